@@ -0,0 +1,232 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// ARCConfig represents the configuration used to seal emails with ARC
+	// (RFC 8617), typically by a mailing list or a forwarding service which
+	// modifies the emails it received and authenticated.
+	ARCConfig struct {
+		// Domain is the signing domain, the d= tag of the ARC-Seal and
+		// ARC-Message-Signature header fields.
+		Domain string
+		// Selector is the selector of the public key published in the DNS under
+		// <selector>._domainkey.<domain>, the s= tag of the signatures.
+		Selector string
+		// PrivateKey is the key used to seal the emails, it must be an
+		// *rsa.PrivateKey or an ed25519.PrivateKey.
+		PrivateKey crypto.Signer
+		// Headers is the list of header fields signed by the
+		// ARC-Message-Signature. By default, DefaultDKIMHeaders is used. The
+		// From header is always signed and the ARC header fields never are.
+		Headers []string
+		// AuthServID is the authserv-id of the ARC-Authentication-Results
+		// header, the name of the service which authenticated the email when it
+		// was received. By default, Domain is used.
+		AuthServID string
+		// AuthResults is the result of this authentication written in the
+		// ARC-Authentication-Results header as described in RFC 8601, such as
+		// "spf=pass smtp.mailfrom=example.org; dkim=pass header.d=example.org".
+		// By default, "none" is used.
+		AuthResults string
+		// ChainValidation is the result of the validation of the ARC sets
+		// already in the email, "pass" or "fail", which is the cv= tag of the
+		// ARC-Seal. It must be set to seal an email which has ARC sets and it
+		// is ignored otherwise.
+		ChainValidation string
+	}
+
+	arcSender struct {
+		wrapper
+		config ARCConfig
+	}
+
+	// arcSet holds the ARC-Authentication-Results, ARC-Message-Signature and
+	// ARC-Seal fields, in that order, of an instance.
+	arcSet [3]*headerField
+)
+
+// maxARCInstance is the maximum number of ARC sets of an email.
+const maxARCInstance = 50
+
+var arcFieldNames = [3]string{"ARC-Authentication-Results", "ARC-Message-Signature", "ARC-Seal"}
+
+// ARCSender returns a Sender that seals the emails with ARC using config before
+// delegating them to s. Like with DKIMSender, the whole email is rendered in
+// memory before being sent.
+func ARCSender(s Sender, config ARCConfig) Sender {
+	return &arcSender{wrapper: wrapper{s}, config: config}
+}
+
+func (s *arcSender) Send(from string, to []string, msg io.WriterTo) error {
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return err
+	}
+
+	sealed, err := s.config.Seal(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return s.s.Send(from, to, rawMessage(sealed))
+}
+
+// Seal returns a copy of the rendered email msg with a new ARC set prepended:
+// the ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results header
+// fields, whose instance follows the ARC sets already in msg.
+func (c *ARCConfig) Seal(msg []byte) ([]byte, error) {
+	if c.Domain == "" || c.Selector == "" {
+		return nil, errors.New("mailer: ARC domain and selector must be set")
+	}
+	algorithm, hash, ok := signingAlgorithm(c.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("mailer: unsupported ARC private key type %T", c.PrivateKey)
+	}
+
+	header, body := splitMessage(msg)
+	fields := parseHeaderFields(header)
+	sets, err := arcSets(fields)
+	if err != nil {
+		return nil, err
+	}
+
+	i := len(sets) + 1
+	if i > maxARCInstance {
+		return nil, fmt.Errorf("mailer: the email already has %d ARC sets", len(sets))
+	}
+	cv := "none"
+	if i > 1 {
+		cv = c.ChainValidation
+		if cv != "pass" && cv != "fail" {
+			return nil, errors.New(`mailer: ARCConfig.ChainValidation must be "pass" or "fail" to seal an email which has ARC sets`)
+		}
+	}
+
+	authServID := c.AuthServID
+	if authServID == "" {
+		authServID = c.Domain
+	}
+	results := c.AuthResults
+	if results == "" {
+		results = "none"
+	}
+	instance := "i=" + strconv.Itoa(i)
+	tags := "; a=" + algorithm + "; d=" + c.Domain + "; s=" + c.Selector +
+		"; t=" + strconv.FormatInt(now().Unix(), 10)
+
+	aar := &headerField{
+		name: arcFieldNames[0],
+		raw:  arcFieldNames[0] + ": " + instance + "; " + authServID + ";\r\n " + results + "\r\n",
+	}
+
+	names := c.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+	var notARC []string
+	for _, name := range names {
+		if !strings.HasPrefix(strings.ToLower(name), "arc-") {
+			notARC = append(notARC, name)
+		}
+	}
+	signed, names := selectHeaderFields(fields, notARC)
+	if !containsFold(names, "From") {
+		return nil, errors.New(`mailer: invalid message, "From" field is absent`)
+	}
+
+	bodyHash := sha256.Sum256(CanonicalizationRelaxed.body(body))
+	value := instance + tags + "; c=relaxed/relaxed;\r\n" +
+		" h=" + strings.Join(names, ":") + ";\r\n" +
+		" bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n" +
+		" b="
+	b, err := signHeaderFields(c.PrivateKey, hash, CanonicalizationRelaxed, signed, arcFieldNames[1]+": "+value)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: could not sign message with ARC: %v", err)
+	}
+	ams := &headerField{name: arcFieldNames[1], raw: arcFieldNames[1] + ": " + value + b + "\r\n"}
+
+	// The seal signs the ARC sets in the order of their instances, without
+	// its own b= tag.
+	var sealed []headerField
+	for _, set := range append(sets, arcSet{aar, ams}) {
+		for _, f := range set {
+			if f != nil {
+				sealed = append(sealed, *f)
+			}
+		}
+	}
+	value = instance + tags + "; cv=" + cv + ";\r\n b="
+	b, err = signHeaderFields(c.PrivateKey, hash, CanonicalizationRelaxed, sealed, arcFieldNames[2]+": "+value)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: could not seal message with ARC: %v", err)
+	}
+	seal := arcFieldNames[2] + ": " + value + b + "\r\n"
+
+	return append([]byte(seal+ams.raw+aar.raw), msg...), nil
+}
+
+// arcSets returns the ARC sets of the header fields in the order of their
+// instances. The instances must be complete and numbered from 1.
+func arcSets(fields []headerField) ([]arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+	for k := range fields {
+		f := &fields[k]
+		for j, name := range arcFieldNames {
+			if !strings.EqualFold(f.name, name) {
+				continue
+			}
+			i := arcInstance(f.raw)
+			if i < 1 || i > maxARCInstance {
+				return nil, fmt.Errorf("mailer: invalid ARC instance in %s field", f.name)
+			}
+			set, ok := byInstance[i]
+			if !ok {
+				set = new(arcSet)
+				byInstance[i] = set
+			}
+			if set[j] != nil {
+				return nil, fmt.Errorf("mailer: invalid ARC set %d", i)
+			}
+			set[j] = f
+		}
+	}
+
+	sets := make([]arcSet, len(byInstance))
+	for i := range sets {
+		set, ok := byInstance[i+1]
+		if !ok || set[0] == nil || set[1] == nil || set[2] == nil {
+			return nil, fmt.Errorf("mailer: invalid ARC set %d", i+1)
+		}
+		sets[i] = *set
+	}
+	return sets, nil
+}
+
+// arcInstance returns the value of the i= tag of a raw ARC header field, or 0
+// if it has none.
+func arcInstance(raw string) int {
+	value := raw[strings.IndexByte(raw, ':')+1:]
+	for _, tag := range strings.Split(value, ";") {
+		tag = strings.Join(strings.Fields(tag), "")
+		if strings.HasPrefix(tag, "i=") {
+			if i, err := strconv.Atoi(tag[2:]); err == nil {
+				return i
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,146 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestARCSender(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	m := NewMessage()
+	m.SetHeader("From", testFrom)
+	m.SetHeader("To", testTo1, testTo2)
+	m.SetSubject("A long subject that will certainly be folded by the message writer when rendered")
+	m.SetBody("text/plain", testBody)
+
+	config := ARCConfig{
+		Domain:      "example.com",
+		Selector:    "mail",
+		PrivateKey:  rsaKey,
+		AuthResults: "spf=pass smtp.mailfrom=example.org",
+	}
+	var got []byte
+	s := ARCSender(SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		buf := new(bytes.Buffer)
+		_, err := msg.WriteTo(buf)
+		got = buf.Bytes()
+		return err
+	}), config)
+	assert.NoError(t, Send(s, m))
+
+	header, _ := splitMessage(got)
+	fields := parseHeaderFields(header)
+	assert.Equal(t, "ARC-Authentication-Results: i=1; example.com;\r\n spf=pass smtp.mailfrom=example.org\r\n", fields[2].raw)
+	verifyARC(t, got, rsaKey.Public(), 1)
+}
+
+func TestARCSealChain(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	c := &ARCConfig{Domain: "example.com", Selector: "mail", PrivateKey: edKey}
+	msg, err := c.Seal([]byte(testMsg))
+	assert.NoError(t, err)
+	verifyARC(t, msg, edKey.Public(), 1)
+
+	c = &ARCConfig{Domain: "lists.example.net", Selector: "arc", PrivateKey: edKey, AuthServID: "mx.example.net"}
+	_, err = c.Seal(msg)
+	assert.EqualError(t, err, `mailer: ARCConfig.ChainValidation must be "pass" or "fail" to seal an email which has ARC sets`)
+
+	c.ChainValidation = "pass"
+	msg, err = c.Seal(msg)
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(msg), "ARC-Seal: i=2; a=ed25519-sha256; d=lists.example.net; s=arc;"))
+	assert.Contains(t, string(msg), "ARC-Authentication-Results: i=2; mx.example.net;\r\n none\r\n")
+	verifyARC(t, msg, edKey.Public(), 2)
+}
+
+func TestARCSealErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	c := &ARCConfig{Domain: "example.com", PrivateKey: rsaKey}
+	_, err = c.Seal([]byte(testMsg))
+	assert.EqualError(t, err, "mailer: ARC domain and selector must be set")
+
+	c.Selector = "mail"
+	_, err = c.Seal([]byte("To: " + testTo1 + "\r\n\r\nBody"))
+	assert.EqualError(t, err, `mailer: invalid message, "From" field is absent`)
+
+	_, err = c.Seal([]byte("ARC-Seal: i=1; cv=none; b=\r\n" + testMsg))
+	assert.EqualError(t, err, "mailer: invalid ARC set 1")
+
+	_, err = c.Seal([]byte("ARC-Seal: cv=none; b=\r\n" + testMsg))
+	assert.EqualError(t, err, "mailer: invalid ARC instance in ARC-Seal field")
+}
+
+// verifyARC checks the signatures of the ARC set of instance i prepended to
+// msg.
+func verifyARC(t *testing.T, msg []byte, key crypto.PublicKey, i int) {
+	header, body := splitMessage(msg)
+	fields := parseHeaderFields(header)
+	assert.Equal(t, "ARC-Seal", fields[0].name)
+	assert.Equal(t, "ARC-Message-Signature", fields[1].name)
+	assert.Equal(t, "ARC-Authentication-Results", fields[2].name)
+	for _, f := range fields[:3] {
+		assert.Equal(t, i, arcInstance(f.raw))
+	}
+
+	tags := arcTags(fields[1].raw)
+	assert.Equal(t, "relaxed/relaxed", tags["c"])
+	bodyHash := sha256.Sum256(CanonicalizationRelaxed.body(body))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(bodyHash[:]), tags["bh"])
+	signed, names := selectHeaderFields(fields[3:], strings.Split(tags["h"], ":"))
+	assert.Equal(t, strings.Split(tags["h"], ":"), names)
+	verifyARCSignature(t, key, signed, fields[1].raw)
+
+	sets, err := arcSets(fields)
+	assert.NoError(t, err)
+	assert.Len(t, sets, i)
+	var sealed []headerField
+	for _, set := range sets {
+		sealed = append(sealed, *set[0], *set[1], *set[2])
+	}
+	verifyARCSignature(t, key, sealed[:len(sealed)-1], fields[0].raw)
+}
+
+func arcTags(raw string) map[string]string {
+	tags := make(map[string]string)
+	for _, match := range dkimTagRegExp.FindAllStringSubmatch(raw[strings.IndexByte(raw, ':')+1:], -1) {
+		tags[match[1]] = strings.Join(strings.Fields(match[2]), "")
+	}
+	return tags
+}
+
+// verifyARCSignature checks the signature of the fields held by the b= tag of
+// the raw field sig.
+func verifyARCSignature(t *testing.T, key crypto.PublicKey, fields []headerField, sig string) {
+	h := sha256.New()
+	for _, f := range fields {
+		io.WriteString(h, CanonicalizationRelaxed.header(f.raw))
+	}
+	unsigned := sig[:strings.Index(sig, " b=")+3] + "\r\n"
+	io.WriteString(h, strings.TrimSuffix(CanonicalizationRelaxed.header(unsigned), "\r\n"))
+
+	b, err := base64.StdEncoding.DecodeString(arcTags(sig)["b"])
+	assert.NoError(t, err)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		assert.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), b))
+	case ed25519.PublicKey:
+		assert.True(t, ed25519.Verify(key, h.Sum(nil), b))
+	}
+}
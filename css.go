@@ -0,0 +1,465 @@
+package mailer
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"sort"
+	"strings"
+)
+
+type (
+	// cssRule is a CSS rule whose selector can be inlined.
+	cssRule struct {
+		selector    cssSelector
+		specificity [3]int
+		decls       string
+	}
+
+	// cssSelector is a compound selector made of an optional type selector
+	// and of class and ID selectors, such as "p.intro" or "#footer".
+	cssSelector struct {
+		tag     string
+		classes []string
+		ids     []string
+	}
+
+	// tagAttr is an attribute of an HTML tag, start and end being the
+	// offsets of the whole attribute in the tag.
+	tagAttr struct {
+		name       string
+		value      string
+		start, end int
+	}
+)
+
+// inlineCSSParts returns a copy of parts whose HTML parts have their CSS
+// inlined when they are written.
+func inlineCSSParts(parts []*part) []*part {
+	out := make([]*part, len(parts))
+	for i, p := range parts {
+		out[i] = p
+		if !strings.HasPrefix(p.contentType, "text/html") {
+			continue
+		}
+
+		copier := p.copier
+		cp := *p
+		cp.copier = func(w io.Writer) error {
+			buf := new(bytes.Buffer)
+			if err := copier(buf); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, inlineCSS(buf.String()))
+			return err
+		}
+		out[i] = &cp
+	}
+	return out
+}
+
+// inlineCSS moves the rules of the <style> blocks of an HTML document into the
+// style attributes of the elements they match. Only the rules whose selectors
+// are made of type, class and ID selectors are inlined, the other ones and the
+// at-rules such as media queries are kept in a <style> block.
+func inlineCSS(s string) string {
+	s, css, stylePos := extractStyles(s)
+	if stylePos == -1 {
+		return s
+	}
+	rules, kept := parseCSS(css)
+
+	if kept != "" {
+		s = s[:stylePos] + "<style type=\"text/css\">\n" + kept + "\n</style>" + s[stylePos:]
+	}
+
+	var b strings.Builder
+	b.Grow(len(s))
+	skip := ""
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			b.WriteString(s)
+			break
+		}
+		b.WriteString(s[:i])
+		s = s[i:]
+
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end == -1 {
+				end = len(s) - 3
+			}
+			b.WriteString(s[:end+3])
+			s = s[end+3:]
+			continue
+		}
+
+		end := tagEnd(s)
+		if end == -1 {
+			b.WriteString(s)
+			break
+		}
+		tag := s[1:end]
+		s = s[end+1:]
+
+		name, closing := tagName(tag)
+		switch {
+		case skip != "":
+			if closing && name == skip {
+				skip = ""
+			}
+		case name == "script" || name == "style" || name == "head":
+			if !closing {
+				skip = name
+			}
+		case !closing && name != "" && name[0] != '!' && name[0] != '?':
+			tag = applyRules(tag, name, rules)
+		}
+		b.WriteString("<" + tag + ">")
+	}
+
+	return b.String()
+}
+
+// extractStyles removes the <style> blocks of s and returns their content
+// along with the offset of the first one, which is -1 if there are none.
+func extractStyles(s string) (string, string, int) {
+	lower := strings.ToLower(s)
+	var b, css strings.Builder
+	pos := -1
+	for from := 0; ; {
+		i := strings.Index(lower[from:], "<style")
+		if i == -1 {
+			break
+		}
+		i += from
+		if len(lower) > i+6 && !strings.ContainsRune(" \t\r\n/>", rune(lower[i+6])) {
+			// Another element, such as <styles>.
+			from = i + 6
+			continue
+		}
+		open := tagEnd(s[i:])
+		end := strings.Index(lower[i:], "</style")
+		if open == -1 || end == -1 || end < open {
+			break
+		}
+		closeEnd := strings.IndexByte(lower[i+end:], '>')
+		if closeEnd == -1 {
+			break
+		}
+
+		b.WriteString(s[:i])
+		if pos == -1 {
+			pos = b.Len()
+		}
+		css.WriteString(s[i+open+1:i+end] + "\n")
+		s, lower = s[i+end+closeEnd+1:], lower[i+end+closeEnd+1:]
+		from = 0
+	}
+	b.WriteString(s)
+	return b.String(), css.String(), pos
+}
+
+// tagEnd returns the offset of the '>' ending the tag which starts s, skipping
+// the quoted attribute values, or -1 if the tag is not closed.
+func tagEnd(s string) int {
+	var quote byte
+	afterEq := false
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '>':
+			return i
+		case '"', '\'':
+			if afterEq {
+				quote = c
+			}
+			afterEq = false
+		case '=':
+			afterEq = true
+		case ' ', '\t', '\r', '\n', '\f':
+		default:
+			afterEq = false
+		}
+	}
+	return -1
+}
+
+// parseCSS returns the rules of a style sheet which can be inlined, sorted by
+// specificity and then by order of appearance, and the text of the other ones.
+func parseCSS(css string) ([]cssRule, string) {
+	css = stripCSSComments(css)
+
+	var rules []cssRule
+	var kept strings.Builder
+	for {
+		css = strings.TrimSpace(css)
+		if css == "" {
+			break
+		}
+
+		if css[0] == '@' {
+			end := atRuleEnd(css)
+			kept.WriteString(css[:end] + "\n")
+			css = css[end:]
+			continue
+		}
+
+		open := strings.IndexByte(css, '{')
+		if open == -1 {
+			break
+		}
+		closing := strings.IndexByte(css[open:], '}')
+		if closing == -1 {
+			closing = len(css) - open
+		}
+		selectors := css[:open]
+		decls := strings.TrimSuffix(strings.TrimSpace(css[open+1:open+closing]), ";")
+		css = css[min(open+closing+1, len(css)):]
+		if decls == "" {
+			continue
+		}
+
+		var complex []string
+		for _, sel := range strings.Split(selectors, ",") {
+			sel = strings.TrimSpace(sel)
+			if s, ok := parseSelector(sel); ok {
+				rules = append(rules, cssRule{
+					selector:    s,
+					specificity: s.specificity(),
+					decls:       decls,
+				})
+			} else if sel != "" {
+				complex = append(complex, sel)
+			}
+		}
+		if len(complex) > 0 {
+			kept.WriteString(strings.Join(complex, ", ") + " { " + decls + " }\n")
+		}
+	}
+
+	sort.SliceStable(rules, func(i, j int) bool {
+		a, b := rules[i].specificity, rules[j].specificity
+		for k := range a {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return false
+	})
+
+	return rules, strings.TrimSpace(kept.String())
+}
+
+func stripCSSComments(css string) string {
+	for {
+		i := strings.Index(css, "/*")
+		if i == -1 {
+			return css
+		}
+		end := strings.Index(css[i+2:], "*/")
+		if end == -1 {
+			return css[:i]
+		}
+		css = css[:i] + css[i+2+end+2:]
+	}
+}
+
+// atRuleEnd returns the offset of the end of the at-rule starting css, which
+// ends either with a semicolon or with its block.
+func atRuleEnd(css string) int {
+	depth := 0
+	for i := 0; i < len(css); i++ {
+		switch css[i] {
+		case ';':
+			if depth == 0 {
+				return i + 1
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth <= 0 {
+				return i + 1
+			}
+		}
+	}
+	return len(css)
+}
+
+// parseSelector parses a compound selector made of an optional type selector
+// followed by class and ID selectors. It reports false for other selectors.
+func parseSelector(sel string) (cssSelector, bool) {
+	var s cssSelector
+	if sel == "" {
+		return s, false
+	}
+
+	i := 0
+	for i < len(sel) && isCSSNameChar(sel[i]) {
+		i++
+	}
+	s.tag = strings.ToLower(sel[:i])
+	for i < len(sel) {
+		kind := sel[i]
+		if kind != '.' && kind != '#' {
+			return s, false
+		}
+		start := i + 1
+		for i = start; i < len(sel) && isCSSNameChar(sel[i]); i++ {
+		}
+		if i == start {
+			return s, false
+		}
+		if kind == '.' {
+			s.classes = append(s.classes, sel[start:i])
+		} else {
+			s.ids = append(s.ids, sel[start:i])
+		}
+	}
+	return s, true
+}
+
+// specificity returns the number of ID, class and type selectors of s.
+func (s *cssSelector) specificity() [3]int {
+	tags := 0
+	if s.tag != "" {
+		tags = 1
+	}
+	return [3]int{len(s.ids), len(s.classes), tags}
+}
+
+func isCSSNameChar(c byte) bool {
+	return c == '-' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// matches reports whether s matches the element name with the given id and
+// classes.
+func (s *cssSelector) matches(name, id string, classes []string) bool {
+	if s.tag != "" && s.tag != name {
+		return false
+	}
+	for _, i := range s.ids {
+		if i != id {
+			return false
+		}
+	}
+	for _, c := range s.classes {
+		found := false
+		for _, class := range classes {
+			if c == class {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applyRules returns tag with the declarations of the matching rules added to
+// its style attribute. The existing declarations come last so they still take
+// precedence.
+func applyRules(tag, name string, rules []cssRule) string {
+	attrs := tagAttributes(tag)
+	var id, style string
+	var classes []string
+	styleAttr := -1
+	for i, a := range attrs {
+		switch a.name {
+		case "id":
+			id = a.value
+		case "class":
+			classes = strings.Fields(a.value)
+		case "style":
+			style = strings.TrimSuffix(strings.TrimSpace(a.value), ";")
+			styleAttr = i
+		}
+	}
+
+	var decls []string
+	for _, r := range rules {
+		if r.selector.matches(name, id, classes) {
+			decls = append(decls, r.decls)
+		}
+	}
+	if len(decls) == 0 {
+		return tag
+	}
+	if style != "" {
+		decls = append(decls, style)
+	}
+	attr := `style="` + html.EscapeString(strings.Join(decls, "; ")) + `"`
+
+	if styleAttr != -1 {
+		a := attrs[styleAttr]
+		return tag[:a.start] + attr + tag[a.end:]
+	}
+	end := len(tag)
+	if strings.HasSuffix(tag, "/") {
+		end--
+	}
+	return strings.TrimRight(tag[:end], " \t\r\n") + " " + attr + tag[end:]
+}
+
+// tagAttributes returns the attributes of an HTML tag, tag being the content
+// between the angle brackets. The names are lowercased and the values decoded.
+func tagAttributes(tag string) []tagAttr {
+	var attrs []tagAttr
+	i := strings.IndexAny(tag, " \t\r\n/")
+	if i == -1 {
+		return nil
+	}
+	for i < len(tag) {
+		for i < len(tag) && strings.IndexByte(" \t\r\n/", tag[i]) != -1 {
+			i++
+		}
+		start := i
+		for i < len(tag) && strings.IndexByte(" \t\r\n/=", tag[i]) == -1 {
+			i++
+		}
+		if i == start {
+			break
+		}
+		a := tagAttr{name: strings.ToLower(tag[start:i]), start: start}
+
+		j := i
+		for j < len(tag) && strings.IndexByte(" \t\r\n", tag[j]) != -1 {
+			j++
+		}
+		if j < len(tag) && tag[j] == '=' {
+			j++
+			for j < len(tag) && strings.IndexByte(" \t\r\n", tag[j]) != -1 {
+				j++
+			}
+			if j < len(tag) && (tag[j] == '"' || tag[j] == '\'') {
+				end := strings.IndexByte(tag[j+1:], tag[j])
+				if end == -1 {
+					end = len(tag) - j - 1
+				}
+				a.value = tag[j+1 : j+1+end]
+				i = min(j+end+2, len(tag))
+			} else {
+				end := j
+				for end < len(tag) && strings.IndexByte(" \t\r\n", tag[end]) == -1 {
+					end++
+				}
+				a.value = tag[j:end]
+				i = end
+			}
+			a.value = html.UnescapeString(a.value)
+		}
+		a.end = i
+		attrs = append(attrs, a)
+	}
+	return attrs
+}
@@ -0,0 +1,88 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInlineCSSTransform(t *testing.T) {
+	tests := []struct {
+		html, want string
+	}{
+		{"<p>No style</p>", "<p>No style</p>"},
+		{
+			"<style>p { color: red; }</style><p>Hi</p><P class=x>Up</P>",
+			`<p style="color: red">Hi</p><P class=x style="color: red">Up</P>`,
+		},
+		{
+			`<style type="text/css">
+				/* The rules are applied by specificity. */
+				#main { color: blue }
+				.note, em { font-weight: bold; }
+				p { color: red; margin: 0 }
+				p.note.big { font-size: 20px }
+			</style>
+			<p id="main" class="note">A</p><p class="big note" style="margin: 1px;">B</p><em>C</em><br/>`,
+			"\n\t\t\t" + `<p id="main" class="note" style="color: red; margin: 0; font-weight: bold; color: blue">A</p>` +
+				`<p class="big note" style="color: red; margin: 0; font-weight: bold; font-size: 20px; margin: 1px">B</p>` +
+				`<em style="font-weight: bold">C</em><br/>`,
+		},
+		{
+			"<html><head><style>@media (max-width: 600px) { td { display: block } }\na:hover, td { color: green }</style></head>" +
+				"<body><td>Cell</td><a href=\"#\">Link</a><!-- <td> --><img src=x.png /></body></html>",
+			"<html><head><style type=\"text/css\">\n@media (max-width: 600px) { td { display: block } }\na:hover { color: green }\n</style></head>" +
+				"<body><td style=\"color: green\">Cell</td><a href=\"#\">Link</a><!-- <td> --><img src=x.png /></body></html>",
+		},
+		{
+			`<style>a { font-family: "Helvetica" }</style><a href="x">X</a>`,
+			`<a href="x" style="font-family: &#34;Helvetica&#34;">X</a>`,
+		},
+		{
+			`<style>a { color: red }</style><a title="1 > 0" href='x>y'>X</a>`,
+			`<a title="1 > 0" href='x>y' style="color: red">X</a>`,
+		},
+		{
+			`<styles>Not a style sheet</styles><style media="a>b">p { color: red }</style><p>Hi</p>`,
+			`<styles>Not a style sheet</styles><p style="color: red">Hi</p>`,
+		},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, inlineCSS(test.html), test.html)
+	}
+}
+
+func TestInlineCSS(t *testing.T) {
+	m := NewMessage(InlineCSS(), AutoPlainText())
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.Body(`<style>p { color: red }</style><p>Hello</p>`, true)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Hello\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p style=3D\"color: red\">Hello</p>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	testMessage(t, m, 1, want)
+
+	// The body of the message is not modified.
+	assert.Equal(t, "text/html", m.parts[0].contentType)
+	assert.Len(t, m.writtenParts(), 2)
+	assert.Len(t, m.parts, 1)
+}
@@ -0,0 +1,324 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+type (
+	// Canonicalization represents a DKIM canonicalization algorithm as defined
+	// in RFC 6376, 3.4.
+	Canonicalization string
+
+	// DKIMConfig represents the configuration used to sign emails with DKIM.
+	DKIMConfig struct {
+		// Domain is the signing domain, the d= tag of the signature.
+		Domain string
+		// Selector is the selector of the public key published in the DNS under
+		// <selector>._domainkey.<domain>, the s= tag of the signature.
+		Selector string
+		// PrivateKey is the key used to sign the emails, it must be an
+		// *rsa.PrivateKey or an ed25519.PrivateKey.
+		PrivateKey crypto.Signer
+		// Headers is the list of header fields to sign. By default,
+		// DefaultDKIMHeaders is used. The From header is always signed.
+		Headers []string
+		// HeaderCanonicalization is the canonicalization algorithm of the
+		// headers. By default, relaxed canonicalization is used.
+		HeaderCanonicalization Canonicalization
+		// BodyCanonicalization is the canonicalization algorithm of the body.
+		// By default, relaxed canonicalization is used.
+		BodyCanonicalization Canonicalization
+	}
+
+	dkimSender struct {
+		wrapper
+		config DKIMConfig
+	}
+
+	headerField struct {
+		name string
+		raw  string
+	}
+)
+
+const (
+	// CanonicalizationSimple represents the "simple" canonicalization which
+	// tolerates almost no modification of the email.
+	CanonicalizationSimple Canonicalization = "simple"
+	// CanonicalizationRelaxed represents the "relaxed" canonicalization which
+	// tolerates common modifications such as whitespace replacement and
+	// header line rewrapping.
+	CanonicalizationRelaxed Canonicalization = "relaxed"
+)
+
+// DefaultDKIMHeaders is the list of header fields signed when
+// DKIMConfig.Headers is empty.
+var DefaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "Mime-Version", "Content-Type",
+}
+
+// DKIMSender returns a Sender that signs the emails with DKIM using config
+// before delegating them to s. Signing needs the whole email, so it is
+// rendered in memory before being sent.
+func DKIMSender(s Sender, config DKIMConfig) Sender {
+	return &dkimSender{wrapper: wrapper{s}, config: config}
+}
+
+func (s *dkimSender) Send(from string, to []string, msg io.WriterTo) error {
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return err
+	}
+
+	signed, err := s.config.Sign(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return s.s.Send(from, to, rawMessage(signed))
+}
+
+// Sign returns a copy of the rendered email msg with a DKIM-Signature header
+// prepended.
+func (c *DKIMConfig) Sign(msg []byte) ([]byte, error) {
+	sig, err := c.signature(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(sig), msg...), nil
+}
+
+// signature returns the DKIM-Signature header field of msg, including the
+// trailing CRLF.
+func (c *DKIMConfig) signature(msg []byte) (string, error) {
+	if c.Domain == "" || c.Selector == "" {
+		return "", errors.New("mailer: DKIM domain and selector must be set")
+	}
+
+	algorithm, hash, ok := signingAlgorithm(c.PrivateKey)
+	if !ok {
+		return "", fmt.Errorf("mailer: unsupported DKIM private key type %T", c.PrivateKey)
+	}
+
+	hc := c.HeaderCanonicalization
+	if hc == "" {
+		hc = CanonicalizationRelaxed
+	}
+	bc := c.BodyCanonicalization
+	if bc == "" {
+		bc = CanonicalizationRelaxed
+	}
+	if !hc.valid() || !bc.valid() {
+		return "", fmt.Errorf("mailer: invalid DKIM canonicalization %s/%s", hc, bc)
+	}
+
+	header, body := splitMessage(msg)
+	fields := parseHeaderFields(header)
+
+	bodyHash := sha256.Sum256(bc.body(body))
+
+	names := c.Headers
+	if len(names) == 0 {
+		names = DefaultDKIMHeaders
+	}
+	if !containsFold(names, "From") {
+		names = append([]string{"From"}, names...)
+	}
+	signed, names := selectHeaderFields(fields, names)
+	if !containsFold(names, "From") {
+		return "", errors.New(`mailer: invalid message, "From" field is absent`)
+	}
+
+	value := "v=1; a=" + algorithm + "; c=" + string(hc) + "/" + string(bc) +
+		"; d=" + c.Domain + "; s=" + c.Selector +
+		"; t=" + strconv.FormatInt(now().Unix(), 10) + ";\r\n" +
+		" h=" + strings.Join(names, ":") + ";\r\n" +
+		" bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";\r\n" +
+		" b="
+
+	b, err := signHeaderFields(c.PrivateKey, hash, hc, signed, "DKIM-Signature: "+value)
+	if err != nil {
+		return "", fmt.Errorf("mailer: could not sign message with DKIM: %v", err)
+	}
+
+	return "DKIM-Signature: " + value + b + "\r\n", nil
+}
+
+// signingAlgorithm returns the name of the signature algorithm of key and the
+// options to sign with it.
+func signingAlgorithm(key crypto.Signer) (string, crypto.SignerOpts, bool) {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", crypto.SHA256, true
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", crypto.Hash(0), true
+	default:
+		return "", nil, false
+	}
+}
+
+// signHeaderFields signs the fields canonicalized with c followed by the field
+// holding the signature, whose b= tag ends it and is still empty. It returns
+// the signature encoded and folded for the b= tag.
+func signHeaderFields(key crypto.Signer, opts crypto.SignerOpts, c Canonicalization, fields []headerField, sigField string) (string, error) {
+	h := sha256.New()
+	for _, f := range fields {
+		io.WriteString(h, c.header(f.raw))
+	}
+	io.WriteString(h, strings.TrimSuffix(c.header(sigField+"\r\n"), "\r\n"))
+
+	b, err := key.Sign(rand.Reader, h.Sum(nil), opts)
+	if err != nil {
+		return "", err
+	}
+	return foldBase64(base64.StdEncoding.EncodeToString(b)), nil
+}
+
+func (c Canonicalization) valid() bool {
+	return c == CanonicalizationSimple || c == CanonicalizationRelaxed
+}
+
+// header canonicalizes a raw header field, including its trailing CRLF.
+func (c Canonicalization) header(raw string) string {
+	if c == CanonicalizationSimple {
+		return raw
+	}
+
+	i := strings.IndexByte(raw, ':')
+	name := strings.ToLower(strings.TrimRight(raw[:i], " \t"))
+	value := strings.Replace(raw[i+1:], "\r\n", "", -1)
+	value = strings.TrimLeft(compressWSP(value), " ")
+
+	return name + ":" + value + "\r\n"
+}
+
+// body canonicalizes the body of an email.
+func (c Canonicalization) body(body []byte) []byte {
+	lines := strings.Split(string(body), "\r\n")
+	if c == CanonicalizationRelaxed {
+		for i, line := range lines {
+			lines[i] = compressWSP(line)
+		}
+	}
+
+	// Remove the empty lines at the end of the body, the last element being
+	// what follows the final CRLF.
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) == 0 {
+		if c == CanonicalizationSimple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+
+	return []byte(strings.Join(lines, "\r\n") + "\r\n")
+}
+
+// compressWSP reduces all sequences of whitespace of line to a single space
+// and removes the trailing whitespace.
+func compressWSP(line string) string {
+	var b strings.Builder
+	space := false
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if c == ' ' || c == '\t' {
+			space = true
+			continue
+		}
+		if space {
+			b.WriteByte(' ')
+			space = false
+		}
+		b.WriteByte(c)
+	}
+	return b.String()
+}
+
+// splitMessage splits a rendered email into its header, including the CRLF
+// ending the last header field, and its body.
+func splitMessage(msg []byte) (header, body []byte) {
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i != -1 {
+		return msg[:i+2], msg[i+4:]
+	}
+	return msg, nil
+}
+
+// parseHeaderFields splits a raw header into its fields, keeping their folding.
+func parseHeaderFields(header []byte) []headerField {
+	var fields []headerField
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1].raw += line
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+		fields = append(fields, headerField{
+			name: strings.TrimRight(line[:i], " \t"),
+			raw:  line,
+		})
+	}
+	return fields
+}
+
+// selectHeaderFields returns the fields to sign for the given names, and the
+// names actually found. When a field appears several times, instances are
+// selected from the bottom of the header as required by RFC 6376, 5.4.2.
+func selectHeaderFields(fields []headerField, names []string) ([]headerField, []string) {
+	used := make([]bool, len(fields))
+	var signed []headerField
+	var found []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fields[i].name, name) {
+				used[i] = true
+				signed = append(signed, fields[i])
+				found = append(found, fields[i].name)
+				break
+			}
+		}
+	}
+	return signed, found
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// foldBase64 folds a base64 encoded tag value so header lines stay short.
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72])
+		b.WriteString("\r\n ")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
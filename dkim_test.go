@@ -0,0 +1,147 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Example from RFC 6376, 3.4.5.
+const canonicalizationExample = "A: X\r\n" +
+	"B : Y\t\r\n" +
+	"\tZ  \r\n" +
+	"\r\n" +
+	" C \r\n" +
+	"D \t E\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestDKIMCanonicalization(t *testing.T) {
+	header, body := splitMessage([]byte(canonicalizationExample))
+	fields := parseHeaderFields(header)
+	assert.Len(t, fields, 2)
+
+	var relaxed, simple string
+	for _, f := range fields {
+		relaxed += CanonicalizationRelaxed.header(f.raw)
+		simple += CanonicalizationSimple.header(f.raw)
+	}
+	assert.Equal(t, "a:X\r\nb:Y Z\r\n", relaxed)
+	assert.Equal(t, "A: X\r\nB : Y\t\r\n\tZ  \r\n", simple)
+
+	assert.Equal(t, " C\r\nD E\r\n", string(CanonicalizationRelaxed.body(body)))
+	assert.Equal(t, " C \r\nD \t E\r\n", string(CanonicalizationSimple.body(body)))
+
+	assert.Equal(t, "", string(CanonicalizationRelaxed.body(nil)))
+	assert.Equal(t, "\r\n", string(CanonicalizationSimple.body([]byte("\r\n\r\n"))))
+}
+
+func TestDKIMSender(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+
+	for _, config := range []DKIMConfig{
+		{Domain: "example.com", Selector: "mail", PrivateKey: rsaKey},
+		{
+			Domain:                 "example.com",
+			Selector:               "mail",
+			PrivateKey:             edKey,
+			Headers:                []string{"Subject", "To"},
+			HeaderCanonicalization: CanonicalizationSimple,
+			BodyCanonicalization:   CanonicalizationSimple,
+		},
+	} {
+		m := NewMessage()
+		m.SetHeader("From", testFrom)
+		m.SetHeader("To", testTo1, testTo2)
+		m.SetSubject("A long subject that will certainly be folded by the message writer when rendered")
+		m.SetBody("text/plain", testBody)
+
+		var got []byte
+		s := DKIMSender(SendFunc(func(from string, to []string, msg io.WriterTo) error {
+			buf := new(bytes.Buffer)
+			_, err := msg.WriteTo(buf)
+			got = buf.Bytes()
+			return err
+		}), config)
+		assert.NoError(t, Send(s, m))
+
+		verifyDKIM(t, got, config.PrivateKey.Public())
+	}
+}
+
+func TestDKIMSignErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	assert.NoError(t, err)
+
+	c := &DKIMConfig{Domain: "example.com", PrivateKey: rsaKey}
+	_, err = c.Sign([]byte(testMsg))
+	assert.EqualError(t, err, "mailer: DKIM domain and selector must be set")
+
+	c.Selector = "mail"
+	_, err = c.Sign([]byte("To: " + testTo1 + "\r\n\r\nBody"))
+	assert.EqualError(t, err, `mailer: invalid message, "From" field is absent`)
+
+	c.BodyCanonicalization = "nowsp"
+	_, err = c.Sign([]byte(testMsg))
+	assert.EqualError(t, err, "mailer: invalid DKIM canonicalization relaxed/nowsp")
+}
+
+var dkimTagRegExp = regexp.MustCompile(`(\w+)=([^;]*)`)
+
+// verifyDKIM checks the DKIM-Signature prepended to msg.
+func verifyDKIM(t *testing.T, msg []byte, key crypto.PublicKey) {
+	header, body := splitMessage(msg)
+	fields := parseHeaderFields(header)
+	assert.Equal(t, "DKIM-Signature", fields[0].name)
+
+	tags := make(map[string]string)
+	value := fields[0].raw[len("DKIM-Signature:"):]
+	for _, match := range dkimTagRegExp.FindAllStringSubmatch(value, -1) {
+		tags[match[1]] = strings.Join(strings.Fields(match[2]), "")
+	}
+	assert.Equal(t, "1", tags["v"])
+	assert.Equal(t, "example.com", tags["d"])
+	assert.Equal(t, "mail", tags["s"])
+
+	c := strings.Split(tags["c"], "/")
+	hc, bc := Canonicalization(c[0]), Canonicalization(c[1])
+
+	bodyHash := sha256.Sum256(bc.body(body))
+	assert.Equal(t, base64.StdEncoding.EncodeToString(bodyHash[:]), tags["bh"])
+
+	signed, names := selectHeaderFields(fields[1:], strings.Split(tags["h"], ":"))
+	assert.Equal(t, strings.Split(tags["h"], ":"), names)
+	assert.Equal(t, "From", names[0])
+
+	h := sha256.New()
+	for _, f := range signed {
+		io.WriteString(h, hc.header(f.raw))
+	}
+	unsigned := fields[0].raw[:strings.Index(fields[0].raw, " b=")+3] + "\r\n"
+	io.WriteString(h, strings.TrimSuffix(hc.header(unsigned), "\r\n"))
+
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	assert.NoError(t, err)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		assert.Equal(t, "rsa-sha256", tags["a"])
+		assert.NoError(t, rsa.VerifyPKCS1v15(key, crypto.SHA256, h.Sum(nil), sig))
+	case ed25519.PublicKey:
+		assert.Equal(t, "ed25519-sha256", tags["a"])
+		assert.True(t, ed25519.Verify(key, h.Sum(nil), sig))
+	}
+}
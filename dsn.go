@@ -0,0 +1,113 @@
+package mailer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type (
+	// DSNEvent is an event for which a delivery status notification is
+	// requested, as defined in RFC 3461.
+	DSNEvent string
+
+	// DSNReturn defines how much of the email is returned in a failure
+	// delivery status notification.
+	DSNReturn string
+
+	dsnRequest struct {
+		notify []DSNEvent
+		ret    DSNReturn
+	}
+)
+
+const (
+	// DSNSuccess requests a notification when the email is delivered.
+	DSNSuccess DSNEvent = "SUCCESS"
+	// DSNFailure requests a notification when the email cannot be delivered.
+	DSNFailure DSNEvent = "FAILURE"
+	// DSNDelay requests a notification when the delivery is delayed.
+	DSNDelay DSNEvent = "DELAY"
+	// DSNNever requests no notification at all, it cannot be combined with
+	// other events.
+	DSNNever DSNEvent = "NEVER"
+)
+
+const (
+	// DSNReturnFull returns the whole email in the notifications.
+	DSNReturnFull DSNReturn = "FULL"
+	// DSNReturnHeaders only returns the headers of the email in the
+	// notifications.
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+// RequestDSN requests delivery status notifications for the email as defined in
+// RFC 3461. The NOTIFY parameter is set to the notify events and the original
+// recipient to each recipient address, while the RET parameter is set to ret
+// when it is not empty. When notify is empty, the server decides when to notify.
+//
+// The parameters are only sent by the Sender returned by Dialer.Dial when the
+// server advertises the DSN extension. They are lost when the email is given
+// to a Sender which renders it first, such as DKIMSender or SMIMESender.
+func (m *Message) RequestDSN(notify []DSNEvent, ret DSNReturn) error {
+	for _, e := range notify {
+		switch e {
+		case DSNSuccess, DSNFailure, DSNDelay:
+		case DSNNever:
+			if len(notify) > 1 {
+				return errors.New("mailer: the DSN NEVER event cannot be combined with other events")
+			}
+		default:
+			return fmt.Errorf("mailer: invalid DSN event %q", e)
+		}
+	}
+
+	switch ret {
+	case "", DSNReturnFull, DSNReturnHeaders:
+	default:
+		return fmt.Errorf("mailer: invalid DSN return %q", ret)
+	}
+
+	m.dsn = &dsnRequest{notify: append([]DSNEvent(nil), notify...), ret: ret}
+	return nil
+}
+
+// mailParams returns the DSN parameters of the MAIL command.
+func (r *dsnRequest) mailParams() string {
+	if r.ret == "" {
+		return ""
+	}
+	return " RET=" + string(r.ret)
+}
+
+// rcptParams returns the DSN parameters of the RCPT command for addr. The
+// original recipient is only given for ASCII addresses since the "utf-8"
+// address type of RFC 6533 is not widely supported.
+func (r *dsnRequest) rcptParams(addr string) string {
+	var params string
+	if len(r.notify) > 0 {
+		events := make([]string, len(r.notify))
+		for i, e := range r.notify {
+			events[i] = string(e)
+		}
+		params = " NOTIFY=" + strings.Join(events, ",")
+	}
+	if isASCII(addr) {
+		params += " ORCPT=rfc822;" + xtext(addr)
+	}
+	return params
+}
+
+// xtext encodes s as defined in RFC 3461, section 4.
+func xtext(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			fmt.Fprintf(&b, "+%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
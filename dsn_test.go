@@ -0,0 +1,62 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestDSN(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to+tag@example.com")
+	m.SetAddressHeader("Cc", "tô@example.com", "")
+	m.SetBody("text/plain", "Test")
+	assert.NoError(t, m.RequestDSN([]DSNEvent{DSNSuccess, DSNFailure}, DSNReturnHeaders))
+
+	srv := &fakeServer{ext: []string{"8BITMIME", "SMTPUTF8", "DSN"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort}
+	assert.NoError(t, d.DialAndSend(m))
+	srv.wait()
+
+	assert.Equal(t, []string{
+		"MAIL FROM:<noreply@example.com> BODY=8BITMIME SMTPUTF8 RET=HDRS",
+		"RCPT TO:<to+tag@example.com> NOTIFY=SUCCESS,FAILURE ORCPT=rfc822;to+2Btag@example.com",
+		"RCPT TO:<tô@example.com> NOTIFY=SUCCESS,FAILURE",
+		"DATA",
+		"QUIT",
+	}, srv.cmds[1:])
+}
+
+func TestRequestDSNUnsupported(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	assert.NoError(t, m.RequestDSN([]DSNEvent{DSNNever}, ""))
+
+	srv := &fakeServer{}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort}
+	assert.NoError(t, d.DialAndSend(m))
+	srv.wait()
+
+	assert.Equal(t, []string{
+		"MAIL FROM:<noreply@example.com>",
+		"RCPT TO:<to@example.com>",
+		"DATA",
+		"QUIT",
+	}, srv.cmds[1:])
+}
+
+func TestRequestDSNErrors(t *testing.T) {
+	m := NewMessage()
+	assert.EqualError(t, m.RequestDSN([]DSNEvent{DSNNever, DSNDelay}, ""), "mailer: the DSN NEVER event cannot be combined with other events")
+	assert.EqualError(t, m.RequestDSN([]DSNEvent{"ALWAYS"}, ""), `mailer: invalid DSN event "ALWAYS"`)
+	assert.EqualError(t, m.RequestDSN(nil, "BODY"), `mailer: invalid DSN return "BODY"`)
+	assert.Nil(t, m.dsn)
+}
+
+func TestXtext(t *testing.T) {
+	assert.Equal(t, "a+2Bb+3Dc@example.com", xtext("a+b=c@example.com"))
+	assert.Equal(t, "a+20b", xtext("a b"))
+}
@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type fileSender struct {
+	dir string
+}
+
+// FileSender returns a SendCloser that writes each email to a new .eml file in
+// dir instead of sending it, it is useful to inspect exactly what would be
+// transmitted to the server during development. The file name is made of the
+// current time and the first recipient of the email.
+func FileSender(dir string) SendCloser {
+	return &fileSender{dir: dir}
+}
+
+func (s *fileSender) Send(from string, to []string, msg io.WriterTo) error {
+	f, err := s.create(emlName(to))
+	if err != nil {
+		return err
+	}
+
+	if _, err := msg.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (s *fileSender) Close() error {
+	return nil
+}
+
+// create creates a new file named after name, adding a counter to the name if
+// a file with the same name already exists.
+func (s *fileSender) create(name string) (*os.File, error) {
+	for i := 1; ; i++ {
+		filename := name + ".eml"
+		if i > 1 {
+			filename = fmt.Sprintf("%s-%d.eml", name, i)
+		}
+
+		f, err := os.OpenFile(filepath.Join(s.dir, filename), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+func emlName(to []string) string {
+	name := now().Format("20060102T150405.000000000")
+	if len(to) == 0 {
+		return name
+	}
+
+	return name + "-" + strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		case r == '@', r == '.', r == '-', r == '_', r == '+':
+			return r
+		}
+		return '_'
+	}, to[0])
+}
@@ -0,0 +1,32 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileSender(t *testing.T) {
+	dir := t.TempDir()
+	s := FileSender(dir)
+
+	m := getTestMessage()
+	assert.NoError(t, Send(s, m, m))
+	assert.NoError(t, s.Close())
+
+	for _, name := range []string{
+		"20140625T174600.000000000-to1@example.com.eml",
+		"20140625T174600.000000000-to1@example.com-2.eml",
+	} {
+		b, err := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.NoError(t, err)
+		compareBodies(t, string(b), testMsg)
+	}
+}
+
+func TestEmlName(t *testing.T) {
+	assert.Equal(t, "20140625T174600.000000000", emlName(nil))
+	assert.Equal(t, "20140625T174600.000000000-bob_smith@example.com", emlName([]string{"bob/smith@example.com"}))
+}
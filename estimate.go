@@ -0,0 +1,151 @@
+package mailer
+
+import "io"
+
+const (
+	// boundaryLineSize is the size of a boundary delimiter line of a multipart
+	// entity created by mime/multipart, whose boundaries have 60 characters.
+	boundaryLineSize = len("\r\n--\r\n") + 60
+	// multipartSize is the size of the header and the closing delimiter of a
+	// multipart entity.
+	multipartSize = len("Content-Type: multipart/alternative;\r\n boundary=\r\n\r\n--\r\n--\r\n") + 2*60
+	// defaultHeaderSize is the size of the default "Mime-Version" and "Date"
+	// fields.
+	defaultHeaderSize = len("Mime-Version: 1.0\r\nDate: Mon, 02 Jan 2006 15:04:05 -0700\r\n")
+)
+
+// byteCounter counts the bytes written to it once encoded, without the
+// soft line breaks: the lone LF are converted to CRLF and some bytes are
+// escaped in quoted-printable.
+type byteCounter struct {
+	n, escaped     int64
+	last, beforeCR byte
+}
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	for _, b := range p {
+		switch {
+		case b == '\r':
+			c.beforeCR = c.last
+		case b == '\n':
+			end := c.last
+			if end == '\r' {
+				end = c.beforeCR
+			} else {
+				c.n++
+			}
+			// The white space ending a line is escaped in quoted-printable.
+			if end == ' ' || end == '\t' {
+				c.escaped++
+			}
+		case b == '=' || b > '~' || (b < ' ' && b != '\t'):
+			c.escaped++
+		}
+		c.last = b
+	}
+	return len(p), nil
+}
+
+// EstimatedSize returns an upper bound of the size in bytes of the email
+// written by WriteTo, for example to choose between an SMTP server and an HTTP
+// API having different size limits, without rendering it.
+//
+// Nothing is generated nor read: the size of the parts is computed from the
+// strings given to SetBody, AddAlternative or Part, with the overhead of their
+// encoding, and the size of the files is taken from the file system, the byte
+// slice or the reader when it has a Len or a Stat method. The estimate is
+// usually within a few percent of the actual size. It is not a bound when the
+// email has content whose size is unknown, which is then not counted: the
+// parts written by a function or a template, the files given by SetCopyFunc or
+// read from another io.Reader, and the changes made by InlineCSS and
+// AutoPlainText.
+func (m *Message) EstimatedSize() int64 {
+	size := int64(defaultHeaderSize) + headerSize(m.header)
+
+	parts, embedded, attachments := m.parts, m.embedded, m.attachments
+	if m.tree != nil {
+		// A nil entity is reported when the email is written.
+		parts, embedded, attachments, _ = m.tree.leaves()
+	}
+
+	for _, p := range parts {
+		size += int64(len("Content-Type: ; charset=\r\nContent-Transfer-Encoding: \r\n\r\n") +
+			len(p.contentType) + len(m.charset) + len(p.encoding))
+		size += m.estimatedPartSize(p)
+	}
+	size += filesSize(embedded, false) + filesSize(attachments, true)
+
+	if count := len(parts) + len(embedded) + len(attachments); count > 1 {
+		// At most three multipart entities are nested: mixed, related and
+		// alternative, the two inner ones being entities of their parents.
+		size += int64((count+2)*boundaryLineSize + 3*multipartSize)
+	}
+	return size
+}
+
+// estimatedPartSize returns the estimated size of the encoded content of p, 0
+// if it is not known.
+func (m *Message) estimatedPartSize(p *part) int64 {
+	if p.body == nil {
+		return 0
+	}
+	c := new(byteCounter)
+	io.WriteString(c, *p.body)
+
+	if m.autoEncoding && !m.encodingSet && !p.encodingSet {
+		return min(encodedSize(QuotedPrintable, c.n, c.escaped), encodedSize(Base64, c.n, 0))
+	}
+	return encodedSize(p.encoding, c.n, c.escaped)
+}
+
+// encodedSize returns the approximate size of n bytes of content encoded
+// with enc, escaped being the number of bytes escaped in quoted-printable.
+func encodedSize(enc Encoding, n, escaped int64) int64 {
+	switch enc {
+	case Base64:
+		size := (n + 2) / 3 * 4
+		return size + 2*(size/maxLineLen+1)
+	case QuotedPrintable:
+		size := n + 2*escaped
+		return size + 3*(size/(maxLineLen-1))
+	default:
+		return n
+	}
+}
+
+// headerSize returns the approximate size of the header fields of h.
+func headerSize(h map[string][]string) int64 {
+	var size int64
+	for k, v := range h {
+		if isBcc(k) {
+			continue
+		}
+		n := int64(len(k) + len(": \r\n"))
+		for i, s := range v {
+			if i > 0 {
+				n += int64(len(", "))
+			}
+			n += int64(len(s))
+		}
+		// A folded line is continued by CRLF and a space.
+		size += n + 3*(n/maxLineLen)
+	}
+	return size
+}
+
+// filesSize returns the estimated size of the files, including the default
+// header fields which are not set yet.
+func filesSize(files []*file, isAttachment bool) int64 {
+	var size int64
+	for _, f := range cloneFiles(files) {
+		f.setDefaultHeaders(isAttachment)
+		size += headerSize(f.Header) + int64(len("\r\n"))
+		if f.size != nil {
+			if n := f.size(); n > 0 {
+				size += encodedSize(Base64, n, 0)
+			}
+		}
+	}
+	return size
+}
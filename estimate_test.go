@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimatedSize(t *testing.T) {
+	dir := t.TempDir()
+	pdf := filepath.Join(dir, "report.pdf")
+	assert.NoError(t, os.WriteFile(pdf, bytes.Repeat([]byte{0, 1, 2, 0xff}, 20000), 0o644))
+
+	text := strings.Repeat("Hello, this is the plain text version of the email.\n", 100)
+	html := "<p>" + strings.Repeat("Café, ", 1000) + "</p>"
+	fsys := fstest.MapFS{"logo.png": {Data: bytes.Repeat([]byte("PNG"), 500)}}
+
+	tests := map[string]func(m *Message){
+		"plain": func(m *Message) {
+			m.SetBody("text/plain", text)
+		},
+		"alternative": func(m *Message) {
+			m.SetBody("text/plain", text)
+			m.AddAlternative("text/html", html)
+		},
+		"attachments": func(m *Message) {
+			m.SetBody("text/plain", text)
+			m.AddAlternative("text/html", html, SetPartEncoding(Base64))
+			m.EmbedFS(fsys, "logo.png")
+			m.EmbedReader("image.jpg", strings.NewReader(strings.Repeat("JPEG", 3000)))
+			m.Attach(pdf)
+			m.AttachBytes("notes.txt", []byte(text))
+		},
+		"tree": func(m *Message) {
+			m.SetTree(m.Mixed(
+				m.Alternative(m.Plain(text), m.Related(m.HTML(html), m.Embedded("logo.png", preloadFile(t, pdf)))),
+				m.Attachment(pdf),
+			))
+		},
+	}
+	for name, build := range tests {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com", "Señor To <to2@example.com>")
+		m.SetHeader("Subject", "Monthly report")
+		build(m)
+
+		estimate := m.EstimatedSize()
+		b, err := m.Render()
+		assert.NoError(t, err)
+		actual := int64(len(b))
+		assert.True(t, estimate >= actual && estimate <= actual+actual/20+500,
+			"%s: estimated %d bytes, got %d", name, estimate, actual)
+	}
+}
+
+func TestEstimatedSizeUnknownContent(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	before := m.EstimatedSize()
+
+	m.Attach("missing.pdf")
+	m.Attach("custom.pdf", SetCopyFunc(func(w io.Writer) error {
+		_, err := w.Write(make([]byte, 10000))
+		return err
+	}))
+	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
+		t.Error("EstimatedSize should not write the parts")
+		return nil
+	})
+	// Only the headers of the files, of the part and of the multipart entity
+	// are counted.
+	assert.True(t, m.EstimatedSize()-before < 2000)
+}
+
+func TestEstimatedSizeUpperBound(t *testing.T) {
+	for _, body := range []string{
+		strings.Repeat("short line \n", 500),
+		strings.Repeat("trailing spaces   \r\n", 500),
+		strings.Repeat("=", 5000),
+		strings.Repeat("é", 5000),
+	} {
+		for _, enc := range []Encoding{QuotedPrintable, Base64, Unencoded} {
+			m := NewMessage(SetEncoding(enc))
+			m.SetHeader("To", "to@example.com")
+			m.SetBody("text/plain", body)
+			b, err := m.Render()
+			assert.NoError(t, err)
+			assert.True(t, m.EstimatedSize() >= int64(len(b)), "%s: estimated %d bytes, got %d", enc, m.EstimatedSize(), len(b))
+		}
+	}
+}
+
+// preloadFile returns PreloadFile(filename) or fails the test.
+func preloadFile(t *testing.T, filename string) FileSetting {
+	s, err := PreloadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
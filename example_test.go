@@ -9,6 +9,7 @@ import (
 	"html/template"
 	"io"
 	"log"
+	"os"
 	"time"
 
 	"github.com/butbetter-id/mailer"
@@ -143,6 +144,30 @@ func Example_noSMTP() {
 
 var m *mailer.Message
 
+func ExampleMessageWriter() {
+	text := template.Must(template.New("text").Parse("Hello {{.}}!"))
+	html := template.Must(template.New("html").Parse("<p>Hello {{.}}!</p>"))
+	f, err := os.Open("/tmp/report.pdf")
+	if err != nil {
+		panic(err)
+	}
+	defer f.Close()
+
+	mw := mailer.NewMessageWriter(os.Stdout)
+	mw.WriteAddressHeader("From", "from@example.com", "Example")
+	mw.WriteHeader("To", "to@example.com")
+	mw.WriteHeader("Subject", "Report")
+	mw.StartMultipart("mixed")
+	mw.StartAlternative()
+	mw.WritePart("text/plain", func(w io.Writer) error { return text.Execute(w, "Bob") })
+	mw.WritePart("text/html", func(w io.Writer) error { return html.Execute(w, "Bob") })
+	mw.EndMultipart()
+	mw.AddAttachment("report.pdf", f)
+	if err := mw.Close(); err != nil {
+		panic(err)
+	}
+}
+
 func ExampleSetCopyFunc() {
 	m.Attach("foo.txt", mailer.SetCopyFunc(func(w io.Writer) error {
 		_, err := w.Write([]byte("Content of foo.txt"))
@@ -0,0 +1,68 @@
+package mailer
+
+import "time"
+
+// Hooks holds callbacks called on the events of the SMTP sessions opened by a
+// Dialer, for example to collect metrics or to log them. The callbacks are
+// called synchronously, possibly from several goroutines when the Dialer is
+// shared, and the nil ones are skipped.
+type Hooks struct {
+	// OnConnect is called when the TCP connection to the server at addr is
+	// opened or fails to be.
+	OnConnect func(addr string, d time.Duration, err error)
+	// OnAuth is called after the authentication to the server.
+	OnAuth func(username string, d time.Duration, err error)
+	// OnMailFrom is called after the MAIL command of each email.
+	OnMailFrom func(from string, d time.Duration, err error)
+	// OnRcptTo is called after the RCPT command of each recipient.
+	OnRcptTo func(to string, d time.Duration, err error)
+	// OnData is called once the content of an email is sent, size being the
+	// number of bytes written.
+	OnData func(size int64, d time.Duration, err error)
+	// OnError is called with the errors returned by Dial and Send.
+	OnError func(err error)
+}
+
+// start returns the time at which the timed event starts, h may be nil.
+func (h *Hooks) start() time.Time {
+	if h == nil {
+		return time.Time{}
+	}
+	return now()
+}
+
+func (h *Hooks) connect(addr string, start time.Time, err error) {
+	if h != nil && h.OnConnect != nil {
+		h.OnConnect(addr, now().Sub(start), err)
+	}
+}
+
+func (h *Hooks) auth(username string, start time.Time, err error) {
+	if h != nil && h.OnAuth != nil {
+		h.OnAuth(username, now().Sub(start), err)
+	}
+}
+
+func (h *Hooks) mailFrom(from string, start time.Time, err error) {
+	if h != nil && h.OnMailFrom != nil {
+		h.OnMailFrom(from, now().Sub(start), err)
+	}
+}
+
+func (h *Hooks) rcptTo(to string, start time.Time, err error) {
+	if h != nil && h.OnRcptTo != nil {
+		h.OnRcptTo(to, now().Sub(start), err)
+	}
+}
+
+func (h *Hooks) data(size int64, start time.Time, err error) {
+	if h != nil && h.OnData != nil {
+		h.OnData(size, now().Sub(start), err)
+	}
+}
+
+func (h *Hooks) error(err error) {
+	if h != nil && h.OnError != nil && err != nil {
+		h.OnError(err)
+	}
+}
@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHooks(t *testing.T) {
+	var events []string
+	hooks := &Hooks{
+		OnConnect: func(addr string, d time.Duration, err error) {
+			events = append(events, fmt.Sprintf("connect %s %v", addr, err))
+		},
+		OnMailFrom: func(from string, d time.Duration, err error) {
+			events = append(events, fmt.Sprintf("mail %s %v", from, err))
+		},
+		OnRcptTo: func(to string, d time.Duration, err error) {
+			events = append(events, fmt.Sprintf("rcpt %s %v", to, err))
+		},
+		OnData: func(size int64, d time.Duration, err error) {
+			events = append(events, fmt.Sprintf("data %d %v", size, err))
+		},
+		OnError: func(err error) {
+			events = append(events, fmt.Sprintf("error %v", err))
+		},
+	}
+
+	m := getTestMessage()
+	b, err := m.Render()
+	assert.NoError(t, err)
+
+	srv := &fakeServer{}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Hooks: hooks}
+	assert.NoError(t, d.DialAndSend(m))
+	srv.wait()
+
+	assert.Equal(t, []string{
+		"connect mail.example.com:587 <nil>",
+		"mail from@example.com <nil>",
+		"rcpt to1@example.com <nil>",
+		"rcpt to2@example.com <nil>",
+		"data " + fmt.Sprint(len(b)) + " <nil>",
+	}, events)
+}
+
+func TestHooksError(t *testing.T) {
+	var connectErr, hookErr error
+	hooks := &Hooks{
+		OnConnect: func(addr string, d time.Duration, err error) { connectErr = err },
+		OnError:   func(err error) { hookErr = err },
+	}
+
+	dialErr := errors.New("connection refused")
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return nil, dialErr
+	}
+
+	d := &Dialer{Host: testHost, Port: testPort, Hooks: hooks}
+	_, err := d.Dial()
+	assert.Equal(t, dialErr, err)
+	assert.Equal(t, dialErr, connectErr)
+	assert.Equal(t, dialErr, hookErr)
+}
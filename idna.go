@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// PunycodeDomains is a message setting to convert the internationalized domain
+// names of the envelope addresses to their ASCII form, so info@münchen.de is
+// sent as info@xn--mnchen-3ya.de in the MAIL FROM and RCPT TO commands. The
+// headers are left unchanged. The local part of an address is never converted,
+// such addresses still require a server supporting SMTPUTF8.
+func PunycodeDomains() MessageSetting {
+	return func(m *Message) {
+		m.punycodeDomains = true
+	}
+}
+
+// toASCIIAddress converts the domain of addr to its ASCII form.
+func toASCIIAddress(addr string) (string, error) {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 || isASCII(addr[i+1:]) {
+		return addr, nil
+	}
+
+	domain, err := toASCIIDomain(addr[i+1:])
+	if err != nil {
+		return "", fmt.Errorf("mailer: invalid domain in address %q: %v", addr, err)
+	}
+	return addr[:i+1] + domain, nil
+}
+
+// toASCIIDomain converts domain to its ASCII form with the IDNA2008 lookup
+// profile of RFC 5891, which maps the labels, such as upper case and width
+// variants, and rejects the invalid ones.
+func toASCIIDomain(domain string) (string, error) {
+	return idna.Lookup.ToASCII(domain)
+}
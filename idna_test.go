@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToASCIIAddress(t *testing.T) {
+	tests := map[string]string{
+		"info@münchen.de":     "info@xn--mnchen-3ya.de",
+		"info@MÜNCHEN.de":     "info@xn--mnchen-3ya.de",
+		"info@example.com":    "info@example.com",
+		"jörg@bücher.example": "jörg@xn--bcher-kva.example",
+		"info@sub.münchen.de": "info@sub.xn--mnchen-3ya.de",
+		"info@ｍüｎｃｈｅｎ.de":     "info@xn--mnchen-3ya.de",
+		"info@他们为什么不说中文.cn":   "info@xn--ihqwcrb4cv8a8dqg056pqjye.cn",
+	}
+	for addr, want := range tests {
+		got, err := toASCIIAddress(addr)
+		assert.NoError(t, err)
+		assert.Equal(t, want, got, addr)
+	}
+
+	for _, addr := range []string{"info@-münchen.de", "info@mün chen.de"} {
+		_, err := toASCIIAddress(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestPunycodeDomains(t *testing.T) {
+	m := NewMessage(PunycodeDomains())
+	m.SetAddressHeader("From", "from@bücher.example", "Bücher")
+	m.SetAddressHeader("To", "info@münchen.de", "")
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@xn--bcher-kva.example",
+		to:   []string{"info@xn--mnchen-3ya.de"},
+		content: "From: =?UTF-8?q?B=C3=BCcher?= <from@bücher.example>\r\n" +
+			"To: info@münchen.de\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m = NewMessage()
+	m.SetAddressHeader("From", "from@bücher.example", "")
+	from, err := m.getFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "from@bücher.example", from)
+}
@@ -1,5 +1,13 @@
 package mailer
 
+import (
+	"fmt"
+	"net/mail"
+	"os"
+	"strconv"
+	"strings"
+)
+
 // Config represents all configurable mailer data smtp credentials
 type (
 	ConfigMailer struct {
@@ -13,7 +21,9 @@ type (
 	}
 )
 
-// Config represents all configurable mailer data smtp credentials
+// Config represents all configurable mailer data smtp credentials. It is
+// optional: NewDialerFromConfig and the WithConfig message setting can be used
+// instead to avoid any global state.
 var Config *ConfigMailer
 
 func New(host string, port int, username string, password string, senderEmail string, senderName string) {
@@ -26,3 +36,48 @@ func New(host string, port int, username string, password string, senderEmail st
 		SenderName:  senderName,
 	}
 }
+
+// NewFromEnv initializes Config like New from the environment variables
+// SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, SENDER_EMAIL and
+// SENDER_NAME. SMTP_HOST and SENDER_EMAIL are required, as is SMTP_PASSWORD
+// when SMTP_USERNAME is set, and SMTP_PORT defaults to 587. Config is left
+// unchanged if a variable is missing or invalid.
+func NewFromEnv() error {
+	var missing []string
+	// The white space around the values is ignored, except for the password
+	// which may contain it.
+	get := func(key string, required bool) string {
+		v := os.Getenv(key)
+		if key != "SMTP_PASSWORD" {
+			v = strings.TrimSpace(v)
+		}
+		if v == "" && required {
+			missing = append(missing, key)
+		}
+		return v
+	}
+
+	host := get("SMTP_HOST", true)
+	port := get("SMTP_PORT", false)
+	username := get("SMTP_USERNAME", false)
+	password := get("SMTP_PASSWORD", username != "")
+	senderEmail := get("SENDER_EMAIL", true)
+	senderName := get("SENDER_NAME", false)
+	if len(missing) > 0 {
+		return fmt.Errorf("mailer: missing environment variables: %s", strings.Join(missing, ", "))
+	}
+
+	p := 587
+	if port != "" {
+		var err error
+		if p, err = strconv.Atoi(port); err != nil || p < 1 || p > 65535 {
+			return fmt.Errorf("mailer: invalid SMTP_PORT %q", port)
+		}
+	}
+	if _, err := mail.ParseAddress(senderEmail); err != nil {
+		return fmt.Errorf("mailer: invalid SENDER_EMAIL %q: %v", senderEmail, err)
+	}
+
+	New(host, p, username, password, senderEmail, senderName)
+	return nil
+}
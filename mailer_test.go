@@ -0,0 +1,47 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewFromEnv(t *testing.T) {
+	config := Config
+	defer func() { Config = config }()
+
+	for _, key := range []string{"SMTP_HOST", "SMTP_PORT", "SMTP_USERNAME", "SMTP_PASSWORD", "SENDER_EMAIL", "SENDER_NAME"} {
+		t.Setenv(key, "")
+	}
+
+	t.Setenv("SMTP_USERNAME", "user")
+	assert.EqualError(t, NewFromEnv(), "mailer: missing environment variables: SMTP_HOST, SMTP_PASSWORD, SENDER_EMAIL")
+	assert.Equal(t, config, Config)
+
+	t.Setenv("SMTP_HOST", "smtp.example.org")
+	t.Setenv("SMTP_PASSWORD", "pwd")
+	t.Setenv("SENDER_EMAIL", "noreply")
+	assert.EqualError(t, NewFromEnv(), `mailer: invalid SENDER_EMAIL "noreply": mail: missing '@' or angle-addr`)
+
+	t.Setenv("SENDER_EMAIL", "noreply@example.org")
+	t.Setenv("SMTP_PORT", "smtp")
+	assert.EqualError(t, NewFromEnv(), `mailer: invalid SMTP_PORT "smtp"`)
+
+	t.Setenv("SMTP_PORT", "")
+	t.Setenv("SENDER_NAME", "Example")
+	assert.NoError(t, NewFromEnv())
+	assert.Equal(t, &ConfigMailer{
+		Host:        "smtp.example.org",
+		Port:        587,
+		Username:    "user",
+		Password:    "pwd",
+		SenderEmail: "noreply@example.org",
+		SenderName:  "Example",
+	}, Config)
+
+	t.Setenv("SMTP_PORT", " 465 ")
+	t.Setenv("SMTP_PASSWORD", " pwd ")
+	assert.NoError(t, NewFromEnv())
+	assert.Equal(t, 465, Config.Port)
+	assert.Equal(t, " pwd ", Config.Password)
+}
@@ -0,0 +1,219 @@
+package mailer
+
+import (
+	"html"
+	"strings"
+)
+
+// MarkdownRenderer converts Markdown to HTML for MarkdownBody. The default
+// renderer supports the common syntax: headings, paragraphs, emphasis, code
+// spans and fenced code blocks, links, images, lists, block quotes and
+// horizontal rules. It can be replaced to use a complete implementation.
+var MarkdownRenderer = renderMarkdown
+
+// MarkdownBody sets the body of the message to the Markdown md: the Markdown
+// itself is the text/plain part and its rendering by MarkdownRenderer is the
+// text/html alternative.
+func (m *Message) MarkdownBody(md string) *Message {
+	m.SetBody("text/plain", md)
+	m.AddAlternative("text/html", MarkdownRenderer(md))
+	return m
+}
+
+// renderMarkdown is the default MarkdownRenderer.
+func renderMarkdown(md string) string {
+	md = strings.ReplaceAll(md, "\r\n", "\n")
+	return strings.Join(markdownBlocks(strings.Split(md, "\n")), "\n")
+}
+
+// markdownBlocks renders the block elements made of lines.
+func markdownBlocks(lines []string) []string {
+	var out, para []string
+	flush := func() {
+		if len(para) > 0 {
+			out = append(out, "<p>"+markdownInline(strings.Join(para, "\n"))+"</p>")
+			para = nil
+		}
+	}
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		switch {
+		case trimmed == "":
+			flush()
+		case strings.HasPrefix(trimmed, "```"):
+			flush()
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code = append(code, lines[i])
+			}
+			out = append(out, "<pre><code>"+html.EscapeString(strings.Join(code, "\n"))+"</code></pre>")
+		case headingLevel(trimmed) > 0:
+			flush()
+			n := headingLevel(trimmed)
+			text := strings.TrimSpace(strings.TrimRight(trimmed[n:], "#"))
+			tag := string(rune('0' + n))
+			out = append(out, "<h"+tag+">"+markdownInline(text)+"</h"+tag+">")
+		case isHorizontalRule(trimmed):
+			flush()
+			out = append(out, "<hr>")
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				l := strings.TrimPrefix(strings.TrimSpace(lines[i]), ">")
+				quote = append(quote, strings.TrimPrefix(l, " "))
+			}
+			i--
+			out = append(out, "<blockquote>\n"+strings.Join(markdownBlocks(quote), "\n")+"\n</blockquote>")
+		case listMarker(trimmed) != "":
+			flush()
+			tag := listMarker(trimmed)
+			var items []string
+			for ; i < len(lines); i++ {
+				t := strings.TrimSpace(lines[i])
+				if t == "" {
+					break
+				}
+				if listMarker(t) == tag {
+					items = append(items, listItemText(t))
+				} else if listMarker(t) == "" && len(items) > 0 {
+					items[len(items)-1] += "\n" + t
+				} else {
+					break
+				}
+			}
+			i--
+			list := "<" + tag + ">"
+			for _, item := range items {
+				list += "\n<li>" + markdownInline(item) + "</li>"
+			}
+			out = append(out, list+"\n</"+tag+">")
+		default:
+			para = append(para, line)
+		}
+	}
+	flush()
+
+	return out
+}
+
+// headingLevel returns the level of the ATX heading line, or 0.
+func headingLevel(line string) int {
+	n := 0
+	for n < len(line) && line[n] == '#' {
+		n++
+	}
+	if n == 0 || n > 6 || (n < len(line) && line[n] != ' ' && line[n] != '\t') {
+		return 0
+	}
+	return n
+}
+
+func isHorizontalRule(line string) bool {
+	s := strings.ReplaceAll(line, " ", "")
+	if len(s) < 3 || (s[0] != '-' && s[0] != '*' && s[0] != '_') {
+		return false
+	}
+	return strings.Count(s, s[:1]) == len(s)
+}
+
+// listMarker returns "ul" or "ol" if line is a list item, and "" otherwise.
+func listMarker(line string) string {
+	if len(line) > 1 && strings.IndexByte("-*+", line[0]) != -1 && line[1] == ' ' {
+		return "ul"
+	}
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i > 0 && i+1 < len(line) && (line[i] == '.' || line[i] == ')') && line[i+1] == ' ' {
+		return "ol"
+	}
+	return ""
+}
+
+func listItemText(line string) string {
+	return strings.TrimSpace(line[strings.IndexByte(line, ' ')+1:])
+}
+
+// markdownInline renders the inline elements of s and escapes the rest.
+func markdownInline(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_[]()#+-.!>", s[i+1]) != -1:
+			i++
+			b.WriteString(html.EscapeString(s[i : i+1]))
+		case c == '`':
+			if end := strings.IndexByte(s[i+1:], '`'); end != -1 {
+				b.WriteString("<code>" + html.EscapeString(s[i+1:i+1+end]) + "</code>")
+				i += end + 1
+				continue
+			}
+			b.WriteByte(c)
+		case c == '!' && strings.HasPrefix(s[i+1:], "["):
+			if text, url, n := markdownLink(s[i+1:]); n > 0 {
+				b.WriteString(`<img src="` + html.EscapeString(url) + `" alt="` + html.EscapeString(text) + `">`)
+				i += n
+				continue
+			}
+			b.WriteByte(c)
+		case c == '[':
+			if text, url, n := markdownLink(s[i:]); n > 0 {
+				b.WriteString(`<a href="` + html.EscapeString(url) + `">` + markdownInline(text) + "</a>")
+				i += n - 1
+				continue
+			}
+			b.WriteByte(c)
+		case c == '*' || c == '_':
+			delim := s[i : i+1]
+			tag := "em"
+			if strings.HasPrefix(s[i+1:], delim) {
+				delim += delim
+				tag = "strong"
+			}
+			start := i + len(delim)
+			end := strings.Index(s[start:], delim)
+			if end > 0 && (c == '*' || i == 0 || !isWordChar(s[i-1])) {
+				b.WriteString("<" + tag + ">" + markdownInline(s[start:start+end]) + "</" + tag + ">")
+				i = start + end + len(delim) - 1
+				continue
+			}
+			b.WriteString(delim)
+			i += len(delim) - 1
+		case c == '\n':
+			if strings.HasSuffix(b.String(), "  ") {
+				trimmed := strings.TrimRight(b.String(), " ")
+				b.Reset()
+				b.WriteString(trimmed + "<br>")
+			}
+			b.WriteByte('\n')
+		default:
+			b.WriteString(html.EscapeString(s[i : i+1]))
+		}
+	}
+	return b.String()
+}
+
+// markdownLink parses a link such as "[text](url)" at the beginning of s and
+// returns its text, its URL and its length, which is 0 if s does not start
+// with a link.
+func markdownLink(s string) (text, url string, n int) {
+	closing := strings.Index(s, "](")
+	if closing == -1 || strings.IndexByte(s[:closing], '\n') != -1 {
+		return "", "", 0
+	}
+	end := strings.IndexByte(s[closing+2:], ')')
+	if end == -1 {
+		return "", "", 0
+	}
+	return s[1:closing], strings.TrimSpace(s[closing+2 : closing+2+end]), closing + 2 + end + 1
+}
+
+func isWordChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
@@ -0,0 +1,65 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		md, want string
+	}{
+		{"Hello *Bob* & **Cora**", "<p>Hello <em>Bob</em> &amp; <strong>Cora</strong></p>"},
+		{"# Title\n\nFirst\nline  \nbreak\n\nSecond", "<h1>Title</h1>\n<p>First\nline<br>\nbreak</p>\n<p>Second</p>"},
+		{"### Sub ###", "<h3>Sub</h3>"},
+		{"See [our site](https://example.com/?a=1&b=2) or ![logo](logo.png).", `<p>See <a href="https://example.com/?a=1&amp;b=2">our site</a> or <img src="logo.png" alt="logo">.</p>`},
+		{"- One\n- Two\n  continued\n\n1. First\n2) Second", "<ul>\n<li>One</li>\n<li>Two\ncontinued</li>\n</ul>\n<ol>\n<li>First</li>\n<li>Second</li>\n</ol>"},
+		{"> Quoted\n> **text**\n\n---", "<blockquote>\n<p>Quoted\n<strong>text</strong></p>\n</blockquote>\n<hr>"},
+		{"```\n<b>code</b>\n```\nUse `a < b` and snake_case_name \\*not em\\*", "<pre><code>&lt;b&gt;code&lt;/b&gt;</code></pre>\n<p>Use <code>a &lt; b</code> and snake_case_name *not em*</p>"},
+		{"#hashtag and 2 * 3", "<p>#hashtag and 2 * 3</p>"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, renderMarkdown(test.md), test.md)
+	}
+}
+
+func TestMarkdownBody(t *testing.T) {
+	renderer := MarkdownRenderer
+	defer func() { MarkdownRenderer = renderer }()
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.MarkdownBody("Hello **Bob**")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Hello **Bob**\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p>Hello <strong>Bob</strong></p>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	testMessage(t, m, 1, want)
+
+	MarkdownRenderer = func(md string) string { return "<div>" + md + "</div>" }
+	m.MarkdownBody("Test")
+	assert.Len(t, m.parts, 2)
+	msg, err := m.Render()
+	assert.NoError(t, err)
+	assert.Contains(t, string(msg), "<div>Test</div>")
+}
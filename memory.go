@@ -0,0 +1,81 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"net/mail"
+	"sync"
+)
+
+type (
+	// A SentMessage is an email captured by a MemorySender.
+	SentMessage struct {
+		// From is the envelope sender of the email.
+		From string
+		// To is the list of envelope recipients of the email.
+		To []string
+		// Data is the email as it would have been transmitted to the server.
+		Data []byte
+	}
+
+	// MemorySender is a SendCloser that keeps the emails in memory instead of
+	// sending them, it is useful to test code sending emails. The zero value is
+	// ready to use and it is safe for concurrent use.
+	MemorySender struct {
+		mu       sync.Mutex
+		messages []SentMessage
+	}
+)
+
+// Send implements Sender, it renders msg and records it.
+func (s *MemorySender) Send(from string, to []string, msg io.WriterTo) error {
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.messages = append(s.messages, SentMessage{
+		From: from,
+		To:   append([]string(nil), to...),
+		Data: buf.Bytes(),
+	})
+	s.mu.Unlock()
+
+	return nil
+}
+
+// Close implements SendCloser, it does nothing.
+func (s *MemorySender) Close() error {
+	return nil
+}
+
+// Messages returns the emails sent so far, in the order they were sent.
+func (s *MemorySender) Messages() []SentMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]SentMessage(nil), s.messages...)
+}
+
+// Reset discards the emails sent so far.
+func (s *MemorySender) Reset() {
+	s.mu.Lock()
+	s.messages = nil
+	s.mu.Unlock()
+}
+
+// Parse parses the captured email, the body of the returned message is the
+// raw, still encoded, MIME body.
+func (m SentMessage) Parse() (*mail.Message, error) {
+	return mail.ReadMessage(bytes.NewReader(m.Data))
+}
+
+// Header returns the headers of the captured email.
+func (m SentMessage) Header() (mail.Header, error) {
+	msg, err := m.Parse()
+	if err != nil {
+		return nil, err
+	}
+	return msg.Header, nil
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemorySender(t *testing.T) {
+	s := &MemorySender{}
+	m := NewMessage()
+	m.SetHeader("From", testFrom)
+	m.SetHeader("To", testTo1)
+	m.SetHeader("Bcc", testTo2)
+	m.SetSubject("Hello!")
+	m.SetBody("text/plain", testBody)
+
+	assert.NoError(t, Send(s, m, m))
+	assert.NoError(t, s.Close())
+
+	msgs := s.Messages()
+	assert.Len(t, msgs, 2)
+	assert.Equal(t, testFrom, msgs[0].From)
+	assert.Equal(t, []string{testTo1, testTo2}, msgs[0].To)
+
+	h, err := msgs[0].Header()
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello!", h.Get("Subject"))
+	assert.Equal(t, testTo1, h.Get("To"))
+	assert.Empty(t, h.Get("Bcc"))
+
+	parsed, err := msgs[1].Parse()
+	assert.NoError(t, err)
+	body, err := ioutil.ReadAll(parsed.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, testBody, string(body))
+
+	s.Reset()
+	assert.Empty(t, s.Messages())
+}
@@ -4,13 +4,19 @@ import (
 	"bytes"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
 	"mime"
 	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -22,10 +28,27 @@ type (
 		parts       []*part
 		attachments []*file
 		embedded    []*file
+		tree        *Entity
 		charset     string
 		encoding    Encoding
+		encodingSet bool
 		hEncoder    mimeEncoder
 		buf         bytes.Buffer
+
+		autoPlainText bool
+		inlineCSS     bool
+		autoEncoding  bool
+		autoHEncoding bool
+		keepURLs      bool
+		boundary      string
+		autoMessageID bool
+		idDomain      string
+
+		punycodeDomains bool
+		config          *ConfigMailer
+		noDefaultDate   bool
+		clock           func() time.Time
+		dsn             *dsnRequest
 	}
 
 	messageWriter struct {
@@ -34,6 +57,11 @@ type (
 		writers    [3]*multipart.Writer
 		partWriter io.Writer
 		depth      uint8
+		keepURLs   bool
+		// boundary is the prefix of the boundaries given by SetBoundary and
+		// boundaries the number of boundaries generated from it.
+		boundary   string
+		boundaries int
 		err        error
 	}
 )
@@ -41,13 +69,23 @@ type (
 // Stubbed out for testing.
 var now = time.Now
 
-// NewMessage creates a new message. It uses UTF-8 and quoted-printable encoding
-// by default.
+var (
+	// DefaultCharset is the charset of the emails created with NewMessage,
+	// unless they are given SetCharset.
+	DefaultCharset = "UTF-8"
+	// DefaultEncoding is the encoding of the emails created with NewMessage,
+	// unless they are given SetEncoding.
+	DefaultEncoding = QuotedPrintable
+)
+
+// NewMessage creates a new message. It uses DefaultCharset and DefaultEncoding,
+// UTF-8 and quoted-printable unless they are changed, the settings taking
+// precedence over them.
 func NewMessage(settings ...MessageSetting) *Message {
 	m := &Message{
 		header:   make(header),
-		charset:  "UTF-8",
-		encoding: QuotedPrintable,
+		charset:  DefaultCharset,
+		encoding: DefaultEncoding,
 	}
 
 	m.applySettings(settings)
@@ -58,9 +96,13 @@ func NewMessage(settings ...MessageSetting) *Message {
 		m.hEncoder = qEncoding
 	}
 
-	if Config != nil {
+	cfg := Config
+	if m.config != nil {
+		cfg = m.config
+	}
+	if cfg != nil {
 		// Set From data Header from env variable
-		m.SetAddressHeader("From", Config.SenderEmail, Config.SenderName)
+		m.SetAddressHeader("From", cfg.SenderEmail, cfg.SenderName)
 	}
 
 	return m
@@ -72,12 +114,45 @@ func (m *Message) From(email string, name string) *Message {
 	return m
 }
 
+// AddFrom adds an author to the "From" header, which can hold several
+// addresses as allowed by RFC 5322. It appends to the address set by From or
+// from Config. As RFC 5322 requires a "Sender" header when there are several
+// authors, the first author is set as the Sender if there is none yet, it is
+// also used as the envelope sender.
+func (m *Message) AddFrom(email string, name string) *Message {
+	m.header["From"] = append(m.header["From"], m.FormatAddress(email, name))
+	if len(m.header["From"]) > 1 && len(m.header["Sender"]) == 0 {
+		m.header["Sender"] = []string{m.header["From"][0]}
+	}
+	return m
+}
+
 // To set recipient
 func (m *Message) To(to ...string) *Message {
 	m.SetRecipient(to...)
 	return m
 }
 
+// Cc add carbon copy recipients, calling it multiple times appends to the
+// previous recipients.
+func (m *Message) Cc(address ...string) *Message {
+	m.addRecipient("Cc", address)
+	return m
+}
+
+// Bcc add blind carbon copy recipients, calling it multiple times appends to
+// the previous recipients. Bcc recipients are never written in the headers.
+func (m *Message) Bcc(address ...string) *Message {
+	m.addRecipient("Bcc", address)
+	return m
+}
+
+// ReplyTo set reply address
+func (m *Message) ReplyTo(email string, name string) *Message {
+	m.SetReplyTo(email, name)
+	return m
+}
+
 // Subject set title
 func (m *Message) Subject(to ...string) *Message {
 	m.SetSubject(to...)
@@ -98,8 +173,34 @@ func (m *Message) Body(body string, isHTML bool) *Message {
 // it can be set multiple recipient, if you need to set email and name of recipient
 // use FormatAddress instead of normal string.
 func (m *Message) SetRecipient(address ...string) {
-	m.encodeHeader(address)
-	m.header["To"] = address
+	m.header["To"] = m.recipientValues(address)
+}
+
+// SetReplyTo sets the address replies should be sent to, the name is encoded
+// the same way as FormatAddress. It does not change the envelope sender of the
+// email which is still taken from the "Sender" or "From" header.
+func (m *Message) SetReplyTo(address, name string) {
+	m.SetAddressHeader("Reply-To", address, name)
+}
+
+// AddReplyTo adds an address to the "Reply-To" header, which can hold several
+// addresses as allowed by RFC 5322, for example so the replies reach every
+// member of a team. It appends to the address set by ReplyTo or SetReplyTo.
+func (m *Message) AddReplyTo(email string, name string) *Message {
+	m.header["Reply-To"] = append(m.header["Reply-To"], m.FormatAddress(email, name))
+	return m
+}
+
+// SetEnvelopeFrom sets the envelope sender of the email, used in the MAIL FROM
+// command instead of the "Sender" or "From" header, and writes it in the
+// "Return-Path" header. It is useful for VERP or when bounces must be sent to
+// another address than the visible sender. An empty address removes it.
+func (m *Message) SetEnvelopeFrom(address string) {
+	if address == "" {
+		delete(m.header, "Return-Path")
+		return
+	}
+	m.header["Return-Path"] = []string{"<" + address + ">"}
 }
 
 // SetSubject sets an value of subject email messages.
@@ -108,10 +209,12 @@ func (m *Message) SetSubject(subject ...string) {
 	m.header["Subject"] = subject
 }
 
-// SetHeader sets a value to the given header field.
+// SetHeader sets a value to the given header field. The field name is
+// canonicalized, so "content-type" and "Content-Type" are the same field,
+// except for "X-" fields whose casing is kept.
 func (m *Message) SetHeader(field string, value ...string) {
 	m.encodeHeader(value)
-	m.header[field] = value
+	m.header[canonicalHeaderKey(field)] = value
 }
 
 // SetHeaders sets the message headers.
@@ -123,23 +226,204 @@ func (m *Message) SetHeaders(h map[string][]string) {
 
 // SetAddressHeader sets an address to the given header field.
 func (m *Message) SetAddressHeader(field, address, name string) {
-	m.header[field] = []string{m.FormatAddress(address, name)}
+	m.header[canonicalHeaderKey(field)] = []string{m.FormatAddress(address, name)}
 }
 
-// SetDateHeader sets a date to the given header field.
+// SetDateHeader sets a date to the given header field. Setting the "Date"
+// field replaces the one added by default when the email is written, see also
+// SetNoDefaultDate.
 func (m *Message) SetDateHeader(field string, date time.Time) {
-	m.header[field] = []string{m.FormatDate(date)}
+	m.header[canonicalHeaderKey(field)] = []string{m.FormatDate(date)}
 }
 
 // SetBody sets the body of the message. It replaces any content previously set
-// by SetBody, AddAlternative or AddAlternativeWriter.
+// by SetBody, SetBodyWriter, AddAlternative or AddAlternativeWriter.
 func (m *Message) SetBody(contentType, body string, settings ...PartSetting) {
-	m.parts = []*part{m.newPart(contentType, newCopier(body), settings)}
+	m.parts = []*part{m.newStringPart(contentType, body, settings)}
+}
+
+// SetBodyWriter sets the body of the message to the content written by f when
+// the message is sent, so a large template does not have to be rendered into a
+// string first. Like SetBody, it replaces any content previously set.
+func (m *Message) SetBodyWriter(contentType string, f func(io.Writer) error, settings ...PartSetting) {
+	m.parts = []*part{m.newPart(contentType, f, settings)}
+}
+
+// SetBodyTemplate sets the body of the message to a text/html part rendered
+// from the html/template t with data when the message is written, without
+// building the whole HTML in memory first. Unlike FormatHTML, it does not panic:
+// the error wrapping ErrExecuteTemplate is returned when the message is written
+// or sent. Like SetBody, it replaces any content previously set.
+func (m *Message) SetBodyTemplate(t *template.Template, data interface{}, settings ...PartSetting) {
+	m.SetBodyWriter("text/html", templateCopier(t, data), settings...)
+}
+
+// templateCopier returns a copier executing t with data, its error wrapping
+// ErrExecuteTemplate.
+func templateCopier(t *template.Template, data interface{}) func(io.Writer) error {
+	return func(w io.Writer) error {
+		if err := t.Execute(w, data); err != nil {
+			return fmt.Errorf("%w, %v", ErrExecuteTemplate, err)
+		}
+		return nil
+	}
+}
+
+// SetListUnsubscribe sets the "List-Unsubscribe" header defined in RFC 2369
+// with the given mailto: or http(s): URLs, at least one URL must be given.
+// Bulk senders should also call SetListUnsubscribePost to allow one-click
+// unsubscription.
+func (m *Message) SetListUnsubscribe(urls ...string) error {
+	if len(urls) == 0 {
+		return errors.New("mailer: at least one List-Unsubscribe URL is required")
+	}
+
+	values := make([]string, len(urls))
+	for i, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return fmt.Errorf("mailer: invalid List-Unsubscribe URL %q: %v", rawURL, err)
+		}
+		switch {
+		case u.Scheme == "mailto" && u.Opaque != "":
+		case (u.Scheme == "http" || u.Scheme == "https") && u.Host != "":
+		default:
+			return fmt.Errorf("mailer: invalid List-Unsubscribe URL %q: must be an absolute mailto: or http(s): URL", rawURL)
+		}
+		if strings.ContainsAny(rawURL, "<> \t\r\n") {
+			return fmt.Errorf("mailer: invalid List-Unsubscribe URL %q: must not contain angle brackets or whitespace", rawURL)
+		}
+		values[i] = "<" + rawURL + ">"
+	}
+
+	m.header["List-Unsubscribe"] = values
+	return nil
+}
+
+// SetContentLanguage sets the "Content-Language" header defined in RFC 3282
+// with the given language tags, such as "de" or "en-US". At least one tag must
+// be given, tags are only checked to be made of letters, digits and hyphens.
+func (m *Message) SetContentLanguage(langs ...string) error {
+	if len(langs) == 0 {
+		return errors.New("mailer: at least one Content-Language tag is required")
+	}
+
+	for _, lang := range langs {
+		if !isLanguageTag(lang) {
+			return fmt.Errorf("mailer: invalid Content-Language tag %q", lang)
+		}
+	}
+
+	m.header["Content-Language"] = []string{strings.Join(langs, ", ")}
+	return nil
+}
+
+// SetListUnsubscribePost sets the "List-Unsubscribe-Post" header defined in
+// RFC 8058 which signals that the https: URL of the "List-Unsubscribe" header
+// supports one-click unsubscription.
+func (m *Message) SetListUnsubscribePost() {
+	m.header["List-Unsubscribe-Post"] = []string{"List-Unsubscribe=One-Click"}
+}
+
+// SetPriority sets the "X-Priority", "Priority" and "Importance" headers used
+// by the email clients to display the priority of the email. PriorityNormal
+// removes these headers since it is the default.
+func (m *Message) SetPriority(p Priority) {
+	switch p {
+	case PriorityHigh:
+		m.header["X-Priority"] = []string{"1 (Highest)"}
+		m.header["Priority"] = []string{"urgent"}
+		m.header["Importance"] = []string{"high"}
+	case PriorityLow:
+		m.header["X-Priority"] = []string{"5 (Lowest)"}
+		m.header["Priority"] = []string{"non-urgent"}
+		m.header["Importance"] = []string{"low"}
+	default:
+		delete(m.header, "X-Priority")
+		delete(m.header, "Priority")
+		delete(m.header, "Importance")
+	}
+}
+
+// SetAutoSubmitted sets the "Auto-Submitted" header defined in RFC 3834 which
+// tells the auto-responders, such as vacation replies, not to answer the email:
+// "auto-generated" for the emails sent by a program, such as notifications,
+// and "auto-replied" for the automatic replies. The value can also be
+// "auto-notified" (RFC 5436) or "no" for an email written by a person.
+func (m *Message) SetAutoSubmitted(value string) error {
+	switch v := strings.ToLower(value); v {
+	case "no", "auto-generated", "auto-replied", "auto-notified":
+		m.header["Auto-Submitted"] = []string{v}
+		return nil
+	default:
+		return fmt.Errorf("mailer: invalid Auto-Submitted value %q", value)
+	}
+}
+
+// SetPrecedenceBulk sets the non-standard "Precedence: bulk" header, still
+// widely used by the auto-responders and mailing list software to recognize
+// the automated emails along with "Auto-Submitted".
+func (m *Message) SetPrecedenceBulk() {
+	m.header["Precedence"] = []string{"bulk"}
+}
+
+// SetMessageID sets the "Message-ID" header, the angle brackets are added to
+// id if it does not have them.
+func (m *Message) SetMessageID(id string) {
+	if !strings.HasPrefix(id, "<") || !strings.HasSuffix(id, ">") {
+		id = "<" + id + ">"
+	}
+	m.header["Message-ID"] = []string{id}
+}
+
+// SetInReplyTo sets the "In-Reply-To" header to the Message-ID of the email
+// being replied to, for example "<1234@example.com>".
+func (m *Message) SetInReplyTo(messageID string) error {
+	if err := validateMessageID(messageID); err != nil {
+		return err
+	}
+	m.header["In-Reply-To"] = []string{messageID}
+	return nil
+}
+
+// SetReferences sets the "References" header to the Message-IDs of the emails
+// of the thread, from the oldest to the most recent. Clients such as Gmail use
+// it with "In-Reply-To" to group the replies under the original email.
+func (m *Message) SetReferences(messageIDs ...string) error {
+	for _, id := range messageIDs {
+		if err := validateMessageID(id); err != nil {
+			return err
+		}
+	}
+	// Message IDs are separated by spaces which allows the header to be folded.
+	m.header["References"] = []string{strings.Join(messageIDs, " ")}
+	return nil
 }
 
 // GetHeader gets a header field.
 func (m *Message) GetHeader(field string) []string {
-	return m.header[field]
+	return m.header[canonicalHeaderKey(field)]
+}
+
+// headerCasing holds the fields whose usual casing differs from the one
+// returned by textproto.CanonicalMIMEHeaderKey.
+var headerCasing = map[string]string{
+	"Content-Id":     "Content-ID",
+	"Dkim-Signature": "DKIM-Signature",
+	"Message-Id":     "Message-ID",
+}
+
+// canonicalHeaderKey returns the canonical form of the header field name. The
+// "X-" fields are returned unchanged.
+func canonicalHeaderKey(field string) string {
+	if len(field) >= 2 && (field[0] == 'X' || field[0] == 'x') && field[1] == '-' {
+		return field
+	}
+	key := textproto.CanonicalMIMEHeaderKey(field)
+	if k, ok := headerCasing[key]; ok {
+		return k
+	}
+	return key
 }
 
 // FormatAddress formats an address and a name as a valid RFC 5322 address.
@@ -178,14 +462,16 @@ func (m *Message) FormatDate(date time.Time) string {
 	return date.Format(time.RFC1123Z)
 }
 
-// FormatHTML formats an html template with data interface that will be used as body
+// FormatHTML formats an html template with data interface that will be used as body,
+// it panics on error, use FormatHTMLE to get the error instead.
 func (m *Message) FormatHTML(t *template.Template, data interface{}) string {
-	buf := new(bytes.Buffer)
-	if err := t.Execute(buf, data); err != nil {
-		panic("mailer: Error when compiling template, " + err.Error())
-	}
+	return mustTemplate(m.FormatHTMLE(t, data))
+}
 
-	return buf.String()
+// FormatHTMLE formats an html template with data interface that will be used as body.
+// The returned error wraps ErrExecuteTemplate when the template fails to execute.
+func (m *Message) FormatHTMLE(t *template.Template, data interface{}) (string, error) {
+	return executeTemplate(t, data)
 }
 
 // AddAlternative adds an alternative part to the message.
@@ -195,7 +481,7 @@ func (m *Message) FormatHTML(t *template.Template, data interface{}) string {
 // the end of the message. So the plain text part should be added before the
 // HTML part. See http://en.wikipedia.org/wiki/MIME#Alternative
 func (m *Message) AddAlternative(contentType, body string, settings ...PartSetting) {
-	m.AddAlternativeWriter(contentType, newCopier(body), settings...)
+	m.parts = append(m.parts, m.newStringPart(contentType, body, settings))
 }
 
 // AddAlternativeWriter adds an alternative part to the message. It can be
@@ -204,6 +490,43 @@ func (m *Message) AddAlternativeWriter(contentType string, f func(io.Writer) err
 	m.parts = append(m.parts, m.newPart(contentType, f, settings))
 }
 
+// AddAlternativeTemplate adds an alternative part of the given content type
+// rendered from the html/template t with data when the message is written,
+// like SetBodyTemplate. The error wrapping ErrExecuteTemplate is returned when
+// the message is written or sent. As html/template escapes its output for
+// HTML, a text/template should be used with AddAlternativeWriter for a plain
+// text part.
+func (m *Message) AddAlternativeTemplate(contentType string, t *template.Template, data interface{}, settings ...PartSetting) {
+	m.AddAlternativeWriter(contentType, templateCopier(t, data), settings...)
+}
+
+// AddCalendar adds a text/calendar alternative part with the iCalendar object
+// ics, for example a meeting invitation, as defined in RFC 6047. method is the
+// iTIP method of the object, such as "REQUEST" or "CANCEL", which must match
+// its METHOD property if it has one.
+//
+// To have the clients display the invitation with their Accept and Decline
+// buttons, the calendar part should be the last alternative, after the plain
+// text and HTML bodies:
+//
+//	m.SetBody("text/plain", text)
+//	m.AddAlternative("text/html", html)
+//	m.AddCalendar(ics, "REQUEST")
+func (m *Message) AddCalendar(ics, method string, settings ...PartSetting) error {
+	method = strings.ToUpper(method)
+	if !isIANAToken(method) {
+		return fmt.Errorf("mailer: invalid iCalendar method %q", method)
+	}
+	for _, line := range strings.Split(ics, "\n") {
+		if v := strings.TrimSpace(line); strings.HasPrefix(strings.ToUpper(v), "METHOD:") && !strings.EqualFold(v[len("METHOD:"):], method) {
+			return fmt.Errorf("mailer: iCalendar method %q does not match the METHOD property %q", method, v[len("METHOD:"):])
+		}
+	}
+
+	m.AddAlternative("text/calendar; method="+method, ics, settings...)
+	return nil
+}
+
 // Attach attaches the files to the email.
 func (m *Message) Attach(filename string, settings ...FileSetting) {
 	m.attachments = m.appendFile(m.attachments, filename, settings)
@@ -214,6 +537,84 @@ func (m *Message) Embed(filename string, settings ...FileSetting) {
 	m.embedded = m.appendFile(m.embedded, filename, settings)
 }
 
+// AttachReader attaches the content read from r to the email under the given
+// name. The reader is consumed when the message is written, so the message can
+// only be sent once. If r implements io.Closer, it is closed after copying.
+func (m *Message) AttachReader(name string, r io.Reader, settings ...FileSetting) {
+	m.attachments = m.appendFile(m.attachments, name, readerSettings(r, settings))
+}
+
+// EmbedReader embeds the image read from r to the email under the given name.
+// The reader is consumed when the message is written, so the message can only
+// be sent once. If r implements io.Closer, it is closed after copying.
+func (m *Message) EmbedReader(name string, r io.Reader, settings ...FileSetting) {
+	m.embedded = m.appendFile(m.embedded, name, readerSettings(r, settings))
+}
+
+// AttachBytes attaches the content of b to the email under the given name.
+// The content type is inferred from the name extension unless it is set with
+// SetHeader.
+func (m *Message) AttachBytes(name string, b []byte, settings ...FileSetting) {
+	m.attachments = m.appendFile(m.attachments, name, bytesSettings(b, settings))
+}
+
+// EmbedBytes embeds the image content of b to the email under the given name.
+// The content type is inferred from the name extension unless it is set with
+// SetHeader.
+func (m *Message) EmbedBytes(name string, b []byte, settings ...FileSetting) {
+	m.embedded = m.appendFile(m.embedded, name, bytesSettings(b, settings))
+}
+
+// AttachFS attaches the file name of fsys to the email, the file is opened
+// when the message is written. It is useful with files shipped in an embed.FS.
+func (m *Message) AttachFS(fsys fs.FS, name string, settings ...FileSetting) {
+	m.attachments = m.appendFile(m.attachments, name, fsSettings(fsys, name, settings))
+}
+
+// EmbedFS embeds the image name of fsys to the email, the file is opened when
+// the message is written. It is useful with images shipped in an embed.FS.
+func (m *Message) EmbedFS(fsys fs.FS, name string, settings ...FileSetting) {
+	m.embedded = m.appendFile(m.embedded, name, fsSettings(fsys, name, settings))
+}
+
+// EmbedImage embeds the image read from r under the given name, like
+// EmbedReader, and returns its generated Content-ID to be referenced from the
+// HTML body with a cid: URL:
+//
+//	cid, err := m.EmbedImage(r, "logo.png")
+//	// <img src="cid:{{.LogoCID}}">
+//
+// The content type is inferred from the extension of name, which must be the
+// one of an image. The Content-ID is unique, using the domain given to
+// AutoMessageID or the one of the "From" address, so the same name can be
+// embedded several times.
+func (m *Message) EmbedImage(r io.Reader, name string) (string, error) {
+	if ext := filepath.Ext(name); !strings.HasPrefix(mime.TypeByExtension(ext), "image/") {
+		return "", fmt.Errorf("mailer: %q does not have the extension of an image", name)
+	}
+
+	id, err := GenerateMessageID(m.contentIDDomain())
+	if err != nil {
+		return "", err
+	}
+	cid := strings.Trim(id, "<>")
+	m.EmbedReader(name, r, ContentID(cid))
+	return cid, nil
+}
+
+// contentIDDomain returns the domain of the generated Content-IDs.
+func (m *Message) contentIDDomain() string {
+	if m.idDomain != "" {
+		return m.idDomain
+	}
+	if from := m.header["From"]; len(from) > 0 {
+		if addr, err := parseAddress(from[0]); err == nil {
+			return addr[strings.LastIndexByte(addr, '@')+1:]
+		}
+	}
+	return "localhost"
+}
+
 // Reset resets the message so it can be reused. The message keeps its previous
 // settings so it is in the same state that after a call to NewMessage.
 func (m *Message) Reset() {
@@ -223,13 +624,73 @@ func (m *Message) Reset() {
 	m.parts = nil
 	m.attachments = nil
 	m.embedded = nil
+	m.tree = nil
+}
+
+// Clone returns a deep copy of the message: its headers, parts, attachments and
+// embedded files can be modified without changing m. It is useful to build
+// one email per recipient from a base message, which can be cloned from
+// several goroutines as long as it is not modified. The contents of the parts
+// and files are shared, so files added with AttachReader or EmbedReader can
+// only be sent once across all the clones.
+func (m *Message) Clone() *Message {
+	c := &Message{
+		header:      make(header, len(m.header)),
+		charset:     m.charset,
+		encoding:    m.encoding,
+		encodingSet: m.encodingSet,
+		hEncoder:    m.hEncoder,
+
+		autoPlainText:   m.autoPlainText,
+		inlineCSS:       m.inlineCSS,
+		autoEncoding:    m.autoEncoding,
+		autoHEncoding:   m.autoHEncoding,
+		keepURLs:        m.keepURLs,
+		boundary:        m.boundary,
+		autoMessageID:   m.autoMessageID,
+		idDomain:        m.idDomain,
+		punycodeDomains: m.punycodeDomains,
+		config:          m.config,
+		noDefaultDate:   m.noDefaultDate,
+		clock:           m.clock,
+		dsn:             m.dsn,
+	}
+	for k, v := range m.header {
+		c.header[k] = append([]string(nil), v...)
+	}
+	for _, p := range m.parts {
+		cp := *p
+		c.parts = append(c.parts, &cp)
+	}
+	c.attachments = cloneFiles(m.attachments)
+	c.embedded = cloneFiles(m.embedded)
+	c.tree = m.tree.clone()
+
+	return c
 }
 
-// Send initialing new dialer with the messages and sending the email.
+func cloneFiles(files []*file) []*file {
+	if files == nil {
+		return nil
+	}
+	c := make([]*file, len(files))
+	for i, f := range files {
+		cf := *f
+		cf.Header = make(map[string][]string, len(f.Header))
+		for k, v := range f.Header {
+			cf.Header[k] = append([]string(nil), v...)
+		}
+		c[i] = &cf
+	}
+	return c
+}
+
+// Send initialing new dialer with the messages and sending the email. The
+// error is logged with the default slog logger and returned.
 func (m *Message) Send() (err error) {
 	d := NewDialer()
 	if err = d.DialAndSend(m); err != nil {
-		log.Fatal(err.Error())
+		slog.Error("mailer: could not send email", "error", err)
 	}
 	return
 }
@@ -240,6 +701,29 @@ func (m *Message) applySettings(settings []MessageSetting) {
 	}
 }
 
+func (m *Message) addRecipient(field string, address []string) {
+	m.header[field] = append(m.header[field], m.recipientValues(address)...)
+}
+
+// recipientValues returns the encoded header values of the recipients address.
+// A string holding several comma-separated addresses, such as
+// "a@example.com, Doe <b@example.com>", is split into one value per address.
+func (m *Message) recipientValues(address []string) []string {
+	values := make([]string, 0, len(address))
+	for _, a := range address {
+		if strings.Contains(a, ",") {
+			if list, err := mail.ParseAddressList(a); err == nil && len(list) > 1 {
+				for _, addr := range list {
+					values = append(values, m.FormatAddress(addr.Address, addr.Name))
+				}
+				continue
+			}
+		}
+		values = append(values, m.encodeString(a))
+	}
+	return values
+}
+
 func (m *Message) encodeHeader(values []string) {
 	for i := range values {
 		values[i] = m.encodeString(values[i])
@@ -247,7 +731,19 @@ func (m *Message) encodeHeader(values []string) {
 }
 
 func (m *Message) encodeString(value string) string {
-	return m.hEncoder.Encode(m.charset, value)
+	enc := m.hEncoder.Encode(m.charset, value)
+	if m.autoHEncoding && enc != value {
+		// The encoded-words of the other encoding are used if they are
+		// shorter.
+		other := qEncoding
+		if m.hEncoder == qEncoding {
+			other = bEncoding
+		}
+		if o := other.Encode(m.charset, value); len(o) < len(enc) {
+			return o
+		}
+	}
+	return enc
 }
 
 func (m *Message) newPart(contentType string, f func(io.Writer) error, settings []PartSetting) *part {
@@ -264,6 +760,13 @@ func (m *Message) newPart(contentType string, f func(io.Writer) error, settings
 	return p
 }
 
+// newStringPart returns a new part whose content is body.
+func (m *Message) newStringPart(contentType, body string, settings []PartSetting) *part {
+	p := m.newPart(contentType, newCopier(body), settings)
+	p.body = &body
+	return p
+}
+
 func (m *Message) appendFile(list []*file, name string, settings []FileSetting) []*file {
 	f := &file{
 		Name:   filepath.Base(name),
@@ -279,6 +782,12 @@ func (m *Message) appendFile(list []*file, name string, settings []FileSetting)
 			}
 			return h.Close()
 		},
+		size: func() int64 {
+			if info, err := os.Stat(name); err == nil {
+				return info.Size()
+			}
+			return -1
+		},
 	}
 
 	for _, s := range settings {
@@ -292,8 +801,28 @@ func (m *Message) appendFile(list []*file, name string, settings []FileSetting)
 	return append(list, f)
 }
 
+// EnvelopeFrom returns the address used as the sender of the SMTP envelope
+// when the message is sent: the "Return-Path" address if set, otherwise the
+// "Sender" address or the "From" address.
+func (m *Message) EnvelopeFrom() (string, error) {
+	return m.getFrom()
+}
+
+// Recipients returns the addresses of the To, Cc and Bcc recipients, without
+// duplicates, to which the message is sent.
+func (m *Message) Recipients() ([]string, error) {
+	return m.getRecipients()
+}
+
 func (m *Message) getFrom() (string, error) {
-	from := m.header["Sender"]
+	if len(m.header["From"]) > 1 && len(m.header["Sender"]) == 0 {
+		return "", errors.New(`mailer: invalid message, a "Sender" field is required with several "From" addresses`)
+	}
+
+	from := m.header["Return-Path"]
+	if len(from) == 0 {
+		from = m.header["Sender"]
+	}
 	if len(from) == 0 {
 		from = m.header["From"]
 		if len(from) == 0 {
@@ -301,25 +830,67 @@ func (m *Message) getFrom() (string, error) {
 		}
 	}
 
-	return parseAddress(from[0])
+	addr, err := parseAddress(from[0])
+	if err != nil {
+		return "", err
+	}
+	return m.envelopeAddress(addr)
+}
+
+// envelopeAddress returns addr as it must be used in the SMTP envelope.
+func (m *Message) envelopeAddress(addr string) (string, error) {
+	if !m.punycodeDomains {
+		return addr, nil
+	}
+	return toASCIIAddress(addr)
 }
 
 func (m *Message) getRecipients() ([]string, error) {
+	return m.recipients("To", "Cc", "Bcc")
+}
+
+// bccRecipients returns the envelope addresses of the Bcc recipients which are
+// not also To or Cc recipients.
+func (m *Message) bccRecipients() ([]string, error) {
+	bcc, err := m.recipients("Bcc")
+	if err != nil || len(bcc) == 0 {
+		return nil, err
+	}
+	visible, err := m.recipients("To", "Cc")
+	if err != nil {
+		return nil, err
+	}
+
+	list := bcc[:0]
+	for _, addr := range bcc {
+		if !hasAddress(visible, addr) {
+			list = append(list, addr)
+		}
+	}
+	return list, nil
+}
+
+// recipients returns the envelope addresses of the recipients of the header
+// fields, without duplicates.
+func (m *Message) recipients(fields ...string) ([]string, error) {
 	n := 0
-	for _, field := range []string{"To", "Cc", "Bcc"} {
+	for _, field := range fields {
 		if addresses, ok := m.header[field]; ok {
 			n += len(addresses)
 		}
 	}
 	list := make([]string, 0, n)
 
-	for _, field := range []string{"To", "Cc", "Bcc"} {
+	for _, field := range fields {
 		if addresses, ok := m.header[field]; ok {
 			for _, a := range addresses {
 				addr, err := parseAddress(a)
 				if err != nil {
 					return nil, err
 				}
+				if addr, err = m.envelopeAddress(addr); err != nil {
+					return nil, err
+				}
 				list = addAddress(list, addr)
 			}
 		}
@@ -328,65 +899,217 @@ func (m *Message) getRecipients() ([]string, error) {
 	return list, nil
 }
 
+// setDefaultMessageID generates the "Message-ID" header of the message, it is
+// stored so the ID stays the same if the message is written again.
+func (m *Message) setDefaultMessageID() error {
+	domain := m.idDomain
+	if domain == "" {
+		from, ok := m.header["From"]
+		if !ok || len(from) == 0 {
+			return errors.New(`mailer: cannot generate Message-ID, "From" field is absent`)
+		}
+		addr, err := parseAddress(from[0])
+		if err != nil {
+			return err
+		}
+		domain = addr[strings.LastIndexByte(addr, '@')+1:]
+	}
+
+	id, err := GenerateMessageID(domain)
+	if err != nil {
+		return err
+	}
+	m.header["Message-ID"] = []string{id}
+	return nil
+}
+
 // WriteTo implements io.WriterTo. It dumps the whole message into w.
+//
+// The parts and files are streamed to w as they are encoded, so large
+// attachments are never held in memory.
+//
+// The output is the message itself, as stored in an .eml file or signed with
+// DKIM, it is not dot-stuffed: the lines starting with a period are left
+// untouched. Dot-stuffing is done by the transport, the SMTP Dialer escapes
+// them when sending the message with the DATA command. A Sender giving the
+// output to an SMTP server by other means must do it too.
 func (m *Message) WriteTo(w io.Writer) (int64, error) {
 	mw := &messageWriter{w: w}
 	mw.writeMessage(m)
 	return mw.n, mw.err
 }
 
-func (m *Message) hasMixedPart() bool {
-	return (len(m.parts) > 0 && len(m.attachments) > 0) || len(m.attachments) > 1
+// Render returns the complete MIME message as it would be sent, without
+// sending it and without dot-stuffing, see WriteTo. It is useful to preview an
+// email or to check it in tests.
+func (m *Message) Render() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := m.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
-func (m *Message) hasRelatedPart() bool {
-	return (len(m.parts) > 0 && len(m.embedded) > 0) || len(m.embedded) > 1
+// String implements fmt.Stringer by returning the rendered MIME message, for
+// logging and debugging. If the message cannot be written, it returns
+// "<error: ...>" with the error instead, use Render to get the error.
+func (m *Message) String() string {
+	b, err := m.Render()
+	if err != nil {
+		return "<error: " + err.Error() + ">"
+	}
+	return string(b)
 }
 
-func (m *Message) hasAlternativePart() bool {
-	return len(m.parts) > 1
+// now returns the current time according to the clock of the message.
+func (m *Message) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return now()
+}
+
+// writtenParts returns the parts of the message as they are written, which
+// includes the parts automatically generated by the message settings.
+func (m *Message) writtenParts() []*part {
+	parts := m.parts
+	if m.inlineCSS {
+		parts = inlineCSSParts(parts)
+	}
+	if m.autoPlainText {
+		parts = addPlainTextPart(parts)
+	}
+	if m.autoEncoding && !m.encodingSet {
+		parts = autoEncodeParts(parts)
+	}
+	return parts
+}
+
+// autoEncodeParts returns a copy of parts whose encoding, unless set with
+// SetPartEncoding, is chosen when they are written, see AutoEncoding.
+func autoEncodeParts(parts []*part) []*part {
+	out := make([]*part, len(parts))
+	for i, p := range parts {
+		out[i] = p
+		if p.encodingSet {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		cp := *p
+		if err := p.copier(buf); err != nil {
+			cp.copier = func(io.Writer) error { return err }
+		} else {
+			cp.encoding = smallestEncoding(buf.Bytes())
+			cp.copier = func(w io.Writer) error {
+				_, err := w.Write(buf.Bytes())
+				return err
+			}
+		}
+		out[i] = &cp
+	}
+	return out
+}
+
+// smallestEncoding returns the encoding giving the smaller output for b between
+// quoted-printable and base64.
+func smallestEncoding(b []byte) Encoding {
+	qp := 0
+	for _, c := range b {
+		if c >= 0x80 || c == '=' || c < ' ' && c != '\r' && c != '\n' && c != '\t' {
+			qp += 3
+		} else {
+			qp++
+		}
+	}
+	// The lines are at most 76 characters long, the soft line breaks of
+	// quoted-printable being 3 bytes long.
+	qp += qp / (maxLineLen - 1) * 3
+	b64 := (len(b) + 2) / 3 * 4
+	b64 += b64 / maxLineLen * 2
+
+	if b64 < qp {
+		return Base64
+	}
+	return QuotedPrintable
+}
+
+func (m *Message) hasMixedPart(parts []*part) bool {
+	return (len(parts) > 0 && len(m.attachments) > 0) || len(m.attachments) > 1
+}
+
+func (m *Message) hasRelatedPart(parts []*part) bool {
+	return (len(parts) > 0 && len(m.embedded) > 0) || len(m.embedded) > 1
+}
+
+func (m *Message) hasAlternativePart(parts []*part) bool {
+	return len(parts) > 1
 }
 
 func (w *messageWriter) writeMessage(m *Message) {
-	if _, ok := m.header["Mime-Version"]; !ok {
+	w.keepURLs = m.keepURLs
+	w.boundary = m.boundary
+	if _, ok := m.header[canonicalHeaderKey("MIME-Version")]; !ok {
 		w.writeString("Mime-Version: 1.0\r\n")
 	}
-	if _, ok := m.header["Date"]; !ok {
-		w.writeHeader("Date", m.FormatDate(now()))
+	if _, ok := m.header["Date"]; !ok && !m.noDefaultDate {
+		w.writeHeader("Date", m.FormatDate(m.now()))
+	}
+	if _, ok := m.header["Message-ID"]; !ok && m.autoMessageID {
+		if w.err = m.setDefaultMessageID(); w.err != nil {
+			return
+		}
 	}
 	w.writeHeaders(m.header)
 
-	if m.hasMixedPart() {
+	if m.tree != nil {
+		w.writeEntity(m, m.tree)
+		return
+	}
+
+	parts := m.writtenParts()
+	if m.hasMixedPart(parts) {
 		w.openMultipart("mixed")
 	}
 
-	if m.hasRelatedPart() {
+	if m.hasRelatedPart(parts) {
 		w.openMultipart("related")
 	}
 
-	if m.hasAlternativePart() {
+	if m.hasAlternativePart(parts) {
 		w.openMultipart("alternative")
 	}
-	for _, part := range m.parts {
+	for _, part := range parts {
 		w.writePart(part, m.charset)
 	}
-	if m.hasAlternativePart() {
+	if m.hasAlternativePart(parts) {
 		w.closeMultipart()
 	}
 
 	w.addFiles(m.embedded, false)
-	if m.hasRelatedPart() {
+	if m.hasRelatedPart(parts) {
 		w.closeMultipart()
 	}
 
 	w.addFiles(m.attachments, true)
-	if m.hasMixedPart() {
+	if m.hasMixedPart(parts) {
 		w.closeMultipart()
 	}
 }
 
 func (w *messageWriter) openMultipart(mimeType string) {
+	if w.err != nil {
+		return
+	}
 	mw := multipart.NewWriter(w)
+	if w.boundary != "" {
+		w.boundaries++
+		boundary := w.boundary + "_" + strconv.Itoa(w.boundaries)
+		if err := mw.SetBoundary(boundary); err != nil {
+			w.err = fmt.Errorf("mailer: invalid boundary %q: %w", boundary, err)
+			return
+		}
+	}
 	contentType := "multipart/" + mimeType + ";\r\n boundary=" + mw.Boundary()
 	w.writers[w.depth] = mw
 
@@ -402,12 +1125,17 @@ func (w *messageWriter) openMultipart(mimeType string) {
 }
 
 func (w *messageWriter) createPart(h map[string][]string) {
+	if w.err != nil {
+		return
+	}
 	w.partWriter, w.err = w.writers[w.depth-1].CreatePart(h)
 }
 
 func (w *messageWriter) closeMultipart() {
 	if w.depth > 0 {
-		w.writers[w.depth-1].Close()
+		if err := w.writers[w.depth-1].Close(); w.err == nil {
+			w.err = err
+		}
 		w.depth--
 	}
 }
@@ -422,33 +1150,7 @@ func (w *messageWriter) writePart(p *part, charset string) {
 
 func (w *messageWriter) addFiles(files []*file, isAttachment bool) {
 	for _, f := range files {
-		if _, ok := f.Header["Content-Type"]; !ok {
-			mediaType := mime.TypeByExtension(filepath.Ext(f.Name))
-			if mediaType == "" {
-				mediaType = "application/octet-stream"
-			}
-			f.setHeader("Content-Type", mediaType+`; name="`+f.Name+`"`)
-		}
-
-		if _, ok := f.Header["Content-Transfer-Encoding"]; !ok {
-			f.setHeader("Content-Transfer-Encoding", string(Base64))
-		}
-
-		if _, ok := f.Header["Content-Disposition"]; !ok {
-			var disp string
-			if isAttachment {
-				disp = "attachment"
-			} else {
-				disp = "inline"
-			}
-			f.setHeader("Content-Disposition", disp+`; filename="`+f.Name+`"`)
-		}
-
-		if !isAttachment {
-			if _, ok := f.Header["Content-ID"]; !ok {
-				f.setHeader("Content-ID", "<"+f.Name+">")
-			}
-		}
+		f.setDefaultHeaders(isAttachment)
 		w.writeHeaders(f.Header)
 		w.writeBody(f.CopyFunc, Base64)
 	}
@@ -466,40 +1168,56 @@ func (w *messageWriter) Write(p []byte) (int, error) {
 }
 
 func (w *messageWriter) writeString(s string) {
-	n, _ := io.WriteString(w.w, s)
+	if w.err != nil {
+		return
+	}
+	var n int
+	n, w.err = io.WriteString(w.w, s)
 	w.n += int64(n)
 }
 
 func (w *messageWriter) writeHeader(k string, v ...string) {
+	if w.err != nil {
+		return
+	}
+	k = sanitizeHeaderValue(k)
 	w.writeString(k)
 	if len(v) == 0 {
 		w.writeString(":\r\n")
 		return
 	}
-	w.writeString(": ")
+	w.writeString(":")
 
 	// Max header line length is 78 characters in RFC 5322 and 76 characters
 	// in RFC 2047. So for the sake of simplicity we use the 76 characters
 	// limit.
-	charsLeft := 76 - len(k) - len(": ")
+	charsLeft := 76 - len(k) - len(":")
 
 	for i, s := range v {
-		// If the line is already too long, insert a newline right away.
-		if charsLeft < 1 {
-			if i == 0 {
-				w.writeString("\r\n ")
-			} else {
-				w.writeString(",\r\n ")
-			}
+		s = sanitizeHeaderValue(s)
+		if i != 0 {
+			w.writeString(",")
+			charsLeft--
+		}
+
+		// If the line is already too long, or if the value starts with an
+		// encoded-word which does not fit, insert a newline right away since
+		// an encoded-word cannot be split.
+		if charsLeft < 2 || (strings.HasPrefix(s, "=?") && firstTokenLen(s) > charsLeft-1) {
+			w.writeString("\r\n ")
 			charsLeft = 75
-		} else if i != 0 {
-			w.writeString(", ")
-			charsLeft -= 2
+		} else {
+			w.writeString(" ")
+			charsLeft--
 		}
 
 		// While the header content is too long, fold it by inserting a newline.
 		for len(s) > charsLeft {
-			s = w.writeLine(s, charsLeft)
+			rest, ok := w.writeLine(s, charsLeft)
+			if !ok {
+				break
+			}
+			s = rest
 			charsLeft = 75
 		}
 		w.writeString(s)
@@ -512,70 +1230,173 @@ func (w *messageWriter) writeHeader(k string, v ...string) {
 	w.writeString("\r\n")
 }
 
-func (w *messageWriter) writeLine(s string, charsLeft int) string {
+// writeLine writes the beginning of s followed by a newline, folding it on a
+// space before the limit when possible, and returns the rest of s. It returns
+// false without writing anything if s cannot be folded.
+func (w *messageWriter) writeLine(s string, charsLeft int) (string, bool) {
 	// If there is already a newline before the limit. Write the line.
 	if i := strings.IndexByte(s, '\n'); i != -1 && i < charsLeft {
 		w.writeString(s[:i+1])
-		return s[i+1:]
+		return s[i+1:], true
 	}
 
 	for i := charsLeft - 1; i >= 0; i-- {
 		if s[i] == ' ' {
 			w.writeString(s[:i])
 			w.writeString("\r\n ")
-			return s[i+1:]
+			return s[i+1:], true
 		}
 	}
 
 	// We could not insert a newline cleanly so look for a space or a newline
 	// even if it is after the limit.
-	for i := 75; i < len(s); i++ {
+	for i := charsLeft; i < len(s); i++ {
 		if s[i] == ' ' {
 			w.writeString(s[:i])
 			w.writeString("\r\n ")
-			return s[i+1:]
+			return s[i+1:], true
 		}
 		if s[i] == '\n' {
 			w.writeString(s[:i+1])
-			return s[i+1:]
+			return s[i+1:], true
 		}
 	}
 
-	// Too bad, no space or newline in the whole string. Just write everything.
-	w.writeString(s)
-	return ""
+	// Too bad, no space or newline in the whole string.
+	return s, false
+}
+
+// firstTokenLen returns the length of the first word of s, which is an
+// encoded-word when s is an encoded header value.
+func firstTokenLen(s string) int {
+	if i := strings.IndexAny(s, " \n"); i != -1 {
+		return i
+	}
+	return len(s)
 }
 
+// writeHeaders writes the header fields h, except the "Bcc" field whatever its
+// casing since Bcc recipients must never be disclosed.
 func (w *messageWriter) writeHeaders(h map[string][]string) {
 	if w.depth == 0 {
 		for k, v := range h {
-			if k != "Bcc" {
+			if !isBcc(k) {
 				w.writeHeader(k, v...)
 			}
 		}
-	} else {
-		w.createPart(h)
+		return
+	}
+
+	for k := range h {
+		if isBcc(k) {
+			h = withoutBcc(h)
+			break
+		}
+	}
+	w.createPart(sanitizeHeader(h))
+}
+
+// sanitizeHeader returns h, or a sanitized copy of h if one of its fields
+// contains a newline, see sanitizeHeaderValue.
+func sanitizeHeader(h map[string][]string) map[string][]string {
+	clean := true
+	for k, v := range h {
+		clean = clean && !strings.ContainsAny(k+strings.Join(v, ""), "\r\n")
+	}
+	if clean {
+		return h
+	}
+
+	c := make(map[string][]string, len(h))
+	for k, v := range h {
+		values := make([]string, len(v))
+		for i, s := range v {
+			values[i] = sanitizeHeaderValue(s)
+		}
+		c[sanitizeHeaderValue(k)] = values
 	}
+	return c
+}
+
+// sanitizeHeaderValue prevents s from injecting header fields: a newline
+// followed by a space or a tab is removed as defined by the unfolding of
+// RFC 5322, section 2.2.3, and the other CR and LF characters are replaced by
+// a space. The value is folded again when it is written.
+func sanitizeHeaderValue(s string) string {
+	if !strings.ContainsAny(s, "\r\n") {
+		return s
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\r' && c != '\n' {
+			b.WriteByte(c)
+			continue
+		}
+		if c == '\r' && i+1 < len(s) && s[i+1] == '\n' {
+			i++
+		}
+		if i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '\t') {
+			continue
+		}
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+func isBcc(field string) bool {
+	return strings.EqualFold(field, "Bcc")
+}
+
+// withoutBcc returns a copy of h without the "Bcc" field.
+func withoutBcc(h map[string][]string) map[string][]string {
+	c := make(map[string][]string, len(h))
+	for k, v := range h {
+		if !isBcc(k) {
+			c[k] = v
+		}
+	}
+	return c
 }
 
 func (w *messageWriter) writeBody(f func(io.Writer) error, enc Encoding) {
+	if w.err != nil {
+		return
+	}
+
 	var subWriter io.Writer
 	if w.depth == 0 {
 		w.writeString("\r\n")
-		subWriter = w.w
+		subWriter = w
 	} else {
 		subWriter = w.partWriter
 	}
 
+	var err error
 	if enc == Base64 {
 		wc := base64.NewEncoder(base64.StdEncoding, newBase64LineWriter(subWriter))
-		w.err = f(wc)
-		wc.Close()
+		if err = f(wc); err == nil {
+			err = wc.Close()
+		}
 	} else if enc == Unencoded {
-		w.err = f(subWriter)
+		// The dot-stuffing is left to the SMTP DATA writer.
+		err = f(&crlfWriter{w: subWriter})
+	} else if enc == Encoding7bit {
+		err = f(&crlfWriter{w: sevenBitWriter{subWriter}})
 	} else {
-		wc := newQPWriter(subWriter)
-		w.err = f(wc)
-		wc.Close()
+		var wc io.WriteCloser = newQPWriter(subWriter)
+		if w.keepURLs {
+			wc = newURLQPWriter(subWriter)
+		}
+		if err = f(wc); err == nil {
+			err = wc.Close()
+		}
+	}
+
+	// The error of the underlying writer takes precedence over the one
+	// returned by f since f usually only reports it.
+	if w.err == nil {
+		w.err = err
 	}
 }
@@ -3,14 +3,24 @@ package mailer
 import (
 	"bytes"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"io/ioutil"
+	"math/rand"
+	"mime"
+	"mime/quotedprintable"
+	"os"
 	"path/filepath"
 	"regexp"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -61,6 +71,62 @@ func TestMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestParseTemplateE(t *testing.T) {
+	got, err := ParseTemplateE("_fixture/example.html", struct{ Name string }{Name: "Testing"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi, Testing", got)
+
+	_, err = ParseTemplateE("_fixture/missing.html", nil)
+	assert.True(t, errors.Is(err, ErrParseTemplate), fmt.Sprintf("got %v, want ErrParseTemplate", err))
+
+	_, err = ParseTemplateE("_fixture/example.html", struct{}{})
+	assert.True(t, errors.Is(err, ErrExecuteTemplate), fmt.Sprintf("got %v, want ErrExecuteTemplate", err))
+
+	assert.Panics(t, func() { ParseTemplate("_fixture/missing.html", nil) })
+}
+
+func TestFormatHTMLE(t *testing.T) {
+	m := NewMessage()
+	tpl := template.Must(template.New("body").Parse("Hi, {{.User.Name}}"))
+
+	got, err := m.FormatHTMLE(tpl, map[string]interface{}{
+		"User": struct{ Name string }{"Testing"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi, Testing", got)
+
+	_, err = m.FormatHTMLE(tpl, struct{ User *struct{ Name string } }{})
+	assert.True(t, errors.Is(err, ErrExecuteTemplate), fmt.Sprintf("got %v, want ErrExecuteTemplate", err))
+
+	assert.Panics(t, func() { m.FormatHTML(tpl, struct{ User *struct{ Name string } }{}) })
+}
+
+func TestAutoHeaderEncoding(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Réunion du comité de direction", "=?UTF-8?q?R=C3=A9union_du_comit=C3=A9_de_direction?="},
+		{"こんにちは世界", "=?UTF-8?b?44GT44KT44Gr44Gh44Gv5LiW55WM?="},
+		{"Test", "Test"},
+	}
+	for _, test := range tests {
+		for _, enc := range []Encoding{QuotedPrintable, Base64} {
+			m := NewMessage(SetEncoding(enc), AutoHeaderEncoding())
+			m.SetHeader("Subject", test.value)
+			assert.Equal(t, []string{test.want}, m.GetHeader("Subject"))
+
+			q := mime.QEncoding.Encode("UTF-8", test.value)
+			b := mime.BEncoding.Encode("UTF-8", test.value)
+			assert.LessOrEqual(t, len(test.want), len(q))
+			assert.LessOrEqual(t, len(test.want), len(b))
+		}
+	}
+
+	m := NewMessage(AutoHeaderEncoding())
+	assert.Equal(t, "=?UTF-8?b?44GT44KT44Gr44Gh44Gv?= <to@example.com>", m.FormatAddress("to@example.com", "こんにちは"))
+}
+
 func TestCustomMessage(t *testing.T) {
 	m := NewMessage(SetCharset("ISO-8859-1"), SetEncoding(Base64))
 	m.SetHeaders(map[string][]string{
@@ -85,6 +151,53 @@ func TestCustomMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestDefaultCharsetEncoding(t *testing.T) {
+	defer func(charset string, enc Encoding) {
+		DefaultCharset, DefaultEncoding = charset, enc
+	}(DefaultCharset, DefaultEncoding)
+	DefaultCharset, DefaultEncoding = "ISO-8859-1", Base64
+
+	m := NewMessage()
+	m.SetHeaders(map[string][]string{
+		"From":    {"from@example.com"},
+		"To":      {"to@example.com"},
+		"Subject": {"Café"},
+	})
+	m.SetBody("text/html", "¡Hola, señor!")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Subject: =?ISO-8859-1?b?Q2Fmw6k=?=\r\n" +
+			"Content-Type: text/html; charset=ISO-8859-1\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			"wqFIb2xhLCBzZcOxb3Ih",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m = NewMessage(SetCharset("UTF-8"), SetEncoding(QuotedPrintable))
+	m.SetHeaders(map[string][]string{
+		"From":    {"from@example.com"},
+		"To":      {"to@example.com"},
+		"Subject": {"Café"},
+	})
+	m.SetBody("text/html", "¡Hola, señor!")
+
+	want.content = "From: from@example.com\r\n" +
+		"To: to@example.com\r\n" +
+		"Subject: =?UTF-8?q?Caf=C3=A9?=\r\n" +
+		"Content-Type: text/html; charset=UTF-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"=C2=A1Hola, se=C3=B1or!"
+
+	testMessage(t, m, 0, want)
+}
+
 func TestUnencodedMessage(t *testing.T) {
 	m := NewMessage(SetEncoding(Unencoded))
 	m.SetHeaders(map[string][]string{
@@ -109,6 +222,243 @@ func TestUnencodedMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestUnencodedLineEndings(t *testing.T) {
+	m := NewMessage(SetEncoding(Unencoded))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Line 1\nLine 2\r\n.Line 3\n")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"Line 1\r\nLine 2\r\n.Line 3\r\n",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func Test7bitEncoding(t *testing.T) {
+	m := NewMessage(SetEncoding(Encoding7bit))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "Café")
+	m.SetBody("text/plain", "Line 1\nLine 2\r\n")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Subject: =?UTF-8?q?Caf=C3=A9?=\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 7bit\r\n" +
+			"\r\n" +
+			"Line 1\r\nLine 2\r\n",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m.SetBody("text/plain", "ASCII")
+	m.AddAlternative("text/html", "<p>Café</p>")
+	_, err := m.WriteTo(io.Discard)
+	assert.EqualError(t, err, "mailer: the content of a 7bit part has the non-ASCII byte 0xC3")
+
+	m.SetBody("text/plain", "Café", SetPartEncoding(QuotedPrintable))
+	_, err = m.WriteTo(io.Discard)
+	assert.NoError(t, err)
+}
+
+func TestCRLFWriter(t *testing.T) {
+	data := "a\nb\r\nc\r\r\nd\n\ne"
+	for _, size := range []int{1, 2, 3, len(data)} {
+		buf := new(bytes.Buffer)
+		w := &crlfWriter{w: buf}
+		for p := data; len(p) > 0; {
+			k := min(size, len(p))
+			n, err := w.Write([]byte(p[:k]))
+			assert.NoError(t, err)
+			assert.Equal(t, k, n)
+			p = p[k:]
+		}
+		assert.Equal(t, "a\r\nb\r\nc\r\r\nd\r\n\r\ne", buf.String())
+	}
+
+	errWrite := errors.New("write error")
+	_, err := (&crlfWriter{w: errorWriter{errWrite}}).Write([]byte("a\n"))
+	assert.Equal(t, errWrite, err)
+}
+
+func TestSetBoundary(t *testing.T) {
+	m := NewMessage(SetBoundary("test-boundary"))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AddAlternative("text/html", "<p>Test</p>")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	compareBodies(t, string(b), "Mime-Version: 1.0\r\n"+
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n"+
+		"From: from@example.com\r\n"+
+		"To: to@example.com\r\n"+
+		"Content-Type: multipart/mixed; boundary=test-boundary_1\r\n"+
+		"\r\n"+
+		"--test-boundary_1\r\n"+
+		"Content-Type: multipart/alternative;\r\n"+
+		" boundary=test-boundary_2\r\n"+
+		"\r\n"+
+		"--test-boundary_2\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Test\r\n"+
+		"--test-boundary_2\r\n"+
+		"Content-Type: text/html; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"<p>Test</p>\r\n"+
+		"--test-boundary_2--\r\n"+
+		"\r\n"+
+		"--test-boundary_1\r\n"+
+		"Content-Type: application/pdf; name=\"test.pdf\"\r\n"+
+		"Content-Disposition: attachment; filename=\"test.pdf\"\r\n"+
+		"Content-Transfer-Encoding: base64\r\n"+
+		"\r\n"+
+		base64.StdEncoding.EncodeToString([]byte("Content of test.pdf"))+"\r\n"+
+		"--test-boundary_1--\r\n")
+
+	again, err := m.Clone().Render()
+	assert.NoError(t, err)
+	compareBodies(t, string(again), string(b))
+
+	for _, prefix := range []string{"invalid<boundary>", strings.Repeat("a", 70)} {
+		m := NewMessage(SetBoundary(prefix))
+		m.SetHeader("To", "to@example.com")
+		m.SetBody("text/plain", "Test")
+		m.Attach(mockCopyFile("/tmp/test.pdf"))
+		_, err := m.Render()
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "mailer: invalid boundary")
+		}
+	}
+}
+
+func TestKeepURLs(t *testing.T) {
+	long := "https://track.example.com/c/" + strings.Repeat("a1b2c3d4e5", 17) + "?id=42"
+	short := "https://example.com/unsubscribe?token=0123456789abcdef"
+	body := "Click here: " + long + " to confirm.\n" +
+		strings.Repeat("Lorem ipsum ", 3) + "see " + short + "\n"
+
+	for _, keep := range []bool{false, true} {
+		var settings []MessageSetting
+		if keep {
+			settings = append(settings, KeepURLs())
+		}
+		m := NewMessage(settings...)
+		m.SetHeader("To", "to@example.com")
+		m.SetBody("text/plain", body)
+
+		b, err := m.Render()
+		assert.NoError(t, err)
+		p, err := ParseMessage(bytes.NewReader(b))
+		assert.NoError(t, err)
+		if assert.Len(t, p.Parts, 1) {
+			assert.Equal(t, strings.ReplaceAll(body, "\n", "\r\n"), p.Parts[0].Body)
+		}
+
+		encodedShort := strings.ReplaceAll(short, "=", "=3D")
+		assert.Equal(t, keep, strings.Contains(string(b), "\r\n"+encodedShort+"\r\n"), "keep %v", keep)
+		for _, line := range strings.Split(string(b), "\r\n") {
+			assert.True(t, len(line) <= 76, line)
+		}
+	}
+}
+
+func TestURLQPWriter(t *testing.T) {
+	data := []string{
+		"",
+		"Hello, World!",
+		strings.Repeat("Long line without any URL, ", 10),
+		strings.Repeat("é=", 60) + "\r\n" + strings.Repeat(" ", 80) + "\n\ttab \n",
+		strings.Repeat("x", 74) + "=y\n" + strings.Repeat("x", 75) + " \r\n",
+		"A URL longer than a line: https://example.com/" + strings.Repeat("path/", 30),
+	}
+	for _, s := range data {
+		want := new(bytes.Buffer)
+		qp := quotedprintable.NewWriter(want)
+		qp.Write([]byte(s))
+		qp.Close()
+
+		for _, size := range []int{1, 7, len(s) + 1} {
+			got := new(bytes.Buffer)
+			w := newURLQPWriter(got)
+			for p := s; len(p) > 0; {
+				k := min(size, len(p))
+				n, err := w.Write([]byte(p[:k]))
+				assert.NoError(t, err)
+				assert.Equal(t, k, n)
+				p = p[k:]
+			}
+			assert.NoError(t, w.Close())
+			assert.Equal(t, want.String(), got.String(), "%q", s)
+		}
+	}
+
+	errWrite := errors.New("write error")
+	_, err := newURLQPWriter(errorWriter{errWrite}).Write([]byte("a\n"))
+	assert.Equal(t, errWrite, err)
+}
+
+func TestAutoEncoding(t *testing.T) {
+	ascii := "Hello, this is a mostly ASCII text, café."
+	cyrillic := "Привет, это текст на русском языке."
+
+	encodings := func(m *Message) []string {
+		b, err := m.Render()
+		assert.NoError(t, err)
+		parsed, err := ParseMessage(bytes.NewReader(b))
+		assert.NoError(t, err)
+
+		var encs []string
+		for _, p := range parsed.Parts {
+			encs = append(encs, firstValue(p.Header, "Content-Transfer-Encoding"))
+			assert.Contains(t, []string{ascii, cyrillic}, p.Body)
+		}
+		return encs
+	}
+
+	m := NewMessage(AutoEncoding())
+	m.SetBody("text/plain", ascii)
+	m.AddAlternative("text/html", cyrillic)
+	assert.Equal(t, []string{"quoted-printable", "base64"}, encodings(m))
+	// The message can be written again.
+	assert.Equal(t, []string{"quoted-printable", "base64"}, encodings(m))
+	assert.Equal(t, []string{"quoted-printable", "base64"}, encodings(m.Clone()))
+
+	m = NewMessage(AutoEncoding())
+	m.SetBody("text/plain", cyrillic, SetPartEncoding(QuotedPrintable))
+	m.AddAlternative("text/html", ascii, SetPartEncoding(Base64))
+	assert.Equal(t, []string{"quoted-printable", "base64"}, encodings(m))
+
+	m = NewMessage(AutoEncoding(), SetEncoding(QuotedPrintable))
+	m.SetBody("text/plain", cyrillic)
+	assert.Equal(t, []string{"quoted-printable"}, encodings(m))
+}
+
+func TestSmallestEncoding(t *testing.T) {
+	assert.Equal(t, QuotedPrintable, smallestEncoding(nil))
+	assert.Equal(t, QuotedPrintable, smallestEncoding([]byte(strings.Repeat("ASCII text\r\n", 100))))
+	assert.Equal(t, QuotedPrintable, smallestEncoding([]byte("Un café crème, s'il vous plaît.")))
+	assert.Equal(t, Base64, smallestEncoding([]byte("日本語のテキスト")))
+	assert.Equal(t, Base64, smallestEncoding([]byte{0, 1, 2, 3, 0xff, 0xfe}))
+}
+
 func TestRecipients(t *testing.T) {
 	m := NewMessage()
 	m.SetHeaders(map[string][]string{
@@ -136,132 +486,1241 @@ func TestRecipients(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
-func TestAlternative(t *testing.T) {
+func TestRecipientLists(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
-	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain", "¡Hola, señor!")
-	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+	m.To(`to1@example.com, "Doe, John" <to2@example.com>`)
+	m.Cc(`"Doe, Jane" <cc@example.com>`)
+	m.Cc("José <jose@example.com>, cc2@example.com")
+	m.Bcc("bcc1@example.com,bcc2@example.com", "bcc3@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	assert.Equal(t, []string{"to1@example.com", `"Doe, John" <to2@example.com>`}, m.GetHeader("To"))
+	assert.Equal(t, []string{`"Doe, Jane" <cc@example.com>`, "=?UTF-8?q?Jos=C3=A9?= <jose@example.com>", "cc2@example.com"}, m.GetHeader("Cc"))
+
+	to, err := m.Recipients()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"to1@example.com", "to2@example.com",
+		"cc@example.com", "jose@example.com", "cc2@example.com",
+		"bcc1@example.com", "bcc2@example.com", "bcc3@example.com",
+	}, to)
+
+	// A string which is not a valid list is kept as is.
+	m.To("to1@example.com, <invalid")
+	assert.Equal(t, []string{"to1@example.com, <invalid"}, m.GetHeader("To"))
+}
+
+func TestCcBcc(t *testing.T) {
+	m := NewMessage().
+		From("from@example.com", "").
+		To("to@example.com").
+		Cc("cc1@example.com").
+		Cc("cc2@example.com").
+		Bcc("bcc1@example.com").
+		Bcc("bcc2@example.com").
+		Body("Test message", false)
 
 	want := &message{
 		from: "from@example.com",
-		to:   []string{"to@example.com"},
+		to: []string{
+			"to@example.com",
+			"cc1@example.com",
+			"cc2@example.com",
+			"bcc1@example.com",
+			"bcc2@example.com",
+		},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
+			"Cc: cc1@example.com, cc2@example.com\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestBccNeverWritten(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Bcc", "bcc1@example.com")
+	m.SetHeader("bcc", "bcc2@example.com")
+	m.SetHeader("BCC", "bcc3@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AddAlternative("text/html", "<p>Test</p>")
+	m.EmbedBytes("image.jpg", []byte("Image"), SetHeader(map[string][]string{"bcc": {"bcc4@example.com"}}))
+	m.AttachBytes("test.txt", []byte("Content"), SetHeader(map[string][]string{"Bcc": {"bcc5@example.com"}}))
+
+	buf := new(bytes.Buffer)
+	_, err := m.WriteTo(buf)
+	assert.NoError(t, err)
+
+	out := strings.ToLower(buf.String())
+	assert.Contains(t, out, "multipart/mixed")
+	assert.Contains(t, out, "multipart/related")
+	assert.Contains(t, out, "multipart/alternative")
+	assert.NotContains(t, out, "bcc")
+}
+
+func TestHeaderCasing(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("from", "from@example.com")
+	m.SetHeader("to", "to@example.com")
+	m.SetAddressHeader("bcc", "bcc@example.com", "")
+	m.SetHeader("subject", "Test")
+	m.SetHeader("mime-version", "1.0")
+	m.SetDateHeader("date", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	m.SetHeader("message-id", "<1234@example.com>")
+	m.SetHeader("X-SES-CONFIGURATION-SET", "test")
+	m.SetBody("text/plain", "Test message")
+
+	assert.Equal(t, []string{"Test"}, m.GetHeader("SUBJECT"))
+	assert.Equal(t, []string{"<1234@example.com>"}, m.GetHeader("Message-ID"))
+
+	to, err := m.getRecipients()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"to@example.com", "bcc@example.com"}, to)
+
+	buf := new(bytes.Buffer)
+	_, err = m.WriteTo(buf)
+	assert.NoError(t, err)
+	compareBodies(t, buf.String(), "From: from@example.com\r\n"+
+		"To: to@example.com\r\n"+
+		"Subject: Test\r\n"+
+		"Mime-Version: 1.0\r\n"+
+		"Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n"+
+		"Message-ID: <1234@example.com>\r\n"+
+		"X-SES-CONFIGURATION-SET: test\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Test message")
+}
+
+func TestHeaderInjection(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "Hello\r\nBcc: attacker@evil.com")
+	m.SetAddressHeader("Reply-To", "reply@example.com", "Name\nBcc: attacker@evil.com")
+	m.SetEnvelopeFrom("bounce@example.com\r\nBcc: attacker@evil.com")
+	m.SetBody("text/plain", "Test message")
+	m.AttachBytes("test\r\nBcc: attacker@evil.com", []byte("Content"))
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	for _, line := range strings.Split(string(b), "\r\n") {
+		assert.False(t, strings.HasPrefix(line, "Bcc:"), "injected header: %q", line)
+	}
+
+	parsed, err := ParseMessage(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.NotContains(t, parsed.Header, "Bcc")
+	assert.Equal(t, []string{"<bounce@example.com Bcc: attacker@evil.com>"}, parsed.Header["Return-Path"])
+	assert.Len(t, parsed.Parts, 2)
+	for _, p := range parsed.Parts {
+		assert.NotContains(t, p.Header, "Bcc")
+	}
+}
+
+func TestSanitizeHeaderValue(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"Test", "Test"},
+		{"a\r\nb", "a b"},
+		{"a\nb\rc", "a b c"},
+		{"a\r\n\tb", "a\tb"},
+		{"a\r\n", "a "},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.want, sanitizeHeaderValue(test.in))
+	}
+}
+
+func TestClone(t *testing.T) {
+	base := NewMessage(AutoMessageID("example.com"))
+	base.SetHeader("From", "from@example.com")
+	base.SetHeader("Subject", "Newsletter")
+	base.SetBody("text/plain", "Test message")
+	base.AttachBytes("test.txt", []byte("Content"))
+
+	var wg sync.WaitGroup
+	clones := make([]*Message, 2)
+	for i := range clones {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clones[i] = base.Clone()
+		}(i)
+	}
+	wg.Wait()
+
+	clones[0].SetHeader("To", "to1@example.com")
+	clones[0].GetHeader("Subject")[0] = "Changed"
+	clones[0].AddAlternative("text/html", "<p>Test message</p>")
+	clones[0].attachments[0].Header["Content-Type"] = []string{"text/csv"}
+	clones[1].SetHeader("To", "to2@example.com")
+
+	assert.Empty(t, base.GetHeader("To"))
+	assert.Equal(t, []string{"Newsletter"}, base.GetHeader("Subject"))
+	assert.Len(t, base.parts, 1)
+	assert.Empty(t, base.attachments[0].Header)
+	assert.True(t, clones[1].autoMessageID)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to2@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to2@example.com\r\n" +
+			"Subject: Newsletter\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: text/plain; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"=C2=A1Hola, se=C3=B1or!\r\n" +
+			"Test message\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Type: text/plain; charset=utf-8; name=\"test.txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	clones[1].SetMessageID("1234@example.com")
+	want.content = "Message-ID: <1234@example.com>\r\n" + want.content
+
+	testMessage(t, clones[1], 1, want)
+}
+
+func TestWithConfig(t *testing.T) {
+	m := NewMessage(WithConfig(ConfigMailer{SenderEmail: "other@example.org", SenderName: "Other"}))
+	assert.Equal(t, []string{`"Other" <other@example.org>`}, m.GetHeader("From"))
+
+	cfg := Config
+	defer func() { Config = cfg }()
+	Config = nil
+
+	assert.Empty(t, NewMessage().GetHeader("From"))
+	m = NewMessage(WithConfig(ConfigMailer{SenderEmail: "other@example.org"}))
+	assert.Equal(t, []string{"other@example.org"}, m.GetHeader("From"))
+}
+
+func TestRender(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	compareBodies(t, string(b), "Mime-Version: 1.0\r\n"+
+		"Date: Wed, 25 Jun 2014 17:46:00 +0000\r\n"+
+		"From: from@example.com\r\n"+
+		"To: to@example.com\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Test message")
+
+	m.Attach("does-not-exist.txt")
+	b, err = m.Render()
+	assert.Nil(t, b)
+	assert.Error(t, err)
+}
+
+func TestMessageString(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	compareBodies(t, m.String(), string(b))
+	compareBodies(t, fmt.Sprint(m), string(b))
+
+	m.Attach("does-not-exist.txt")
+	_, err = m.Render()
+	assert.Equal(t, "<error: "+err.Error()+">", m.String())
+}
+
+func TestWriteToError(t *testing.T) {
+	simple := NewMessage()
+	simple.SetHeader("From", "from@example.com")
+	simple.SetHeader("To", "to@example.com")
+	simple.SetBody("text/plain", "Test message")
+
+	multi := NewMessage()
+	multi.SetHeader("From", "from@example.com")
+	multi.SetHeader("To", "to@example.com")
+	multi.SetBody("text/plain", "Test message")
+	multi.AddAlternative("text/html", "<p>Test message</p>")
+	multi.AttachBytes("test.txt", []byte("Content"))
+
+	for _, m := range []*Message{simple, multi} {
+		b, err := m.Render()
+		assert.NoError(t, err)
+
+		n, err := m.WriteTo(ioutil.Discard)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(len(b)), n)
+
+		for limit := 0; limit < len(b); limit += 7 {
+			w := &failingWriter{limit: limit}
+			n, err := m.WriteTo(w)
+			assert.Equal(t, errBrokenPipe, err, "limit %d", limit)
+			assert.Equal(t, int64(w.n), n, "limit %d", limit)
+		}
+	}
+}
+
+var errBrokenPipe = errors.New("broken pipe")
+
+// failingWriter fails once limit bytes have been written.
+type failingWriter struct {
+	limit int
+	n     int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.n+len(p) > w.limit {
+		n := w.limit - w.n
+		w.n = w.limit
+		return n, errBrokenPipe
+	}
+	w.n += len(p)
+	return len(p), nil
+}
+
+func TestLongEncodedSubject(t *testing.T) {
+	subject := "【重要】システムメンテナンスのお知らせ：2024年4月1日（月）午前2時から午前6時まで、" +
+		"全サービスが一時的に利用できなくなります"
+
+	for _, enc := range []Encoding{QuotedPrintable, Base64} {
+		m := NewMessage(SetEncoding(enc))
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetHeader("Subject", subject)
+		m.SetBody("text/plain", "Test message")
+
+		b, err := m.Render()
+		assert.NoError(t, err)
+		header, _ := splitMessage(b)
+
+		for _, line := range strings.Split(strings.TrimSuffix(string(header), "\r\n"), "\r\n") {
+			assert.True(t, len(line) <= 76, "line too long: %q", line)
+			if strings.HasPrefix(line, " ") {
+				// Folded lines must be made of whole encoded-words.
+				for _, word := range strings.Fields(line) {
+					assert.Regexp(t, `^=\?UTF-8\?[bq]\?[^?\s]*\?=$`, word)
+				}
+			}
+		}
+
+		p, err := ParseMessage(bytes.NewReader(b))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{subject}, p.Header["Subject"])
+	}
+}
+
+func TestAddFrom(t *testing.T) {
+	m := NewMessage().
+		From("alice@example.com", "Alice").
+		AddFrom("bob@example.com", "").
+		To("to@example.com").
+		Body("Test message", false)
+
+	want := &message{
+		from: "alice@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: \"Alice\" <alice@example.com>, bob@example.com\r\n" +
+			"Sender: \"Alice\" <alice@example.com>\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m = NewMessage()
+	m.SetHeader("From", "alice@example.com", "bob@example.com")
+	m.SetHeader("To", "to@example.com")
+	err := Send(SendFunc(func(string, []string, io.WriterTo) error { return nil }), m)
+	assert.EqualError(t, err, `mailer: could not send email 1: mailer: invalid message, a "Sender" field is required with several "From" addresses`)
+}
+
+func TestContentLanguage(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	assert.NoError(t, m.SetContentLanguage("de", "en-US"))
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Language: de, en-US\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	assert.EqualError(t, m.SetContentLanguage(), "mailer: at least one Content-Language tag is required")
+	for _, tag := range []string{"", "en US", "fr,de", "-en", "en\r\nBcc: x@example.com"} {
+		assert.EqualError(t, m.SetContentLanguage(tag), fmt.Sprintf("mailer: invalid Content-Language tag %q", tag))
+	}
+	assert.Equal(t, []string{"de, en-US"}, m.GetHeader("Content-Language"))
+}
+
+func TestNoDefaultDate(t *testing.T) {
+	m := NewMessage(SetNoDefaultDate())
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	compareBodies(t, string(b), "Mime-Version: 1.0\r\n"+
+		"From: from@example.com\r\n"+
+		"To: to@example.com\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Test message")
+
+	m.SetDateHeader("Date", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC))
+	b, err = m.Render()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n")
+}
+
+func TestCustomMimeVersion(t *testing.T) {
+	for _, field := range []string{"MIME-Version", "mime-version", "Mime-Version"} {
+		m := NewMessage(SetNoDefaultDate())
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetHeader(field, "1.0 (produced by gateway)")
+		m.SetBody("text/plain", "Test message")
+
+		b, err := m.Render()
+		assert.NoError(t, err)
+		assert.Equal(t, 1, strings.Count(strings.ToLower(string(b)), "mime-version:"), field)
+		compareBodies(t, string(b), "Mime-Version: 1.0 (produced by gateway)\r\n"+
+			"From: from@example.com\r\n"+
+			"To: to@example.com\r\n"+
+			"Content-Type: text/plain; charset=UTF-8\r\n"+
+			"Content-Transfer-Encoding: quoted-printable\r\n"+
+			"\r\n"+
+			"Test message")
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	t.Parallel()
+
+	clock := func() time.Time { return time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC) }
+	m := NewMessage(SetClock(clock))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "Date: Thu, 04 Mar 2021 05:06:07 +0000\r\n")
+	assert.Equal(t, clock(), m.Clone().now())
+}
+
+func TestReplyTo(t *testing.T) {
+	m := NewMessage().
+		To("to@example.com").
+		ReplyTo("support@example.com", "Señor Support").
+		Body("Test message", false)
+
+	want := &message{
+		from: "noreply@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: \"System example\" <noreply@example.com>\r\n" +
+			"To: to@example.com\r\n" +
+			"Reply-To: =?UTF-8?q?Se=C3=B1or_Support?= <support@example.com>\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestAddReplyTo(t *testing.T) {
+	m := NewMessage().
+		To("to@example.com").
+		ReplyTo("alice@example.com", "Alice").
+		AddReplyTo("bob@example.com", "").
+		AddReplyTo("support-team-with-a-long-address@example.com", "Señor Support").
+		Body("Test message", false)
+
+	want := &message{
+		from: "noreply@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: \"System example\" <noreply@example.com>\r\n" +
+			"To: to@example.com\r\n" +
+			"Reply-To: \"Alice\" <alice@example.com>, bob@example.com,\r\n" +
+			" =?UTF-8?q?Se=C3=B1or_Support?=\r\n" +
+			" <support-team-with-a-long-address@example.com>\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestEnvelopeFrom(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("Sender", "sender@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetEnvelopeFrom("bounce+to=example.com@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "bounce+to=example.com@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"Sender: sender@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Return-Path: <bounce+to=example.com@example.com>\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m.SetEnvelopeFrom("")
+	from, err := m.getFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "sender@example.com", from)
+}
+
+func TestListUnsubscribe(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	err := m.SetListUnsubscribe("mailto:unsubscribe@example.com?subject=unsubscribe", "https://example.com/unsubscribe/7e3c2a")
+	assert.NoError(t, err)
+	m.SetListUnsubscribePost()
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"List-Unsubscribe: <mailto:unsubscribe@example.com?subject=unsubscribe>, <https://example.com/unsubscribe/7e3c2a>\r\n" +
+			"List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	assert.Error(t, m.SetListUnsubscribe())
+	assert.Error(t, m.SetListUnsubscribe("/unsubscribe"))
+	assert.Error(t, m.SetListUnsubscribe("ftp://example.com/unsubscribe"))
+	assert.Error(t, m.SetListUnsubscribe("mailto:"))
+	assert.Error(t, m.SetListUnsubscribe("https://example.com/a b"))
+}
+
+func TestPriority(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetPriority(PriorityHigh)
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"X-Priority: 1 (Highest)\r\n" +
+			"Priority: urgent\r\n" +
+			"Importance: high\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m.SetPriority(PriorityLow)
+	assert.Equal(t, []string{"5 (Lowest)"}, m.GetHeader("X-Priority"))
+	assert.Equal(t, []string{"non-urgent"}, m.GetHeader("Priority"))
+	assert.Equal(t, []string{"low"}, m.GetHeader("Importance"))
+
+	m.SetPriority(PriorityNormal)
+	assert.Empty(t, m.GetHeader("X-Priority"))
+	assert.Empty(t, m.GetHeader("Priority"))
+	assert.Empty(t, m.GetHeader("Importance"))
+}
+
+func TestPriorityValues(t *testing.T) {
+	// The values are exported and must not depend on the other constants.
+	assert.Equal(t, Priority(0), PriorityNormal)
+	assert.Equal(t, Priority(1), PriorityHigh)
+	assert.Equal(t, Priority(2), PriorityLow)
+}
+
+func TestAutoSubmitted(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	assert.NoError(t, m.SetAutoSubmitted("Auto-Generated"))
+	m.SetPrecedenceBulk()
+	m.SetBody("text/plain", "Test message")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Auto-Submitted: auto-generated\r\n" +
+			"Precedence: bulk\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message",
+	}
+
+	testMessage(t, m, 0, want)
+
+	assert.NoError(t, m.SetAutoSubmitted("auto-replied"))
+	assert.Equal(t, []string{"auto-replied"}, m.GetHeader("Auto-Submitted"))
+	for _, value := range []string{"", "yes", "auto-generated\r\nBcc: x@example.com"} {
+		assert.EqualError(t, m.SetAutoSubmitted(value), fmt.Sprintf("mailer: invalid Auto-Submitted value %q", value))
+	}
+	assert.Equal(t, []string{"auto-replied"}, m.GetHeader("Auto-Submitted"))
+}
+
+func TestMessageID(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetMessageID("1234@example.com")
+	assert.Equal(t, []string{"<1234@example.com>"}, m.GetHeader("Message-ID"))
+	m.SetMessageID("<5678@example.com>")
+	assert.Equal(t, []string{"<5678@example.com>"}, m.GetHeader("Message-ID"))
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"Message-ID: <5678@example.com>\r\n",
+	}
+	testMessage(t, m, 0, want)
+}
+
+func TestAutoMessageID(t *testing.T) {
+	idRegExp := regexp.MustCompile(`^<[0-9a-z]+\.[0-9a-f]{32}@([a-z.]+)>$`)
+
+	m := NewMessage(AutoMessageID(""))
+	m.SetAddressHeader("From", "from@mail.example.com", "From")
+	assert.Empty(t, m.GetHeader("Message-ID"))
+
+	_, err := m.WriteTo(ioutil.Discard)
+	assert.NoError(t, err)
+	id := m.GetHeader("Message-ID")
+	assert.Len(t, id, 1)
+	match := idRegExp.FindStringSubmatch(id[0])
+	assert.Equal(t, "mail.example.com", match[1], id[0])
+
+	// The ID is kept when the message is written again.
+	_, err = m.WriteTo(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, id, m.GetHeader("Message-ID"))
+
+	m = NewMessage(AutoMessageID("example.org"))
+	_, err = m.WriteTo(ioutil.Discard)
+	assert.NoError(t, err)
+	match = idRegExp.FindStringSubmatch(m.GetHeader("Message-ID")[0])
+	assert.Equal(t, "example.org", match[1])
+
+	m = NewMessage(AutoMessageID(""))
+	m.Reset()
+	_, err = m.WriteTo(ioutil.Discard)
+	assert.EqualError(t, err, `mailer: cannot generate Message-ID, "From" field is absent`)
+
+	id1, err := GenerateMessageID("example.com")
+	assert.NoError(t, err)
+	id2, err := GenerateMessageID("example.com")
+	assert.NoError(t, err)
+	assert.NotEqual(t, id1, id2)
+}
+
+func TestThread(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	assert.NoError(t, m.SetInReplyTo("<3.reply@example.com>"))
+	assert.NoError(t, m.SetReferences(
+		"<1.0123456789abcdef0123456789abcdef@example.com>",
+		"<2.0123456789abcdef0123456789abcdef@example.com>",
+		"<3.reply@example.com>",
+	))
+
+	want := &message{
+		from: "from@example.com",
+		content: "From: from@example.com\r\n" +
+			"In-Reply-To: <3.reply@example.com>\r\n" +
+			"References: <1.0123456789abcdef0123456789abcdef@example.com>\r\n" +
+			" <2.0123456789abcdef0123456789abcdef@example.com> <3.reply@example.com>\r\n",
+	}
+	testMessage(t, m, 0, want)
+
+	for _, id := range []string{"", "1@example.com", "<1@example.com", "<@example.com>", "<1@>", "<1@example.com> <2@example.com>", "<1 2@example.com>"} {
+		assert.Error(t, m.SetInReplyTo(id), id)
+		assert.Error(t, m.SetReferences("<1@example.com>", id), id)
+	}
+}
+
+func TestAlternative(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "¡Hola, señor!")
+	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1Hola, se=C3=B1or!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestAddCalendar(t *testing.T) {
+	ics := "BEGIN:VCALENDAR\r\nMETHOD:REQUEST\r\nBEGIN:VEVENT\r\nSUMMARY:Meeting\r\nEND:VEVENT\r\nEND:VCALENDAR"
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Meeting")
+	m.AddAlternative("text/html", "<p>Meeting</p>")
+	assert.NoError(t, m.AddCalendar(ics, "request"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Meeting\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p>Meeting</p>\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/calendar; method=REQUEST; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			ics + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+	testMessage(t, m, 1, want)
+
+	assert.EqualError(t, m.AddCalendar(ics, "CANCEL"), `mailer: iCalendar method "CANCEL" does not match the METHOD property "REQUEST"`)
+	assert.EqualError(t, m.AddCalendar(ics, "REQUEST; x=y"), `mailer: invalid iCalendar method "REQUEST; X=Y"`)
+	assert.EqualError(t, m.AddCalendar(ics, ""), `mailer: invalid iCalendar method ""`)
+	assert.Len(t, m.parts, 3)
+}
+
+func TestPartSetting(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
+	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"¡Hola, señor!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestBodyWriter(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.AddAlternativeWriter("text/plain", func(w io.Writer) error {
+		_, err := w.Write([]byte("Test message"))
+		return err
+	})
+	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
+		_, err := w.Write([]byte("Test HTML"))
+		return err
+	})
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test message\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test HTML\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestSetBodyWriter(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Replaced")
+	m.AddAlternative("text/html", "Replaced")
+	m.SetBodyWriter("text/plain", func(w io.Writer) error {
+		_, err := w.Write([]byte("Test message"))
+		return err
+	}, SetPartEncoding(Base64))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Test message")),
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestSetBodyTemplate(t *testing.T) {
+	tpl := template.Must(template.New("body").Parse("<p>Hi, {{.User.Name}}</p>"))
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Replaced")
+	m.SetBodyTemplate(tpl, map[string]interface{}{
+		"User": struct{ Name string }{"<Testing>"},
+	})
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p>Hi, &lt;Testing&gt;</p>",
+	}
+
+	testMessage(t, m, 0, want)
+
+	m.SetBodyTemplate(tpl, struct{ User *struct{ Name string } }{})
+	_, err := m.WriteTo(io.Discard)
+	assert.True(t, errors.Is(err, ErrExecuteTemplate), fmt.Sprintf("got %v, want ErrExecuteTemplate", err))
+}
+
+func TestAddAlternativeTemplate(t *testing.T) {
+	tpl := template.Must(template.New("body").Parse("<p>Hi, {{.Name}}</p>"))
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Hi, Testing")
+	m.AddAlternativeTemplate("text/html", tpl, struct{ Name string }{"<Testing>"})
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	p, err := ParseMessage(bytes.NewReader(b))
+	assert.NoError(t, err)
+	if assert.Len(t, p.Parts, 2) {
+		assert.Equal(t, "text/html", p.Parts[1].ContentType)
+		assert.Equal(t, "<p>Hi, &lt;Testing&gt;</p>", p.Parts[1].Body)
+	}
+
+	m.SetBody("text/plain", "Hi")
+	m.AddAlternativeTemplate("text/html", tpl, 42)
+	_, err = m.WriteTo(io.Discard)
+	assert.True(t, errors.Is(err, ErrExecuteTemplate), fmt.Sprintf("got %v, want ErrExecuteTemplate", err))
+}
+
+func TestAttachmentOnly(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")),
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestAttachment(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.Attach(mockCopyFile("/tmp/test.pdf"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+}
+
+func TestRename(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	name, copy := mockCopyFile("/tmp/test.pdf")
+	rename := Rename("another.pdf")
+	m.Attach(name, copy, rename)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"another.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"another.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
 }
 
-func TestPartSetting(t *testing.T) {
+func TestContentType(t *testing.T) {
+	for _, settings := range [][]FileSetting{
+		{ContentType("application/pdf"), Rename("report")},
+		{Rename("report"), ContentType("application/pdf")},
+	} {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetBody("text/plain", "Test")
+		name, copy := mockCopyFile("/tmp/test.bin")
+		m.Attach(name, append([]FileSetting{copy}, settings...)...)
+
+		want := &message{
+			from: "from@example.com",
+			to:   []string{"to@example.com"},
+			content: "From: from@example.com\r\n" +
+				"To: to@example.com\r\n" +
+				"Content-Type: multipart/mixed;\r\n" +
+				" boundary=_BOUNDARY_1_\r\n" +
+				"\r\n" +
+				"--_BOUNDARY_1_\r\n" +
+				"Content-Type: text/plain; charset=UTF-8\r\n" +
+				"Content-Transfer-Encoding: quoted-printable\r\n" +
+				"\r\n" +
+				"Test\r\n" +
+				"--_BOUNDARY_1_\r\n" +
+				"Content-Type: application/pdf; name=\"report\"\r\n" +
+				"Content-Disposition: attachment; filename=\"report\"\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				base64.StdEncoding.EncodeToString([]byte("Content of test.bin")) + "\r\n" +
+				"--_BOUNDARY_1_--\r\n",
+		}
+
+		testMessage(t, m, 1, want)
+	}
+}
+
+func TestFileDates(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain; format=flowed", "¡Hola, señor!", SetPartEncoding(Unencoded))
-	m.AddAlternative("text/html", "¡<b>Hola</b>, <i>señor</i>!</h1>")
+	m.SetBody("text/plain", "Test")
+	created := time.Date(2014, 6, 20, 9, 30, 0, 0, time.FixedZone("", 2*3600))
+	name, copy := mockCopyFile("/tmp/test.pdf")
+	m.Attach(name, copy, CreationTime(created), ModTime(now()))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/plain; format=flowed; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: 8bit\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"¡Hola, señor!\r\n" +
+			"Test\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"; " +
+			"creation-date=\"Fri, 20 Jun 2014 09:30:00 +0200\"; " +
+			"modification-date=\"Wed, 25 Jun 2014 17:46:00 +0000\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			"=C2=A1<b>Hola</b>, <i>se=C3=B1or</i>!</h1>\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
 }
 
-func TestBodyWriter(t *testing.T) {
+func TestAttachmentUnicodeFilename(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.AddAlternativeWriter("text/plain", func(w io.Writer) error {
-		_, err := w.Write([]byte("Test message"))
-		return err
-	})
-	m.AddAlternativeWriter("text/html", func(w io.Writer) error {
-		_, err := w.Write([]byte("Test HTML"))
-		return err
-	})
+	m.SetBody("text/plain", "Test")
+	m.AttachBytes("rapport financier é.pdf", []byte("Content"))
+	m.AttachBytes(`say "hi".txt`, []byte("Content"))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
-			"Content-Type: multipart/alternative;\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: text/plain; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"Test message\r\n" +
+			"Test\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/html; charset=UTF-8\r\n" +
-			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"Content-Type: application/pdf; name=\"rapport financier e.pdf\"; name*=UTF-8''rapport%20financier%20%C3%A9.pdf\r\n" +
+			"Content-Disposition: attachment; filename=\"rapport financier e.pdf\"; filename*=UTF-8''rapport%20financier%20%C3%A9.pdf\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			"Test HTML\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=utf-8; name=\"say \\\"hi\\\".txt\"\r\n" +
+			"Content-Disposition: attachment; filename=\"say \\\"hi\\\".txt\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
 }
 
-func TestAttachmentOnly(t *testing.T) {
+func TestFileParam(t *testing.T) {
+	assert.Equal(t, `filename="report.pdf"`, fileParam("filename", "report.pdf"))
+	assert.Equal(t, `filename="__.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC.txt`, fileParam("filename", "日本.txt"))
+	assert.Equal(t, `filename="Resume de la reunion de l'equipe technique.pdf";`+
+		` filename*0*=UTF-8''R%C3%A9sum%C3%A9%20de%20la%20r%C3%A9union%20de%20l;`+
+		` filename*1*=%27%C3%A9quipe%20technique.pdf`,
+		fileParam("filename", "Résumé de la réunion de l'équipe technique.pdf"))
+}
+
+func TestEnvelope(t *testing.T) {
+	m := NewMessage()
+	m.SetAddressHeader("From", "from@example.com", "Sender")
+	m.SetHeader("To", "to@example.com", "Other <cc@example.com>")
+	m.SetHeader("Cc", "cc@example.com")
+	m.Bcc("bcc@example.com")
+
+	from, err := m.EnvelopeFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "from@example.com", from)
+	to, err := m.Recipients()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"to@example.com", "cc@example.com", "bcc@example.com"}, to)
+
+	m.SetHeader("Return-Path", "bounces@example.com")
+	from, err = m.EnvelopeFrom()
+	assert.NoError(t, err)
+	assert.Equal(t, "bounces@example.com", from)
+}
+
+func TestPreloadFile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "logo.png")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("Content of logo.png"), 0o600))
+
+	logo, err := PreloadFile(filename)
+	assert.NoError(t, err)
+	// The file is not opened again when the messages are written.
+	assert.NoError(t, os.Remove(filename))
+
+	for i := 0; i < 2; i++ {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.Embed(filename, logo)
+
+		want := &message{
+			from: "from@example.com",
+			to:   []string{"to@example.com"},
+			content: "From: from@example.com\r\n" +
+				"To: to@example.com\r\n" +
+				"Content-Type: image/png; name=\"logo.png\"\r\n" +
+				"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+				"Content-ID: <logo.png>\r\n" +
+				"Content-Transfer-Encoding: base64\r\n" +
+				"\r\n" +
+				base64.StdEncoding.EncodeToString([]byte("Content of logo.png")),
+		}
+		testMessage(t, m, 0, want)
+	}
+
+	_, err = PreloadFile(filename)
+	assert.Error(t, err)
+}
+
+func TestAttachmentsOnly(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
 	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	m.Attach(mockCopyFile("/tmp/test.zip"))
 
 	want := &message{
 		from: "from@example.com",
 		to:   []string{"to@example.com"},
 		content: "From: from@example.com\r\n" +
 			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
 			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
 			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")),
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/zip; name=\"test.zip\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.zip\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.zip")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
 	}
 
-	testMessage(t, m, 0, want)
+	testMessage(t, m, 1, want)
 }
 
-func TestAttachment(t *testing.T) {
+func TestAttachments(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
 	m.SetBody("text/plain", "Test")
 	m.Attach(mockCopyFile("/tmp/test.pdf"))
+	m.Attach(mockCopyFile("/tmp/test.zip"))
 
 	want := &message{
 		from: "from@example.com",
@@ -282,20 +1741,37 @@ func TestAttachment(t *testing.T) {
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
 			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/zip; name=\"test.zip\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.zip\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.zip")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
 }
 
-func TestRename(t *testing.T) {
+type mockReadCloser struct {
+	io.Reader
+	closed bool
+}
+
+func (r *mockReadCloser) Close() error {
+	r.closed = true
+	return nil
+}
+
+func TestAttachReader(t *testing.T) {
+	r := &mockReadCloser{Reader: strings.NewReader("Content of report.pdf")}
+
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
 	m.SetBody("text/plain", "Test")
-	name, copy := mockCopyFile("/tmp/test.pdf")
-	rename := Rename("another.pdf")
-	m.Attach(name, copy, rename)
+	m.AttachReader("report.pdf", r)
+	assert.False(t, r.closed, "reader should be consumed lazily")
 
 	want := &message{
 		from: "from@example.com",
@@ -311,23 +1787,49 @@ func TestRename(t *testing.T) {
 			"\r\n" +
 			"Test\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/pdf; name=\"another.pdf\"\r\n" +
-			"Content-Disposition: attachment; filename=\"another.pdf\"\r\n" +
+			"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of report.pdf")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
 	testMessage(t, m, 1, want)
+	assert.True(t, r.closed, "reader should be closed after copying")
 }
 
-func TestAttachmentsOnly(t *testing.T) {
+func TestEmbedReader(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.Attach(mockCopyFile("/tmp/test.pdf"))
-	m.Attach(mockCopyFile("/tmp/test.zip"))
+	m.EmbedReader("image.jpg", strings.NewReader("Content of image.jpg"))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <image.jpg>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")),
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestAttachBytes(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/html", `<img src="cid:logo">`)
+	m.AttachBytes("report.pdf", []byte("Content of report.pdf"))
+	m.EmbedBytes("logo", []byte("Content of logo"), SetHeader(map[string][]string{
+		"Content-Type": {"image/png"},
+	}))
 
 	want := &message{
 		from: "from@example.com",
@@ -338,30 +1840,50 @@ func TestAttachmentsOnly(t *testing.T) {
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
-			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:logo\">\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: image/png\r\n" +
+			"Content-Disposition: inline; filename=\"logo\"\r\n" +
+			"Content-ID: <logo>\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of logo")) + "\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/zip; name=\"test.zip\"\r\n" +
-			"Content-Disposition: attachment; filename=\"test.zip\"\r\n" +
+			"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.zip")) + "\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of report.pdf")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
-	testMessage(t, m, 1, want)
+	// The content can be written more than once.
+	testMessage(t, m, 2, want)
+	testMessage(t, m, 2, want)
 }
 
-func TestAttachments(t *testing.T) {
+func TestAttachFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"docs/report.pdf": {Data: []byte("Content of report.pdf")},
+		"img/logo.png":    {Data: []byte("Content of logo.png")},
+		"example.html":    {Data: []byte("Hi, {{.Name}} <img src=\"cid:logo.png\">")},
+	}
+
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
 	m.SetHeader("To", "to@example.com")
-	m.SetBody("text/plain", "Test")
-	m.Attach(mockCopyFile("/tmp/test.pdf"))
-	m.Attach(mockCopyFile("/tmp/test.zip"))
+	m.SetBody("text/html", ParseTemplateFS(fsys, "example.html", struct{ Name string }{"Testing"}))
+	m.AttachFS(fsys, "docs/report.pdf")
+	m.EmbedFS(fsys, "img/logo.png")
 
 	want := &message{
 		from: "from@example.com",
@@ -372,26 +1894,33 @@ func TestAttachments(t *testing.T) {
 			" boundary=_BOUNDARY_1_\r\n" +
 			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
 			"Content-Transfer-Encoding: quoted-printable\r\n" +
 			"\r\n" +
-			"Test\r\n" +
-			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
-			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Hi, Testing <img src=3D\"cid:logo.png\">\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: image/png; name=\"logo.png\"\r\n" +
+			"Content-Disposition: inline; filename=\"logo.png\"\r\n" +
+			"Content-ID: <logo.png>\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of logo.png")) + "\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
 			"--_BOUNDARY_1_\r\n" +
-			"Content-Type: application/zip; name=\"test.zip\"\r\n" +
-			"Content-Disposition: attachment; filename=\"test.zip\"\r\n" +
+			"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
 			"Content-Transfer-Encoding: base64\r\n" +
 			"\r\n" +
-			base64.StdEncoding.EncodeToString([]byte("Content of test.zip")) + "\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of report.pdf")) + "\r\n" +
 			"--_BOUNDARY_1_--\r\n",
 	}
 
-	testMessage(t, m, 1, want)
+	testMessage(t, m, 2, want)
 }
 
 func TestEmbedded(t *testing.T) {
@@ -435,6 +1964,84 @@ func TestEmbedded(t *testing.T) {
 	testMessage(t, m, 1, want)
 }
 
+func TestEmbedImage(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	cid1, err := m.EmbedImage(strings.NewReader("Image"), "logo.png")
+	assert.NoError(t, err)
+	cid2, err := m.EmbedImage(strings.NewReader("Image"), "logo.png")
+	assert.NoError(t, err)
+	assert.NotEqual(t, cid1, cid2)
+	assert.True(t, strings.HasSuffix(cid1, "@example.com"), cid1)
+	m.SetBody("text/html", `<img src="cid:`+cid1+`">`)
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+	p, err := ParseMessage(bytes.NewReader(b))
+	assert.NoError(t, err)
+	if assert.Len(t, p.Parts, 3) {
+		assert.Equal(t, "<"+cid1+">", firstValue(p.Parts[1].Header, "Content-Id"))
+		assert.True(t, strings.HasPrefix(firstValue(p.Parts[1].Header, "Content-Type"), "image/png"))
+		assert.Equal(t, "<"+cid2+">", firstValue(p.Parts[2].Header, "Content-Id"))
+	}
+
+	_, err = NewMessage(AutoMessageID("mail.example.org")).EmbedImage(strings.NewReader("Image"), "logo.jpg")
+	assert.NoError(t, err)
+
+	_, err = m.EmbedImage(strings.NewReader("Text"), "notes.txt")
+	assert.EqualError(t, err, `mailer: "notes.txt" does not have the extension of an image`)
+}
+
+func TestContentID(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	name, copy := mockCopyFile("image.jpg")
+	m.Embed(name, copy, ContentID("logo"))
+	name, copy = mockCopyFile("doc.pdf")
+	m.Attach(name, copy, ContentID("<doc@example.com>"))
+	m.SetBody("text/html", `<img src="cid:logo">`)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:logo\">\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <logo>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"doc.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"doc.pdf\"\r\n" +
+			"Content-ID: <doc@example.com>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of doc.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 2, want)
+}
+
 func TestFullMessage(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
@@ -509,6 +2116,58 @@ func TestFullMessage(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+type peakMemoryWriter struct {
+	n, next  int64
+	baseline uint64
+	peak     uint64
+}
+
+func (w *peakMemoryWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	if w.n >= w.next {
+		w.next += 8 << 20
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		if stats.HeapInuse > w.peak {
+			w.peak = stats.HeapInuse
+		}
+	}
+	return len(p), nil
+}
+
+func TestLargeAttachmentStreaming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping large attachment test in short mode")
+	}
+
+	const size = 200 << 20
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	m.AttachReader("large.bin", io.LimitReader(zeroReader{}, size))
+
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	w := &peakMemoryWriter{baseline: stats.HeapInuse, peak: stats.HeapInuse}
+
+	n, err := m.WriteTo(w)
+	assert.NoError(t, err)
+	assert.Equal(t, n, w.n)
+	assert.True(t, n > size*4/3, "the whole attachment should be written")
+	assert.True(t, w.peak-w.baseline < 16<<20, fmt.Sprintf("memory usage should be bounded, got %d bytes", w.peak-w.baseline))
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
 func TestQpLineLength(t *testing.T) {
 	m := NewMessage()
 	m.SetHeader("From", "from@example.com")
@@ -562,6 +2221,44 @@ func TestBase64LineLength(t *testing.T) {
 	testMessage(t, m, 0, want)
 }
 
+func TestBase64LineWriter(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	for _, size := range []int{1, 7, 76, 77, 1000} {
+		buf := new(bytes.Buffer)
+		w := newBase64LineWriter(buf)
+		for p := data; len(p) > 0; {
+			k := size
+			if k > len(p) {
+				k = len(p)
+			}
+			n, err := w.Write(p[:k])
+			assert.NoError(t, err)
+			assert.Equal(t, k, n)
+			p = p[k:]
+		}
+
+		lines := strings.Split(buf.String(), "\r\n")
+		assert.Len(t, lines, 14)
+		for _, line := range lines[:13] {
+			assert.Len(t, line, 76)
+		}
+		assert.Equal(t, string(data), strings.Join(lines, ""))
+	}
+
+	errWrite := errors.New("write error")
+	w := newBase64LineWriter(errorWriter{errWrite})
+	_, err := w.Write(data)
+	assert.Equal(t, errWrite, err)
+}
+
+type errorWriter struct {
+	err error
+}
+
+func (w errorWriter) Write([]byte) (int, error) {
+	return 0, w.err
+}
+
 func TestEmptyName(t *testing.T) {
 	m := NewMessage()
 	m.SetAddressHeader("From", "from@example.com", "")
@@ -731,3 +2428,62 @@ func BenchmarkFull(b *testing.B) {
 		m.Reset()
 	}
 }
+
+// unbufferedBase64LineWriter is the previous implementation of
+// base64LineWriter, kept to compare their performance.
+type unbufferedBase64LineWriter struct {
+	w       io.Writer
+	lineLen int
+}
+
+func (w *unbufferedBase64LineWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p)+w.lineLen > maxLineLen {
+		w.w.Write(p[:maxLineLen-w.lineLen])
+		w.w.Write([]byte("\r\n"))
+		p = p[maxLineLen-w.lineLen:]
+		n += maxLineLen - w.lineLen
+		w.lineLen = 0
+	}
+
+	w.w.Write(p)
+	w.lineLen += len(p)
+
+	return n + len(p), nil
+}
+
+// callWriter discards the data written, the cost of a real writer being
+// mostly per call.
+type callWriter struct {
+	calls int
+}
+
+func (w *callWriter) Write(p []byte) (int, error) {
+	w.calls++
+	return len(p), nil
+}
+
+func BenchmarkBase64LineWriter(b *testing.B) {
+	payload := make([]byte, 50<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+
+	writers := []struct {
+		name string
+		new  func(io.Writer) io.Writer
+	}{
+		{"unbuffered", func(w io.Writer) io.Writer { return &unbufferedBase64LineWriter{w: w} }},
+		{"buffered", func(w io.Writer) io.Writer { return newBase64LineWriter(w) }},
+	}
+	for _, bw := range writers {
+		b.Run(bw.name, func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for n := 0; n < b.N; n++ {
+				cw := &callWriter{}
+				enc := base64.NewEncoder(base64.StdEncoding, bw.new(cw))
+				enc.Write(payload)
+				enc.Close()
+				b.ReportMetric(float64(cw.calls), "writes/op")
+			}
+		})
+	}
+}
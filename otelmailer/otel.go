@@ -0,0 +1,198 @@
+// Package otelmailer traces the emails sent with mailer using OpenTelemetry.
+// It is a separate module so the mailer package does not depend on
+// OpenTelemetry.
+package otelmailer
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/butbetter-id/mailer"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const spanName = "mailer.Send"
+
+type (
+	// A ContextSender is a Sender whose SendContext method starts the span of
+	// the email as a child of the span of ctx, if any. Send uses
+	// context.Background. Like the Senders of mailer wrapping another one,
+	// Close closes the wrapped Sender, if any.
+	ContextSender interface {
+		mailer.SendCloser
+		SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error
+	}
+
+	tracedSender struct {
+		s      mailer.Sender
+		tracer trace.Tracer
+	}
+
+	tracedDialer struct {
+		d      *mailer.Dialer
+		tracer trace.Tracer
+	}
+
+	// countingWriterTo counts the bytes written by msg.
+	countingWriterTo struct {
+		msg io.WriterTo
+		n   int64
+	}
+)
+
+// TracedSender returns a Sender sending emails with s and starting a span
+// around each Send with tracer. The span records the number of recipients,
+// the size of the email and the error returned by s, if any. The size is not
+// recorded for a *mailer.Message, which is passed to s as is so s can still
+// read its headers, use TracedDialer to record it when sending with a Dialer.
+func TracedSender(s mailer.Sender, tracer trace.Tracer) ContextSender {
+	return &tracedSender{s: s, tracer: tracer}
+}
+
+func (t *tracedSender) Send(from string, to []string, msg io.WriterTo) error {
+	return t.SendContext(context.Background(), from, to, msg)
+}
+
+func (t *tracedSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	_, span := start(ctx, t.tracer, to)
+	defer span.End()
+
+	if _, ok := msg.(*mailer.Message); !ok {
+		c := &countingWriterTo{msg: msg}
+		defer func() { span.SetAttributes(attribute.Int64("mailer.message.size", c.n)) }()
+		msg = c
+	}
+
+	err := t.s.Send(from, to, msg)
+	setStatus(span, err)
+	return err
+}
+
+// Close closes s if it is a SendCloser.
+func (t *tracedSender) Close() error {
+	if c, ok := t.s.(mailer.SendCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// TracedDialer returns a Sender sending each email like d.DialAndSend, on a
+// new connection, inside a span started with tracer. In addition to what
+// TracedSender records, span events are added for the connection, the
+// authentication, the MAIL and RCPT commands and the DATA phase, with their
+// duration. The Hooks of d are still called. With SendContext, the connection
+// is also aborted when ctx is done, like with Dialer.DialContext.
+func TracedDialer(d *mailer.Dialer, tracer trace.Tracer) ContextSender {
+	return &tracedDialer{d: d, tracer: tracer}
+}
+
+func (t *tracedDialer) Send(from string, to []string, msg io.WriterTo) error {
+	return t.SendContext(context.Background(), from, to, msg)
+}
+
+func (t *tracedDialer) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	ctx, span := start(ctx, t.tracer, to)
+	defer span.End()
+
+	// The Dialer is copied so the hooks recording the events of this span are
+	// not shared with the other emails sent concurrently.
+	d := *t.d
+	d.Hooks = spanHooks(span, t.d.Hooks)
+
+	err := send(ctx, &d, from, to, msg)
+	setStatus(span, err)
+	return err
+}
+
+// Close does nothing, each email being sent on its own connection.
+func (t *tracedDialer) Close() error {
+	return nil
+}
+
+func send(ctx context.Context, d *mailer.Dialer, from string, to []string, msg io.WriterTo) error {
+	s, err := d.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	if err := s.Send(from, to, msg); err != nil {
+		s.Close()
+		return err
+	}
+	return s.Close()
+}
+
+// spanHooks returns the Hooks adding the events of an SMTP session to span and
+// calling next.
+func spanHooks(span trace.Span, next *mailer.Hooks) *mailer.Hooks {
+	if next == nil {
+		next = &mailer.Hooks{}
+	}
+
+	event := func(name string, d time.Duration, err error, attrs ...attribute.KeyValue) {
+		attrs = append(attrs, attribute.Int64("mailer.duration_ms", d.Milliseconds()))
+		if err != nil {
+			attrs = append(attrs, attribute.String("mailer.error", err.Error()))
+		}
+		span.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+
+	return &mailer.Hooks{
+		OnConnect: func(addr string, d time.Duration, err error) {
+			event("connect", d, err, attribute.String("server.address", addr))
+			if next.OnConnect != nil {
+				next.OnConnect(addr, d, err)
+			}
+		},
+		OnAuth: func(username string, d time.Duration, err error) {
+			event("auth", d, err)
+			if next.OnAuth != nil {
+				next.OnAuth(username, d, err)
+			}
+		},
+		OnMailFrom: func(from string, d time.Duration, err error) {
+			event("mail", d, err)
+			if next.OnMailFrom != nil {
+				next.OnMailFrom(from, d, err)
+			}
+		},
+		OnRcptTo: func(to string, d time.Duration, err error) {
+			event("rcpt", d, err)
+			if next.OnRcptTo != nil {
+				next.OnRcptTo(to, d, err)
+			}
+		},
+		OnData: func(size int64, d time.Duration, err error) {
+			event("data", d, err, attribute.Int64("mailer.message.size", size))
+			span.SetAttributes(attribute.Int64("mailer.message.size", size))
+			if next.OnData != nil {
+				next.OnData(size, d, err)
+			}
+		},
+		OnError: next.OnError,
+	}
+}
+
+func start(ctx context.Context, tracer trace.Tracer, to []string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, spanName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.Int("mailer.recipients", len(to))),
+	)
+}
+
+func setStatus(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	span.SetStatus(codes.Ok, "")
+}
+
+func (c *countingWriterTo) WriteTo(w io.Writer) (int64, error) {
+	n, err := c.msg.WriteTo(w)
+	c.n += n
+	return n, err
+}
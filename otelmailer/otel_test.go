@@ -0,0 +1,117 @@
+package otelmailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/butbetter-id/mailer"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracedSender(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+
+	mem := &mailer.MemorySender{}
+	s := TracedSender(mem, tracer)
+	msg := strings.NewReader("Subject: Test\r\n\r\nTest")
+	assert.NoError(t, s.Send("from@example.com", []string{"to1@example.com", "to2@example.com"}, writerTo{msg}))
+
+	failing := TracedSender(mailer.SendFunc(func(string, []string, io.WriterTo) error {
+		return errors.New("550 rejected")
+	}), tracer)
+	assert.EqualError(t, failing.Send("from@example.com", []string{"to@example.com"}, writerTo{strings.NewReader("")}), "550 rejected")
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, spanName, spans[0].Name())
+		assert.Equal(t, codes.Ok, spans[0].Status().Code)
+		assert.Contains(t, spans[0].Attributes(), attribute.Int("mailer.recipients", 2))
+		assert.Contains(t, spans[0].Attributes(), attribute.Int64("mailer.message.size", 21))
+
+		assert.Equal(t, codes.Error, spans[1].Status().Code)
+		assert.Equal(t, "550 rejected", spans[1].Status().Description)
+		assert.Contains(t, spans[1].Attributes(), attribute.Int("mailer.recipients", 1))
+	}
+	assert.Len(t, mem.Messages(), 1)
+}
+
+func TestTracedSenderMessage(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+
+	m := mailer.NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	r := strings.NewReader("Test")
+	m.SetBodyWriter("text/plain", func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+
+	ctx, parent := tracer.Start(context.Background(), "parent")
+	mem := &mailer.MemorySender{}
+	s := TracedSender(mem, tracer)
+	assert.NoError(t, s.SendContext(ctx, "from@example.com", []string{"to@example.com"}, m))
+	parent.End()
+
+	spans := sr.Ended()
+	if assert.Len(t, spans, 2) {
+		assert.Equal(t, spanName, spans[0].Name())
+		assert.Equal(t, parent.SpanContext().SpanID(), spans[0].Parent().SpanID())
+		for _, attr := range spans[0].Attributes() {
+			assert.NotEqual(t, attribute.Key("mailer.message.size"), attr.Key)
+		}
+	}
+
+	// The content read only once is left for the wrapped Sender.
+	if assert.Len(t, mem.Messages(), 1) {
+		assert.Contains(t, string(mem.Messages()[0].Data), "\r\n\r\nTest")
+	}
+}
+
+func TestSpanHooks(t *testing.T) {
+	sr := tracetest.NewSpanRecorder()
+	tracer := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("test")
+
+	var rcpts []string
+	_, span := tracer.Start(context.Background(), spanName)
+	h := spanHooks(span, &mailer.Hooks{
+		OnRcptTo: func(to string, d time.Duration, err error) { rcpts = append(rcpts, to) },
+	})
+	h.OnConnect("mail.example.com:587", time.Millisecond, nil)
+	h.OnAuth("user", time.Millisecond, nil)
+	h.OnMailFrom("from@example.com", time.Millisecond, nil)
+	h.OnRcptTo("to@example.com", time.Millisecond, errors.New("550 rejected"))
+	h.OnData(42, 3*time.Millisecond, nil)
+	span.End()
+
+	assert.Equal(t, []string{"to@example.com"}, rcpts)
+	spans := sr.Ended()
+	if assert.Len(t, spans, 1) {
+		var names []string
+		for _, e := range spans[0].Events() {
+			names = append(names, e.Name)
+		}
+		assert.Equal(t, []string{"connect", "auth", "mail", "rcpt", "data"}, names)
+		assert.Contains(t, spans[0].Events()[3].Attributes, attribute.String("mailer.error", "550 rejected"))
+		assert.Contains(t, spans[0].Events()[4].Attributes, attribute.Int64("mailer.duration_ms", 3))
+		assert.Contains(t, spans[0].Attributes(), attribute.Int64("mailer.message.size", 42))
+	}
+}
+
+type writerTo struct {
+	r io.Reader
+}
+
+func (w writerTo) WriteTo(dst io.Writer) (int64, error) {
+	return io.Copy(dst, w.r)
+}
@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"strings"
+)
+
+type (
+	// A ParsedMessage is a decoded email returned by ParseMessage.
+	ParsedMessage struct {
+		// Header holds the header fields of the email, with the RFC 2047
+		// encoded-words decoded.
+		Header map[string][]string
+		// Parts holds the leaf parts of the email in the order they appear,
+		// multipart entities being flattened. An email which is not multipart
+		// has a single part.
+		Parts []ParsedPart
+	}
+
+	// A ParsedPart is a decoded leaf part of a ParsedMessage.
+	ParsedPart struct {
+		// Header holds the MIME header fields of the part. For an email which
+		// is not multipart they are the "Content-" fields of the email.
+		Header map[string][]string
+		// ContentType is the media type of the part, without its parameters.
+		ContentType string
+		// Body is the content of the part decoded from its
+		// Content-Transfer-Encoding.
+		Body string
+	}
+)
+
+// ParseMessage reads an email, such as the output of Message.WriteTo, and
+// decodes its headers and parts. It is mainly meant to check rendered emails
+// in tests.
+func ParseMessage(r io.Reader) (*ParsedMessage, error) {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: could not parse email: %v", err)
+	}
+
+	p := &ParsedMessage{Header: make(map[string][]string, len(msg.Header))}
+	content := make(map[string][]string)
+	for k, v := range msg.Header {
+		decoded := make([]string, len(v))
+		for i, s := range v {
+			decoded[i] = decodeHeader(s)
+		}
+		p.Header[k] = decoded
+		if strings.HasPrefix(k, "Content-") {
+			content[k] = v
+		}
+	}
+
+	if err := p.addParts(content, msg.Body); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// addParts adds the leaf parts of the entity with the header h and the body r.
+func (p *ParsedMessage) addParts(h map[string][]string, r io.Reader) error {
+	mediaType := "text/plain"
+	var params map[string]string
+	if ct := firstValue(h, "Content-Type"); ct != "" {
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return fmt.Errorf("mailer: invalid Content-Type %q: %v", ct, err)
+		}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(r, params["boundary"])
+		for {
+			part, err := mr.NextRawPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("mailer: could not parse %s part: %v", mediaType, err)
+			}
+			if err := p.addParts(part.Header, part); err != nil {
+				return err
+			}
+		}
+	}
+
+	var dec io.Reader
+	switch strings.ToLower(firstValue(h, "Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		dec = quotedprintable.NewReader(r)
+	case "base64":
+		dec = base64.NewDecoder(base64.StdEncoding, r)
+	default:
+		dec = r
+	}
+	body, err := ioutil.ReadAll(dec)
+	if err != nil {
+		return fmt.Errorf("mailer: could not decode %s part: %v", mediaType, err)
+	}
+
+	p.Parts = append(p.Parts, ParsedPart{
+		Header:      h,
+		ContentType: mediaType,
+		Body:        string(body),
+	})
+	return nil
+}
+
+func firstValue(h map[string][]string, field string) string {
+	if v := h[field]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
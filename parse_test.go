@@ -0,0 +1,70 @@
+package mailer
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseMessage(t *testing.T) {
+	text := "Trailing spaces   \nTrailing tab\t\na=3D b==c =\n" + strings.Repeat("long line ", 20) + "\nCafé"
+	html := "<p style=\"color: red\">Olá</p>"
+	attachment := []byte{0, 1, 2, 0xff, '\r', '\n'}
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Subject", "¡Hola, señor!")
+	m.SetBody("text/plain", text)
+	m.AddAlternative("text/html", html)
+	m.EmbedBytes("image.jpg", []byte("Image"))
+	m.AttachBytes("data.bin", attachment)
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+
+	p, err := ParseMessage(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"¡Hola, señor!"}, p.Header["Subject"])
+	assert.Equal(t, []string{"to@example.com"}, p.Header["To"])
+
+	if assert.Len(t, p.Parts, 4) {
+		assert.Equal(t, "text/plain", p.Parts[0].ContentType)
+		assert.Equal(t, strings.Replace(text, "\n", "\r\n", -1), p.Parts[0].Body)
+		assert.Equal(t, "text/html", p.Parts[1].ContentType)
+		assert.Equal(t, html, p.Parts[1].Body)
+		assert.Equal(t, "image/jpeg", p.Parts[2].ContentType)
+		assert.Equal(t, "Image", p.Parts[2].Body)
+		assert.Equal(t, []string{"<image.jpg>"}, p.Parts[2].Header["Content-Id"])
+		assert.Equal(t, "application/octet-stream", p.Parts[3].ContentType)
+		assert.Equal(t, string(attachment), p.Parts[3].Body)
+	}
+}
+
+func TestParseMessageSinglePart(t *testing.T) {
+	m := NewMessage(SetEncoding(Base64))
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test message")
+
+	b, err := m.Render()
+	assert.NoError(t, err)
+
+	p, err := ParseMessage(bytes.NewReader(b))
+	assert.NoError(t, err)
+	assert.Equal(t, []ParsedPart{{
+		Header: map[string][]string{
+			"Content-Type":              {"text/plain; charset=UTF-8"},
+			"Content-Transfer-Encoding": {"base64"},
+		},
+		ContentType: "text/plain",
+		Body:        "Test message",
+	}}, p.Parts)
+}
+
+func TestParseMessageError(t *testing.T) {
+	_, err := ParseMessage(strings.NewReader("Content-Type: multipart/mixed; boundary=\"\r\n\r\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,207 @@
+package mailer
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"strings"
+)
+
+// blockTags are the HTML elements rendered on their own lines in plain text.
+var blockTags = map[string]bool{
+	"address": true, "article": true, "blockquote": true, "br": true,
+	"div": true, "dl": true, "dt": true, "dd": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "ol": true, "p": true, "pre": true,
+	"section": true, "table": true, "tr": true, "ul": true,
+}
+
+// addPlainTextPart inserts a plain text part derived from the HTML part
+// before it if the HTML part is the only part.
+func addPlainTextPart(parts []*part) []*part {
+	if len(parts) != 1 || !strings.HasPrefix(parts[0].contentType, "text/html") {
+		return parts
+	}
+
+	h := parts[0]
+	plain := &part{
+		contentType: "text/plain",
+		encoding:    h.encoding,
+		encodingSet: h.encodingSet,
+		copier: func(w io.Writer) error {
+			buf := new(bytes.Buffer)
+			if err := h.copier(buf); err != nil {
+				return err
+			}
+			_, err := io.WriteString(w, htmlToText(buf.String()))
+			return err
+		},
+	}
+
+	return []*part{plain, h}
+}
+
+// htmlToText returns a rudimentary plain text version of an HTML document.
+// Tags are stripped, entities decoded, whitespace collapsed and link URLs are
+// kept in parentheses after the link text.
+func htmlToText(s string) string {
+	var b strings.Builder
+	var href string
+	var linkStart int
+	skip := ""
+
+	for len(s) > 0 {
+		i := strings.IndexByte(s, '<')
+		if i == -1 {
+			i = len(s)
+		}
+		if skip == "" {
+			writeText(&b, html.UnescapeString(s[:i]))
+		}
+		s = s[i:]
+		if s == "" {
+			break
+		}
+
+		if strings.HasPrefix(s, "<!--") {
+			end := strings.Index(s, "-->")
+			if end == -1 {
+				break
+			}
+			s = s[end+3:]
+			continue
+		}
+
+		end := strings.IndexByte(s, '>')
+		if end == -1 {
+			break
+		}
+		tag := s[1:end]
+		s = s[end+1:]
+
+		name, closing := tagName(tag)
+		switch {
+		case skip != "":
+			if closing && name == skip {
+				skip = ""
+			}
+		case name == "script" || name == "style" || name == "head" || name == "title":
+			if !closing {
+				skip = name
+			}
+		case name == "a" && !closing:
+			href = attribute(tag, "href")
+			linkStart = b.Len()
+		case name == "a" && closing:
+			text := strings.TrimSpace(b.String()[linkStart:])
+			if href != "" && text != href && !strings.HasPrefix(href, "#") {
+				b.WriteString(" (" + strings.TrimPrefix(href, "mailto:") + ")")
+			}
+			href = ""
+		case name == "li":
+			if !closing {
+				b.WriteString("\n- ")
+			}
+		case blockTags[name]:
+			b.WriteByte('\n')
+			if name == "p" || strings.HasPrefix(name, "h") && len(name) == 2 {
+				b.WriteByte('\n')
+			}
+		case name == "td" || name == "th":
+			b.WriteByte(' ')
+		}
+	}
+
+	return collapseLines(b.String())
+}
+
+// writeText writes text to b with its whitespace collapsed.
+func writeText(b *strings.Builder, text string) {
+	fields := strings.Fields(text)
+	if len(fields) == 0 {
+		if text != "" {
+			b.WriteByte(' ')
+		}
+		return
+	}
+	if text[0] == ' ' || text[0] == '\t' || text[0] == '\n' || text[0] == '\r' {
+		b.WriteByte(' ')
+	}
+	b.WriteString(strings.Join(fields, " "))
+	if last := text[len(text)-1]; last == ' ' || last == '\t' || last == '\n' || last == '\r' {
+		b.WriteByte(' ')
+	}
+}
+
+// collapseLines trims the lines of s and removes consecutive blank lines.
+func collapseLines(s string) string {
+	lines := strings.Split(s, "\n")
+	out := lines[:0]
+	blank := true
+	for _, line := range lines {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			if !blank {
+				out = append(out, "")
+			}
+			blank = true
+			continue
+		}
+		out = append(out, line)
+		blank = false
+	}
+
+	return strings.TrimSpace(strings.Join(out, "\r\n"))
+}
+
+// tagName returns the lowercase name of an HTML tag and whether it is a
+// closing tag, tag is the content between the angle brackets.
+func tagName(tag string) (string, bool) {
+	closing := strings.HasPrefix(tag, "/")
+	tag = strings.TrimPrefix(tag, "/")
+	end := strings.IndexAny(tag, " \t\r\n/")
+	if end != -1 {
+		tag = tag[:end]
+	}
+	return strings.ToLower(tag), closing
+}
+
+// attribute returns the decoded value of the attribute name of an HTML tag.
+func attribute(tag, name string) string {
+	lower := strings.ToLower(tag)
+	for i := 0; ; {
+		j := strings.Index(lower[i:], name)
+		if j == -1 {
+			return ""
+		}
+		i += j + len(name)
+		if c := lower[i-len(name)-1]; c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			continue
+		}
+
+		rest := strings.TrimLeft(tag[i:], " \t\r\n")
+		if !strings.HasPrefix(rest, "=") {
+			continue
+		}
+		rest = strings.TrimLeft(rest[1:], " \t\r\n")
+		if rest == "" {
+			return ""
+		}
+
+		var value string
+		if q := rest[0]; q == '"' || q == '\'' {
+			end := strings.IndexByte(rest[1:], q)
+			if end == -1 {
+				return ""
+			}
+			value = rest[1 : end+1]
+		} else {
+			end := strings.IndexAny(rest, " \t\r\n>")
+			if end == -1 {
+				end = len(rest)
+			}
+			value = rest[:end]
+		}
+		return html.UnescapeString(value)
+	}
+}
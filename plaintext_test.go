@@ -0,0 +1,66 @@
+package mailer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTMLToText(t *testing.T) {
+	tests := []struct {
+		html, want string
+	}{
+		{"Hello <b>Bob</b> &amp; <i>Cora</i>!", "Hello Bob & Cora!"},
+		{"<p>First   paragraph\n  on two lines</p><p>Second</p>", "First paragraph on two lines\r\n\r\nSecond"},
+		{`Go to <a href="https://example.com/?a=1&amp;b=2">our site</a>.`, "Go to our site (https://example.com/?a=1&b=2)."},
+		{`<a href='https://example.com'>https://example.com</a>`, "https://example.com"},
+		{`Mail <a class="x" href=mailto:bob@example.com>Bob</a>`, "Mail Bob (bob@example.com)"},
+		{"<html><head><title>T</title><style>p { color: red; }</style></head><body>Hi<br>there</body></html>", "Hi\r\nthere"},
+		{"<ul><li>One</li><li>Two</li></ul><!-- comment -->", "- One\r\n- Two"},
+		{"<h1>Title</h1><script>alert('x')</script><div>Body&nbsp;text</div>", "Title\r\n\r\nBody text"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.want, htmlToText(test.html), test.html)
+	}
+}
+
+func TestAutoPlainText(t *testing.T) {
+	m := NewMessage(AutoPlainText())
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.Body(`<p>Hello <a href="https://example.com">Bob</a>!</p>`, true)
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Hello Bob (https://example.com)!\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<p>Hello <a href=3D\"https://example.com\">Bob</a>!</p>\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 1, want)
+
+	// Messages with a plain text part are left untouched.
+	m.SetBody("text/plain", "Hello Bob!")
+	m.AddAlternative("text/html", "<p>Hello Bob!</p>")
+	assert.Len(t, m.writtenParts(), 2)
+
+	// It is opt-in.
+	m = NewMessage()
+	m.Body("<p>Hello Bob!</p>", true)
+	assert.Len(t, m.writtenParts(), 1)
+}
@@ -0,0 +1,108 @@
+package mailer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+type rateLimitedSender struct {
+	wrapper
+	interval time.Duration
+
+	mu        sync.Mutex
+	next      time.Time
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+var (
+	// after is stubbed by the tests to not wait for the rate limit.
+	after = time.After
+
+	errRateLimitedClosed = errors.New("mailer: rate-limited Sender closed")
+)
+
+// RateLimited returns a Sender sending emails with s at most perSecond times
+// per second. Send blocks until the email can be sent instead of returning an
+// error when the limit is hit, it is safe for concurrent use. A perSecond
+// lower than 1 disables the limit.
+//
+// SendContext stops waiting when ctx is done, and passes ctx to s if it is a
+// ContextSender. Closing the Sender wakes up the blocked calls to Send, which
+// then return an error without sending their email, and closes s if it is a
+// SendCloser.
+func RateLimited(s Sender, perSecond int) ContextSender {
+	r := &rateLimitedSender{wrapper: wrapper{s}, closed: make(chan struct{})}
+	if perSecond > 0 {
+		r.interval = time.Second / time.Duration(perSecond)
+	}
+	return r
+}
+
+func (r *rateLimitedSender) Send(from string, to []string, msg io.WriterTo) error {
+	return r.SendContext(context.Background(), from, to, msg)
+}
+
+func (r *rateLimitedSender) SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error {
+	if err := r.wait(ctx); err != nil {
+		return err
+	}
+	if s, ok := r.s.(ContextSender); ok {
+		return s.SendContext(ctx, from, to, msg)
+	}
+	return r.s.Send(from, to, msg)
+}
+
+// Close wakes up the blocked calls to Send and closes the wrapped Sender.
+func (r *rateLimitedSender) Close() error {
+	r.closeOnce.Do(func() { close(r.closed) })
+	return r.wrapper.Close()
+}
+
+// wait blocks until the next email can be sent, the Sender is closed or ctx is
+// done.
+func (r *rateLimitedSender) wait(ctx context.Context) error {
+	select {
+	case <-r.closed:
+		return errRateLimitedClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	if r.interval == 0 {
+		return nil
+	}
+
+	// The time slot is reserved before waiting so that the lock is not held
+	// while blocked and concurrent calls wait for their own slot.
+	r.mu.Lock()
+	t := now()
+	var d time.Duration
+	if r.next.After(t) {
+		d = r.next.Sub(t)
+		t = r.next
+	}
+	r.next = t.Add(r.interval)
+	r.mu.Unlock()
+
+	if d == 0 {
+		return nil
+	}
+	select {
+	case <-after(d):
+		return nil
+	case <-r.closed:
+		return errRateLimitedClosed
+	case <-ctx.Done():
+		// Give the slot back unless a later one was reserved meanwhile.
+		r.mu.Lock()
+		if r.next.Equal(t.Add(r.interval)) {
+			r.next = t
+		}
+		r.mu.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,135 @@
+package mailer
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimited(t *testing.T) {
+	oldNow := now
+	clock := time.Date(2014, 6, 25, 17, 46, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	var delays []time.Duration
+	after = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		clock = clock.Add(d)
+		c := make(chan time.Time, 1)
+		c <- clock
+		return c
+	}
+	defer func() {
+		now = oldNow
+		after = time.After
+	}()
+
+	mem := &MemorySender{}
+	s := RateLimited(mem, 4)
+
+	m := getTestMessage()
+	assert.NoError(t, Send(s, m, m, m))
+	assert.Equal(t, []time.Duration{250 * time.Millisecond, 250 * time.Millisecond}, delays)
+
+	// The limit does not delay emails sent after the interval elapsed.
+	delays = nil
+	clock = clock.Add(time.Second)
+	assert.NoError(t, Send(s, m))
+	assert.Empty(t, delays)
+
+	assert.Len(t, mem.Messages(), 4)
+	assert.NoError(t, s.(SendCloser).Close())
+}
+
+func TestRateLimitedUnlimited(t *testing.T) {
+	after = func(d time.Duration) <-chan time.Time {
+		t.Error("an unlimited Sender should not wait")
+		return time.After(0)
+	}
+	defer func() { after = time.After }()
+
+	sent := 0
+	s := RateLimited(SendFunc(func(from string, to []string, msg io.WriterTo) error {
+		sent++
+		return nil
+	}), 0)
+
+	m := getTestMessage()
+	assert.NoError(t, Send(s, m, m))
+	assert.Equal(t, 2, sent)
+	assert.NoError(t, s.(SendCloser).Close())
+}
+
+func TestRateLimitedClose(t *testing.T) {
+	waiting := make(chan struct{})
+	after = func(d time.Duration) <-chan time.Time {
+		close(waiting)
+		return nil
+	}
+	defer func() { after = time.After }()
+
+	closed := false
+	s := RateLimited(&mockSendCloser{
+		mockSender: func(from string, to []string, msg io.WriterTo) error { return nil },
+		close: func() error {
+			closed = true
+			return nil
+		},
+	}, 1)
+
+	m := getTestMessage()
+	assert.NoError(t, Send(s, m))
+
+	errc := make(chan error)
+	go func() { errc <- Send(s, m) }()
+	<-waiting
+	assert.NoError(t, s.(SendCloser).Close())
+	err := <-errc
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mailer: rate-limited Sender closed")
+	assert.True(t, closed)
+
+	// Send fails without waiting once the Sender is closed.
+	err = Send(s, m)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "mailer: rate-limited Sender closed")
+	assert.NoError(t, s.(SendCloser).Close())
+}
+
+func TestRateLimitedContext(t *testing.T) {
+	oldNow := now
+	clock := time.Date(2014, 6, 25, 17, 46, 0, 0, time.UTC)
+	now = func() time.Time { return clock }
+	waiting := make(chan time.Duration, 1)
+	after = func(d time.Duration) <-chan time.Time {
+		waiting <- d
+		return nil
+	}
+	defer func() {
+		now = oldNow
+		after = time.After
+	}()
+
+	mem := &MemorySender{}
+	s := RateLimited(mem, 1)
+	m := getTestMessage()
+	assert.NoError(t, s.SendContext(context.Background(), testFrom, []string{testTo1}, m))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() { errc <- s.SendContext(ctx, testFrom, []string{testTo1}, m) }()
+	assert.Equal(t, time.Second, <-waiting)
+	cancel()
+	assert.Equal(t, context.Canceled, <-errc)
+
+	// A done context fails right away, and the cancelled call gave its slot
+	// back.
+	assert.Equal(t, context.Canceled, s.SendContext(ctx, testFrom, []string{testTo1}, m))
+	go func() { errc <- s.SendContext(context.Background(), testFrom, []string{testTo1}, m) }()
+	assert.Equal(t, time.Second, <-waiting)
+	assert.NoError(t, s.Close())
+	assert.Error(t, <-errc)
+	assert.Len(t, mem.Messages(), 1)
+}
@@ -0,0 +1,124 @@
+package mailer
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+type (
+	restrictedSender struct {
+		wrapper
+		domains map[string]bool
+		drop    bool
+	}
+
+	redirectSender struct {
+		wrapper
+		override string
+	}
+
+	// originalToMessage is an email written with an "X-Original-To" header
+	// holding its original recipients.
+	originalToMessage struct {
+		msg io.WriterTo
+		to  []string
+	}
+)
+
+// RestrictRecipients returns a Sender sending emails with s only if all their
+// recipients are in one of the allowedDomains, for example to make sure that a
+// staging environment never sends an email to a real customer. Send fails
+// without sending anything if a recipient is in another domain, see
+// FilterRecipients to drop them instead. The domains are compared without
+// case and their subdomains are not allowed.
+func RestrictRecipients(s Sender, allowedDomains []string) Sender {
+	return newRestrictedSender(s, allowedDomains, false)
+}
+
+// FilterRecipients is like RestrictRecipients but the recipients which are not
+// in one of the allowedDomains are removed from the envelope instead, the
+// email still being sent to the other ones. The header of the email is not
+// modified. If no recipient is left, the email is not sent and Send returns
+// nil.
+func FilterRecipients(s Sender, allowedDomains []string) Sender {
+	return newRestrictedSender(s, allowedDomains, true)
+}
+
+func newRestrictedSender(s Sender, allowedDomains []string, drop bool) *restrictedSender {
+	r := &restrictedSender{wrapper: wrapper{s}, domains: make(map[string]bool, len(allowedDomains)), drop: drop}
+	for _, d := range allowedDomains {
+		r.domains[strings.ToLower(d)] = true
+	}
+	return r
+}
+
+func (r *restrictedSender) Send(from string, to []string, msg io.WriterTo) error {
+	var allowed, denied []string
+	for _, addr := range to {
+		if r.allows(addr) {
+			allowed = append(allowed, addr)
+		} else {
+			denied = append(denied, addr)
+		}
+	}
+
+	if len(denied) > 0 && !r.drop {
+		return fmt.Errorf("mailer: recipients not in an allowed domain: %s", strings.Join(denied, ", "))
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return r.s.Send(from, allowed, msg)
+}
+
+// allows reports whether the domain of the address addr is allowed.
+func (r *restrictedSender) allows(addr string) bool {
+	at := strings.LastIndexByte(addr, '@')
+	return at != -1 && r.domains[strings.ToLower(addr[at+1:])]
+}
+
+// RedirectSender returns a Sender sending all the emails with s to the single
+// address override instead of their recipients, for example a catch-all inbox
+// in a test environment. Only the envelope is rewritten: the header of the
+// email is kept and, for a *Message, an "X-Original-To" header holding its
+// original To and Cc recipients is added, so the intended recipients can be
+// checked. The Bcc recipients are never written in it, so the header is not
+// added to the other emails, whose Bcc recipients cannot be told apart from the
+// visible ones. The Dialer options which need a *Message, such as AutoSender,
+// have no effect since s is not given the *Message itself.
+func RedirectSender(s Sender, override string) Sender {
+	return &redirectSender{wrapper: wrapper{s}, override: override}
+}
+
+func (r *redirectSender) Send(from string, to []string, msg io.WriterTo) error {
+	m, ok := msg.(*Message)
+	if !ok {
+		return r.s.Send(from, []string{r.override}, msg)
+	}
+
+	visible, err := m.recipients("To", "Cc")
+	if err != nil {
+		return err
+	}
+	var original []string
+	for _, addr := range to {
+		if hasAddress(visible, addr) {
+			original = append(original, addr)
+		}
+	}
+	if len(original) == 0 {
+		return r.s.Send(from, []string{r.override}, msg)
+	}
+	return r.s.Send(from, []string{r.override}, &originalToMessage{msg: msg, to: original})
+}
+
+func (m *originalToMessage) WriteTo(w io.Writer) (int64, error) {
+	mw := &messageWriter{w: w}
+	mw.writeHeader("X-Original-To", m.to...)
+	if mw.err != nil {
+		return mw.n, mw.err
+	}
+	n, err := m.msg.WriteTo(w)
+	return mw.n + n, err
+}
@@ -0,0 +1,80 @@
+package mailer
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRestrictRecipients(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "dev@Staging.Example.com", "customer@gmail.com")
+	m.SetHeader("Cc", "qa@test.example.com")
+	m.SetBody("text/plain", "Test")
+
+	mem := &MemorySender{}
+	s := RestrictRecipients(mem, []string{"staging.example.com", "TEST.example.com"})
+	err := Send(s, m)
+	assert.EqualError(t, err, "mailer: could not send email 1: mailer: recipients not in an allowed domain: customer@gmail.com")
+	assert.Empty(t, mem.Messages())
+
+	m.SetHeader("To", "dev@Staging.Example.com")
+	assert.NoError(t, Send(s, m))
+	if assert.Len(t, mem.Messages(), 1) {
+		assert.Equal(t, []string{"dev@Staging.Example.com", "qa@test.example.com"}, mem.Messages()[0].To)
+	}
+	assert.NoError(t, s.(SendCloser).Close())
+}
+
+func TestFilterRecipients(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "dev@staging.example.com", "customer@gmail.com")
+	m.SetHeader("Cc", "other@sub.staging.example.com")
+	m.SetBody("text/plain", "Test")
+
+	mem := &MemorySender{}
+	s := FilterRecipients(mem, []string{"staging.example.com"})
+	assert.NoError(t, Send(s, m))
+	if assert.Len(t, mem.Messages(), 1) {
+		assert.Equal(t, []string{"dev@staging.example.com"}, mem.Messages()[0].To)
+	}
+
+	m.SetHeader("To", "customer@gmail.com")
+	m.SetHeader("Cc")
+	assert.NoError(t, Send(s, m))
+	assert.Len(t, mem.Messages(), 1)
+}
+
+func TestRedirectSender(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "customer@gmail.com")
+	m.SetHeader("Cc", "cc@example.com")
+	m.Bcc("bcc@example.com")
+	m.SetBody("text/plain", "Test")
+
+	mem := &MemorySender{}
+	s := RedirectSender(mem, "qa@example.com")
+	assert.NoError(t, Send(s, m))
+	if assert.Len(t, mem.Messages(), 1) {
+		sent := mem.Messages()[0]
+		assert.Equal(t, []string{"qa@example.com"}, sent.To)
+
+		p, err := ParseMessage(bytes.NewReader(sent.Data))
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"customer@gmail.com, cc@example.com"}, p.Header["X-Original-To"])
+		assert.NotContains(t, string(sent.Data), "bcc@example.com")
+		assert.Equal(t, []string{"customer@gmail.com"}, p.Header["To"])
+	}
+	assert.Equal(t, []string{"customer@gmail.com"}, m.GetHeader("To"))
+
+	raw := rawMessage("To: customer@gmail.com\r\n\r\nTest")
+	assert.NoError(t, s.Send("from@example.com", []string{"customer@gmail.com", "bcc@example.com"}, raw))
+	if assert.Len(t, mem.Messages(), 2) {
+		assert.Equal(t, string(raw), string(mem.Messages()[1].Data))
+	}
+	assert.NoError(t, s.(SendCloser).Close())
+}
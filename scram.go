@@ -0,0 +1,155 @@
+package mailer
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/smtp"
+	"strconv"
+	"strings"
+)
+
+type scramAuth struct {
+	username string
+	password string
+
+	// The state of the exchange, reset by Start.
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+// maxSCRAMIterations is the highest iteration count accepted from the server,
+// which could otherwise keep the client busy hashing the password.
+const maxSCRAMIterations = 1 << 20
+
+// scramNonce returns a new client nonce. Stubbed out for testing.
+var scramNonce = func() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// SCRAMSHA256Auth returns an smtp.Auth that implements the SCRAM-SHA-256
+// authentication mechanism (RFC 7677) without channel binding. Unlike PLAIN
+// and CRAM-MD5, the password is never sent to the server, even hashed, and the
+// server proves it knows the credentials too. The password is used as is,
+// without SASLprep normalization.
+func SCRAMSHA256Auth(username, password string) smtp.Auth {
+	return &scramAuth{
+		username: username,
+		password: password,
+	}
+}
+
+func (a *scramAuth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	nonce, err := scramNonce()
+	if err != nil {
+		return "", nil, err
+	}
+	a.nonce = nonce
+	a.serverSignature = nil
+	a.verified = false
+
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username)
+	a.clientFirstBare = "n=" + name + ",r=" + a.nonce
+	return "SCRAM-SHA-256", []byte("n,," + a.clientFirstBare), nil
+}
+
+func (a *scramAuth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		if a.verified {
+			return nil, nil
+		}
+		// The server-final-message can also be sent as the additional data
+		// of the success reply (RFC 4954, section 4), which net/smtp does not
+		// decode.
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(fromServer)))
+		if err != nil || a.serverSignature == nil {
+			return nil, errors.New("mailer: the server did not send its SCRAM-SHA-256 signature")
+		}
+		return nil, a.verify(string(b))
+	}
+
+	if a.serverSignature == nil {
+		return a.clientFinal(string(fromServer))
+	}
+	if err := a.verify(string(fromServer)); err != nil {
+		return nil, err
+	}
+	return []byte{}, nil
+}
+
+// verify checks the signature of the server-final-message serverFinal.
+func (a *scramAuth) verify(serverFinal string) error {
+	attrs := scramAttributes(serverFinal)
+	if e, ok := attrs["e"]; ok {
+		return fmt.Errorf("mailer: SCRAM-SHA-256 authentication failed: %s", e)
+	}
+	v, err := base64.StdEncoding.DecodeString(attrs["v"])
+	if err != nil || subtle.ConstantTimeCompare(v, a.serverSignature) != 1 {
+		return errors.New("mailer: invalid SCRAM-SHA-256 server signature")
+	}
+	a.verified = true
+	return nil
+}
+
+// clientFinal returns the client-final-message answering the
+// server-first-message serverFirst.
+func (a *scramAuth) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := scramAttributes(serverFirst)
+	nonce := attrs["r"]
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil || !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, fmt.Errorf("mailer: invalid SCRAM-SHA-256 challenge: %s", serverFirst)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil || iterations < 1 || iterations > maxSCRAMIterations {
+		return nil, fmt.Errorf("mailer: invalid SCRAM-SHA-256 challenge: %s", serverFirst)
+	}
+
+	salted := pbkdf2SHA256([]byte(a.password), salt, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := a.clientFirstBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = hmacSHA256(hmacSHA256(salted, "Server Key"), authMessage)
+
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+// scramAttributes parses the comma-separated attributes of a SCRAM message.
+func scramAttributes(msg string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(msg, ",") {
+		if len(attr) > 1 && attr[1] == '=' {
+			attrs[attr[:1]] = attr[2:]
+		}
+	}
+	return attrs
+}
+
+// pbkdf2SHA256 is the Hi function of RFC 5802, PBKDF2 with HMAC-SHA-256 and an
+// output of a single block.
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	u := hmacSHA256(password, string(salt)+"\x00\x00\x00\x01")
+	out := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = hmacSHA256(password, string(u))
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
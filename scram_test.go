@@ -0,0 +1,122 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"net/smtp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSCRAMSHA256Auth(t *testing.T) {
+	// Example of RFC 7677, section 3.
+	stubSCRAMNonce(t, "rOprNGfwEbeRWgbNEkqO")
+	a := SCRAMSHA256Auth("user", "pencil")
+
+	proto, resp, err := a.Start(&smtp.ServerInfo{Name: testHost, Auth: []string{"SCRAM-SHA-256"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "SCRAM-SHA-256", proto)
+	assert.Equal(t, "n,,n=user,r=rOprNGfwEbeRWgbNEkqO", string(resp))
+
+	resp, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+	assert.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(resp))
+
+	resp, err = a.Next([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="), true)
+	assert.NoError(t, err)
+	assert.Empty(t, resp)
+
+	resp, err = a.Next(nil, false)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	// A second exchange, after a reconnection, starts from scratch.
+	stubSCRAMNonce(t, "fyko+d2lbbFgONRv9qkxdawL")
+	_, resp, err = a.Start(&smtp.ServerInfo{Name: testHost, Auth: []string{"SCRAM-SHA-256"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL", string(resp))
+	resp, err = a.Next([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"), true)
+	assert.NoError(t, err)
+	assert.Contains(t, string(resp), "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=")
+
+	// The success reply does not authenticate the server without its
+	// signature.
+	_, err = a.Next([]byte("2.7.0 Authentication successful"), false)
+	assert.EqualError(t, err, "mailer: the server did not send its SCRAM-SHA-256 signature")
+}
+
+func TestSCRAMSHA256AuthSuccessData(t *testing.T) {
+	// The server-final-message is sent along with the success reply.
+	stubSCRAMNonce(t, "rOprNGfwEbeRWgbNEkqO")
+	a := SCRAMSHA256Auth("user", "pencil")
+	_, _, err := a.Start(&smtp.ServerInfo{Name: testHost, Auth: []string{"SCRAM-SHA-256"}})
+	assert.NoError(t, err)
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+
+	resp, err := a.Next([]byte(base64.StdEncoding.EncodeToString([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="))), false)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+
+	_, err = a.Next([]byte(base64.StdEncoding.EncodeToString([]byte("v=c2lnbmF0dXJl"))), false)
+	assert.NoError(t, err, "the server is already authenticated")
+
+	_, _, err = a.Start(&smtp.ServerInfo{Name: testHost, Auth: []string{"SCRAM-SHA-256"}})
+	assert.NoError(t, err)
+	_, err = a.Next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"), true)
+	assert.NoError(t, err)
+	_, err = a.Next([]byte(base64.StdEncoding.EncodeToString([]byte("v=c2lnbmF0dXJl"))), false)
+	assert.EqualError(t, err, "mailer: invalid SCRAM-SHA-256 server signature")
+}
+
+func TestSCRAMSHA256AuthNonce(t *testing.T) {
+	a := SCRAMSHA256Auth("user", "pencil")
+	_, first, err := a.Start(&smtp.ServerInfo{Name: testHost})
+	assert.NoError(t, err)
+	_, second, err := a.Start(&smtp.ServerInfo{Name: testHost})
+	assert.NoError(t, err)
+	assert.NotEqual(t, string(first), string(second))
+
+	// A Dialer shared by several goroutines does not use the state of its
+	// Auth.
+	srv := &fakeServer{ext: []string{"AUTH SCRAM-SHA-256"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Auth: SCRAMSHA256Auth("user", "pencil"), AllowPlaintextAuth: true}
+	// The fake server answers 235 right away, without authenticating itself.
+	err = d.Ping()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "mailer: the server did not send its SCRAM-SHA-256 signature")
+	}
+	srv.wait()
+	assert.Empty(t, d.Auth.(*scramAuth).nonce)
+	assert.True(t, strings.HasPrefix(srv.cmds[1], "AUTH SCRAM-SHA-256 "))
+}
+
+func stubSCRAMNonce(t *testing.T, nonce string) {
+	orig := scramNonce
+	scramNonce = func() (string, error) { return nonce, nil }
+	t.Cleanup(func() { scramNonce = orig })
+}
+
+func TestSCRAMSHA256AuthErrors(t *testing.T) {
+	stubSCRAMNonce(t, "abc")
+	a := SCRAMSHA256Auth("us,er=", "pencil")
+	_, resp, err := a.Start(&smtp.ServerInfo{Name: testHost})
+	assert.NoError(t, err)
+	assert.Equal(t, "n,,n=us=2Cer=3D,r=abc", string(resp))
+
+	_, err = a.Next([]byte("r=xyz,s=c2FsdA==,i=4096"), true)
+	assert.EqualError(t, err, "mailer: invalid SCRAM-SHA-256 challenge: r=xyz,s=c2FsdA==,i=4096")
+	_, err = a.Next([]byte("r=abcdef,s=c2FsdA==,i=0"), true)
+	assert.EqualError(t, err, "mailer: invalid SCRAM-SHA-256 challenge: r=abcdef,s=c2FsdA==,i=0")
+	_, err = a.Next([]byte("r=abcdef,s=c2FsdA==,i=2147483647"), true)
+	assert.EqualError(t, err, "mailer: invalid SCRAM-SHA-256 challenge: r=abcdef,s=c2FsdA==,i=2147483647")
+
+	_, err = a.Next([]byte("r=abcdef,s=c2FsdA==,i=1"), true)
+	assert.NoError(t, err)
+	_, err = a.Next([]byte("v=c2lnbmF0dXJl"), true)
+	assert.EqualError(t, err, "mailer: invalid SCRAM-SHA-256 server signature")
+	_, err = a.Next([]byte("e=invalid-proof"), true)
+	assert.EqualError(t, err, "mailer: SCRAM-SHA-256 authentication failed: invalid-proof")
+}
@@ -1,6 +1,7 @@
 package mailer
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/mail"
@@ -14,11 +15,39 @@ type (
 	}
 
 	// SendCloser is the interface that groups the Send and Close methods.
+	//
+	// The Senders returned by the functions wrapping another Sender, such as
+	// DKIMSender or RateLimited, implement SendCloser: their Close method
+	// closes the wrapped Sender if it is a SendCloser.
 	SendCloser interface {
 		Sender
 		Close() error
 	}
 
+	// A ContextSender is a SendCloser whose SendContext method sends an email
+	// like Send but gives up, returning the error of ctx, when ctx is done
+	// before the email could be sent.
+	ContextSender interface {
+		SendCloser
+		SendContext(ctx context.Context, from string, to []string, msg io.WriterTo) error
+	}
+
+	// Resetter is implemented by the SendCloser returned by Dialer.Dial.
+	// Reset aborts the current transaction on the connection, so it can be
+	// reused after a partial failure without reconnecting.
+	Resetter interface {
+		Reset() error
+	}
+
+	// wrapper is embedded in the Senders wrapping the Sender s to forward
+	// Close to it.
+	wrapper struct {
+		s Sender
+	}
+
+	// rawMessage is an already rendered email.
+	rawMessage []byte
+
 	// A SendFunc is a function that sends emails to the given addresses.
 	// The SendFunc type is an adapter to allow the use of ordinary functions as
 	// email senders. If f is a function with the appropriate signature, SendFunc(f)
@@ -31,11 +60,25 @@ func (f SendFunc) Send(from string, to []string, msg io.WriterTo) error {
 	return f(from, to, msg)
 }
 
+// Close closes the wrapped Sender if it is a SendCloser.
+func (w wrapper) Close() error {
+	if c, ok := w.s.(SendCloser); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// WriteTo implements io.WriterTo.
+func (m rawMessage) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(m)
+	return int64(n), err
+}
+
 // Send sends emails using the given Sender.
 func Send(s Sender, msg ...*Message) error {
 	for i, m := range msg {
 		if err := send(s, m); err != nil {
-			return fmt.Errorf("mailer: could not send email %d: %v", i+1, err)
+			return fmt.Errorf("mailer: could not send email %d: %w", i+1, err)
 		}
 	}
 
@@ -61,13 +104,20 @@ func send(s Sender, m *Message) error {
 }
 
 func addAddress(list []string, addr string) []string {
+	if hasAddress(list, addr) {
+		return list
+	}
+
+	return append(list, addr)
+}
+
+func hasAddress(list []string, addr string) bool {
 	for _, a := range list {
 		if addr == a {
-			return list
+			return true
 		}
 	}
-
-	return append(list, addr)
+	return false
 }
 
 func parseAddress(field string) (string, error) {
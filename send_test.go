@@ -52,6 +52,31 @@ func TestSend(t *testing.T) {
 	assert.NoError(t, err)
 }
 
+func TestWrapperClose(t *testing.T) {
+	for name, wrap := range map[string]func(Sender) Sender{
+		"DKIMSender":         func(s Sender) Sender { return DKIMSender(s, DKIMConfig{}) },
+		"RateLimited":        func(s Sender) Sender { return RateLimited(s, 10) },
+		"SMIMESender":        func(s Sender) Sender { return SMIMESender(s, SMIMEConfig{}) },
+		"ARCSender":          func(s Sender) Sender { return ARCSender(s, ARCConfig{}) },
+		"RestrictRecipients": func(s Sender) Sender { return RestrictRecipients(s, nil) },
+		"FilterRecipients":   func(s Sender) Sender { return FilterRecipients(s, nil) },
+		"RedirectSender":     func(s Sender) Sender { return RedirectSender(s, "qa@example.com") },
+	} {
+		closed := false
+		s := wrap(&mockSendCloser{close: func() error {
+			closed = true
+			return nil
+		}})
+		if assert.Implements(t, (*SendCloser)(nil), s, name) {
+			assert.NoError(t, s.(SendCloser).Close(), name)
+			assert.True(t, closed, name)
+		}
+
+		s = wrap(SendFunc(func(string, []string, io.WriterTo) error { return nil }))
+		assert.NoError(t, s.(SendCloser).Close(), name)
+	}
+}
+
 func getTestMessage() *Message {
 	m := NewMessage()
 	m.SetHeader("From", testFrom)
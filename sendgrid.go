@@ -0,0 +1,304 @@
+package mailer
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+type (
+	// SendGridSender is a SendCloser sending emails with the SendGrid v3
+	// mail/send HTTP API instead of SMTP, which is useful when outbound SMTP
+	// ports are blocked. It can only send emails built with NewMessage.
+	SendGridSender struct {
+		// APIKey is the SendGrid API key used to authenticate the requests.
+		APIKey string
+		// Endpoint is the URL of the mail/send endpoint. By default,
+		// "https://api.sendgrid.com/v3/mail/send" is used.
+		Endpoint string
+		// Client is the HTTP client used to send the requests. By default,
+		// http.DefaultClient is used.
+		Client *http.Client
+	}
+
+	sendGridAddress struct {
+		Email string `json:"email"`
+		Name  string `json:"name,omitempty"`
+	}
+
+	sendGridPersonalization struct {
+		To  []sendGridAddress `json:"to"`
+		Cc  []sendGridAddress `json:"cc,omitempty"`
+		Bcc []sendGridAddress `json:"bcc,omitempty"`
+	}
+
+	sendGridContent struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+
+	sendGridAttachment struct {
+		Content     string `json:"content"`
+		Type        string `json:"type,omitempty"`
+		Filename    string `json:"filename"`
+		Disposition string `json:"disposition,omitempty"`
+		ContentID   string `json:"content_id,omitempty"`
+	}
+
+	sendGridMail struct {
+		Personalizations []sendGridPersonalization `json:"personalizations"`
+		From             sendGridAddress           `json:"from"`
+		ReplyTo          *sendGridAddress          `json:"reply_to,omitempty"`
+		ReplyToList      []sendGridAddress         `json:"reply_to_list,omitempty"`
+		Subject          string                    `json:"subject,omitempty"`
+		Content          []sendGridContent         `json:"content,omitempty"`
+		Attachments      []sendGridAttachment      `json:"attachments,omitempty"`
+		Headers          map[string]string         `json:"headers,omitempty"`
+	}
+)
+
+const sendGridEndpoint = "https://api.sendgrid.com/v3/mail/send"
+
+// sendGridReserved are the headers mapped to dedicated fields of the SendGrid
+// request, or set by SendGrid itself.
+var sendGridReserved = map[string]bool{
+	"From": true, "Sender": true, "To": true, "Cc": true, "Bcc": true,
+	"Reply-To": true, "Return-Path": true, "Subject": true, "Date": true, "Mime-Version": true,
+	"Content-Type": true, "Content-Transfer-Encoding": true,
+}
+
+// NewSendGridSender returns a new SendGridSender using the given API key.
+func NewSendGridSender(apiKey string) *SendGridSender {
+	return &SendGridSender{APIKey: apiKey}
+}
+
+// Send implements Sender. The recipients are classified as To, Cc or Bcc
+// according to the headers of msg, which must be a *Message.
+func (s *SendGridSender) Send(from string, to []string, msg io.WriterTo) error {
+	m, ok := msg.(*Message)
+	if !ok {
+		return fmt.Errorf("mailer: SendGrid can only send a *Message, got %T", msg)
+	}
+
+	body, err := m.sendGridMail(from, to)
+	if err != nil {
+		return err
+	}
+
+	endpoint := s.Endpoint
+	if endpoint == "" {
+		endpoint = sendGridEndpoint
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.APIKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("mailer: SendGrid returned %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+// Close implements SendCloser, it does nothing.
+func (s *SendGridSender) Close() error {
+	return nil
+}
+
+// sendGridMail returns the JSON body of the SendGrid request sending m from
+// the envelope sender from to the envelope recipients to. SendGrid has no
+// separate envelope sender, so from is only used without a "From" header.
+func (m *Message) sendGridMail(from string, to []string) ([]byte, error) {
+	sender, err := m.sendGridFrom(from)
+	if err != nil {
+		return nil, err
+	}
+	mail := &sendGridMail{
+		From:    sender,
+		Subject: decodeHeader(strings.Join(m.header["Subject"], " ")),
+		Headers: make(map[string]string),
+	}
+
+	var p sendGridPersonalization
+	for _, addr := range to {
+		a, field, err := m.findRecipient(addr)
+		if err != nil {
+			return nil, err
+		}
+		switch field {
+		case "To":
+			p.To = append(p.To, a)
+		case "Cc":
+			p.Cc = append(p.Cc, a)
+		default:
+			p.Bcc = append(p.Bcc, a)
+		}
+	}
+	if len(p.To) == 0 {
+		return nil, errors.New("mailer: SendGrid requires at least one To recipient")
+	}
+	mail.Personalizations = []sendGridPersonalization{p}
+
+	// SendGrid rejects requests with both reply_to and reply_to_list.
+	replyTo := m.header["Reply-To"]
+	for _, v := range replyTo {
+		a, err := parseSendGridAddress(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(replyTo) == 1 {
+			mail.ReplyTo = &a
+		} else {
+			mail.ReplyToList = append(mail.ReplyToList, a)
+		}
+	}
+
+	for k, v := range m.header {
+		if !sendGridReserved[k] {
+			mail.Headers[k] = strings.Join(v, ", ")
+		}
+	}
+
+	parts, embedded, attachments := m.writtenParts(), m.embedded, m.attachments
+	if m.tree != nil {
+		var err error
+		if parts, embedded, attachments, err = m.tree.leaves(); err != nil {
+			return nil, err
+		}
+		for i, p := range parts {
+			parts[i] = m.treePart(p)
+		}
+	}
+
+	for _, p := range parts {
+		buf := new(bytes.Buffer)
+		if err := p.copier(buf); err != nil {
+			return nil, err
+		}
+		mail.Content = append(mail.Content, sendGridContent{
+			Type:  p.contentType,
+			Value: buf.String(),
+		})
+	}
+
+	for _, f := range embedded {
+		a, err := newSendGridAttachment(f, false)
+		if err != nil {
+			return nil, err
+		}
+		mail.Attachments = append(mail.Attachments, a)
+	}
+	for _, f := range attachments {
+		a, err := newSendGridAttachment(f, true)
+		if err != nil {
+			return nil, err
+		}
+		mail.Attachments = append(mail.Attachments, a)
+	}
+
+	return json.Marshal(mail)
+}
+
+// sendGridFrom returns the first address of the "From" header, or the envelope
+// sender from if there is none.
+func (m *Message) sendGridFrom(from string) (sendGridAddress, error) {
+	if v := m.header["From"]; len(v) > 0 {
+		addrs, err := mail.ParseAddressList(v[0])
+		if err != nil {
+			return sendGridAddress{}, fmt.Errorf("mailer: invalid address %q: %v", v[0], err)
+		}
+		return sendGridAddress{Email: addrs[0].Address, Name: addrs[0].Name}, nil
+	}
+	return sendGridAddress{Email: from}, nil
+}
+
+// findRecipient returns the address and the header field of the recipient
+// addr, Bcc is returned for recipients which are not in the headers. The
+// domains are compared in their ASCII form since addr is converted by
+// PunycodeDomains but the headers are not.
+func (m *Message) findRecipient(addr string) (sendGridAddress, string, error) {
+	ascii, err := toASCIIAddress(addr)
+	if err != nil {
+		return sendGridAddress{}, "", err
+	}
+	for _, field := range []string{"To", "Cc", "Bcc"} {
+		for _, v := range m.header[field] {
+			a, err := parseSendGridAddress(v)
+			if err != nil {
+				return sendGridAddress{}, "", err
+			}
+			if a.Email == addr {
+				return a, field, nil
+			}
+			if headerASCII, err := toASCIIAddress(a.Email); err == nil && headerASCII == ascii {
+				return sendGridAddress{Email: addr, Name: a.Name}, field, nil
+			}
+		}
+	}
+	return sendGridAddress{Email: addr}, "Bcc", nil
+}
+
+func parseSendGridAddress(field string) (sendGridAddress, error) {
+	addr, err := mail.ParseAddress(field)
+	if err != nil {
+		return sendGridAddress{}, fmt.Errorf("mailer: invalid address %q: %v", field, err)
+	}
+	return sendGridAddress{Email: addr.Address, Name: addr.Name}, nil
+}
+
+func newSendGridAttachment(f *file, isAttachment bool) (sendGridAttachment, error) {
+	f.setDefaultHeaders(isAttachment)
+
+	buf := new(bytes.Buffer)
+	if err := f.CopyFunc(buf); err != nil {
+		return sendGridAttachment{}, err
+	}
+
+	a := sendGridAttachment{
+		Content:     base64.StdEncoding.EncodeToString(buf.Bytes()),
+		Filename:    f.Name,
+		Disposition: "attachment",
+	}
+	if ct, ok := f.Header["Content-Type"]; ok && len(ct) > 0 {
+		a.Type, _, _ = mime.ParseMediaType(ct[0])
+	}
+	if !isAttachment {
+		a.Disposition = "inline"
+		if id, ok := f.Header["Content-ID"]; ok && len(id) > 0 {
+			a.ContentID = strings.Trim(id[0], "<>")
+		}
+	}
+	return a, nil
+}
+
+// decodeHeader decodes the RFC 2047 encoded-words of a header value.
+func decodeHeader(value string) string {
+	dec := new(mime.WordDecoder)
+	decoded, err := dec.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+	return decoded
+}
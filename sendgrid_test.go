@@ -0,0 +1,180 @@
+package mailer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendGridSender(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, &got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	m := NewMessage()
+	m.SetAddressHeader("From", "from@example.com", "Señor From")
+	m.SetHeader("To", "to@example.com")
+	m.SetAddressHeader("Cc", "cc@example.com", "Cc")
+	m.SetHeader("Bcc", "bcc@example.com")
+	m.SetHeader("Reply-To", "reply@example.com")
+	m.SetHeader("Subject", "¡Hola, señor!")
+	m.SetHeader("X-Campaign", "test")
+	m.SetBody("text/plain", "Hello!")
+	m.AddAlternative("text/html", "<p>Hello!</p>")
+	m.AttachBytes("test.txt", []byte("Content"))
+	m.EmbedBytes("image.jpg", []byte("Image"))
+
+	s := NewSendGridSender("key")
+	s.Endpoint = srv.URL
+	assert.NoError(t, Send(s, m))
+	assert.NoError(t, s.Close())
+
+	want := map[string]interface{}{
+		"personalizations": []interface{}{map[string]interface{}{
+			"to":  []interface{}{map[string]interface{}{"email": "to@example.com"}},
+			"cc":  []interface{}{map[string]interface{}{"email": "cc@example.com", "name": "Cc"}},
+			"bcc": []interface{}{map[string]interface{}{"email": "bcc@example.com"}},
+		}},
+		"from":     map[string]interface{}{"email": "from@example.com", "name": "Señor From"},
+		"reply_to": map[string]interface{}{"email": "reply@example.com"},
+		"subject":  "¡Hola, señor!",
+		"content": []interface{}{
+			map[string]interface{}{"type": "text/plain", "value": "Hello!"},
+			map[string]interface{}{"type": "text/html", "value": "<p>Hello!</p>"},
+		},
+		"attachments": []interface{}{
+			map[string]interface{}{
+				"content":     "SW1hZ2U=",
+				"type":        "image/jpeg",
+				"filename":    "image.jpg",
+				"disposition": "inline",
+				"content_id":  "image.jpg",
+			},
+			map[string]interface{}{
+				"content":     "Q29udGVudA==",
+				"type":        "text/plain",
+				"filename":    "test.txt",
+				"disposition": "attachment",
+			},
+		},
+		"headers": map[string]interface{}{"X-Campaign": "test"},
+	}
+	assert.Equal(t, want, got)
+}
+
+func TestSendGridSenderError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"errors":[{"message":"bad key"}]}`))
+	}))
+	defer srv.Close()
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Hello!")
+
+	s := &SendGridSender{APIKey: "bad", Endpoint: srv.URL}
+	err := Send(s, m)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "401")
+		assert.Contains(t, err.Error(), "bad key")
+	}
+}
+
+func TestSendGridSenderFrom(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, &got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	m := NewMessage()
+	m.SetAddressHeader("From", "from@example.com", "From")
+	m.SetHeader("Sender", "sender@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetEnvelopeFrom("bounce@example.com")
+	m.SetBody("text/plain", "Hello!")
+
+	s := &SendGridSender{APIKey: "key", Endpoint: srv.URL}
+	assert.NoError(t, Send(s, m))
+
+	assert.Equal(t, map[string]interface{}{"email": "from@example.com", "name": "From"}, got["from"])
+	assert.NotContains(t, got, "headers")
+}
+
+func TestSendGridSenderIDN(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, &got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	m := NewMessage(PunycodeDomains())
+	m.SetHeader("From", "from@example.com")
+	m.SetAddressHeader("To", "info@münchen.de", "München")
+	m.SetAddressHeader("Cc", "cc@bücher.example", "")
+	m.SetBody("text/plain", "Hello!")
+
+	s := &SendGridSender{APIKey: "key", Endpoint: srv.URL}
+	assert.NoError(t, Send(s, m))
+
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"to": []interface{}{map[string]interface{}{"email": "info@xn--mnchen-3ya.de", "name": "München"}},
+		"cc": []interface{}{map[string]interface{}{"email": "cc@xn--bcher-kva.example"}},
+	}}, got["personalizations"])
+}
+
+func TestSendGridSenderNoTo(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("Bcc", "bcc@example.com")
+	m.SetBody("text/plain", "Hello!")
+
+	err := Send(NewSendGridSender("key"), m)
+	assert.EqualError(t, err, "mailer: could not send email 1: mailer: SendGrid requires at least one To recipient")
+}
+
+func TestSendGridSenderReplyToList(t *testing.T) {
+	var got map[string]interface{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.Unmarshal(b, &got))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.ReplyTo("alice@example.com", "Alice").AddReplyTo("bob@example.com", "")
+	m.SetBody("text/plain", "Hello!")
+
+	s := &SendGridSender{APIKey: "key", Endpoint: srv.URL}
+	assert.NoError(t, Send(s, m))
+
+	assert.NotContains(t, got, "reply_to")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"email": "alice@example.com", "name": "Alice"},
+		map[string]interface{}{"email": "bob@example.com"},
+	}, got["reply_to_list"])
+}
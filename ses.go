@@ -0,0 +1,177 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type (
+	// SESConfig holds the settings of an SESSender.
+	SESConfig struct {
+		// Region is the AWS region of the SES endpoint, such as "us-east-1".
+		Region string
+		// AccessKeyID and SecretAccessKey are the AWS credentials used to
+		// sign the requests.
+		AccessKeyID     string
+		SecretAccessKey string
+		// SessionToken is the optional token of temporary credentials.
+		SessionToken string
+		// Endpoint is the URL of the SES API. By default,
+		// "https://email.<Region>.amazonaws.com/" is used.
+		Endpoint string
+		// Client is the HTTP client used to send the requests. By default,
+		// http.DefaultClient is used.
+		Client *http.Client
+	}
+
+	// SESSender is a SendCloser sending emails with the Amazon SES
+	// SendRawEmail API.
+	SESSender struct {
+		config SESConfig
+	}
+
+	sesErrorResponse struct {
+		Code    string `xml:"Error>Code"`
+		Message string `xml:"Error>Message"`
+	}
+)
+
+// NewSESSender returns a new SESSender using the given config.
+func NewSESSender(config SESConfig) *SESSender {
+	return &SESSender{config: config}
+}
+
+// Send implements Sender. The recipients are given to SES as the
+// Destinations of the email, so Bcc recipients are delivered even though
+// they are not written in the headers.
+func (s *SESSender) Send(from string, to []string, msg io.WriterTo) error {
+	if s.config.Region == "" && s.config.Endpoint == "" {
+		return errors.New("mailer: SES region must be set")
+	}
+
+	raw := new(bytes.Buffer)
+	if _, err := msg.WriteTo(raw); err != nil {
+		return err
+	}
+
+	form := url.Values{}
+	form.Set("Action", "SendRawEmail")
+	form.Set("Version", "2010-12-01")
+	form.Set("Source", from)
+	for i, addr := range to {
+		form.Set("Destinations.member."+strconv.Itoa(i+1), addr)
+	}
+	form.Set("RawMessage.Data", base64.StdEncoding.EncodeToString(raw.Bytes()))
+	body := []byte(form.Encode())
+
+	endpoint := s.config.Endpoint
+	if endpoint == "" {
+		endpoint = "https://email." + s.config.Region + ".amazonaws.com/"
+	}
+	req, err := http.NewRequest("POST", endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if s.config.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.config.SessionToken)
+	}
+	s.config.sign(req, body, "ses", now())
+
+	client := s.config.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		var e sesErrorResponse
+		if xml.Unmarshal(b, &e) == nil && e.Code != "" {
+			return fmt.Errorf("mailer: SES returned %s: %s: %s", resp.Status, e.Code, e.Message)
+		}
+		return fmt.Errorf("mailer: SES returned %s: %s", resp.Status, bytes.TrimSpace(b))
+	}
+
+	return nil
+}
+
+// Close implements SendCloser, it does nothing.
+func (s *SESSender) Close() error {
+	return nil
+}
+
+// sign adds the AWS Signature Version 4 headers to req, payload being its
+// body.
+func (c *SESConfig) sign(req *http.Request, payload []byte, service string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	canonical := new(strings.Builder)
+	canonical.WriteString(req.Method + "\n")
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonical.WriteString(path + "\n")
+	canonical.WriteString(strings.Replace(req.URL.Query().Encode(), "+", "%20", -1) + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonical.WriteString("\n" + signedHeaders + "\n")
+	canonical.WriteString(hashHex(payload))
+
+	scope := date + "/" + c.Region + "/" + service + "/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hashHex([]byte(canonical.String()))
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretAccessKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hashHex(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -0,0 +1,89 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSESSender(t *testing.T) {
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "token", r.Header.Get("X-Amz-Security-Token"))
+		assert.Equal(t, "20140625T174600Z", r.Header.Get("X-Amz-Date"))
+		assert.True(t, strings.HasPrefix(r.Header.Get("Authorization"),
+			"AWS4-HMAC-SHA256 Credential=AKID/20140625/eu-west-1/ses/aws4_request, "+
+				"SignedHeaders=content-type;host;x-amz-date;x-amz-security-token, Signature="))
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		form, err = url.ParseQuery(string(b))
+		assert.NoError(t, err)
+		w.Write([]byte("<SendRawEmailResponse/>"))
+	}))
+	defer srv.Close()
+
+	s := NewSESSender(SESConfig{
+		Region:          "eu-west-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "secret",
+		SessionToken:    "token",
+		Endpoint:        srv.URL,
+	})
+
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetHeader("Bcc", "bcc@example.com")
+	m.SetBody("text/plain", "Hello!")
+	assert.NoError(t, Send(s, m))
+	assert.NoError(t, s.Close())
+
+	assert.Equal(t, "SendRawEmail", form.Get("Action"))
+	assert.Equal(t, "from@example.com", form.Get("Source"))
+	assert.Equal(t, "to@example.com", form.Get("Destinations.member.1"))
+	assert.Equal(t, "bcc@example.com", form.Get("Destinations.member.2"))
+
+	raw, err := base64.StdEncoding.DecodeString(form.Get("RawMessage.Data"))
+	assert.NoError(t, err)
+	assert.Contains(t, string(raw), "To: to@example.com\r\n")
+	assert.NotContains(t, string(raw), "bcc@example.com")
+}
+
+func TestSESSenderError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`<ErrorResponse><Error><Code>MessageRejected</Code>` +
+			`<Message>Email address is not verified.</Message></Error></ErrorResponse>`))
+	}))
+	defer srv.Close()
+
+	s := NewSESSender(SESConfig{Region: "us-east-1", Endpoint: srv.URL})
+	err := s.Send("from@example.com", []string{"to@example.com"}, rawMessage("Subject: Hi\r\n\r\nHello!"))
+	assert.EqualError(t, err, "mailer: SES returned 400 Bad Request: MessageRejected: Email address is not verified.")
+}
+
+func TestSESSign(t *testing.T) {
+	// get-vanilla example of the AWS Signature Version 4 test suite.
+	req, err := http.NewRequest("GET", "https://example.amazonaws.com/", nil)
+	assert.NoError(t, err)
+
+	c := &SESConfig{
+		Region:          "us-east-1",
+		AccessKeyID:     "AKIDEXAMPLE",
+		SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	c.sign(req, nil, "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+}
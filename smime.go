@@ -0,0 +1,266 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"mime/multipart"
+	"sort"
+	"strings"
+)
+
+type (
+	// SMIMEConfig represents the configuration used to sign emails with
+	// S/MIME as defined in RFC 8551.
+	SMIMEConfig struct {
+		// Certificate is the certificate of the signer, it is included in the
+		// signature.
+		Certificate *x509.Certificate
+		// PrivateKey is the key matching Certificate, it must be an
+		// *rsa.PrivateKey or an *ecdsa.PrivateKey.
+		PrivateKey crypto.Signer
+		// Chain holds the intermediate certificates included in the signature
+		// so recipients can verify Certificate.
+		Chain []*x509.Certificate
+	}
+
+	smimeSender struct {
+		wrapper
+		config SMIMEConfig
+	}
+
+	pkcs7ContentInfo struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}
+
+	pkcs7SignedData struct {
+		Version          int
+		DigestAlgorithms []pkcs7AlgorithmIdentifier `asn1:"set"`
+		ContentInfo      pkcs7EncapsulatedContent
+		Certificates     asn1.RawValue
+		SignerInfos      []pkcs7SignerInfo `asn1:"set"`
+	}
+
+	pkcs7EncapsulatedContent struct {
+		ContentType asn1.ObjectIdentifier
+	}
+
+	pkcs7AlgorithmIdentifier struct {
+		Algorithm  asn1.ObjectIdentifier
+		Parameters asn1.RawValue `asn1:"optional"`
+	}
+
+	pkcs7SignerInfo struct {
+		Version            int
+		IssuerAndSerial    pkcs7IssuerAndSerial
+		DigestAlgorithm    pkcs7AlgorithmIdentifier
+		SignedAttributes   asn1.RawValue
+		SignatureAlgorithm pkcs7AlgorithmIdentifier
+		Signature          []byte
+	}
+
+	pkcs7IssuerAndSerial struct {
+		Issuer       asn1.RawValue
+		SerialNumber *big.Int
+	}
+
+	pkcs7Attribute struct {
+		Type   asn1.ObjectIdentifier
+		Values asn1.RawValue
+	}
+)
+
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+	oidSHA256        = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidRSAEncryption = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECDSASHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+
+	asn1Null = asn1.RawValue{Tag: asn1.TagNull}
+)
+
+// SMIMESender returns a Sender that signs the emails with S/MIME using config
+// before delegating them to s. The content of the email is wrapped in a
+// multipart/signed entity along with a detached PKCS #7 signature. Signing
+// needs the whole email, so it is rendered in memory before being sent.
+//
+// The signed content must not be modified in transit, so the parts of the
+// email should not use the Unencoded encoding. When the email is also signed
+// with DKIM, SMIMESender must wrap the DKIMSender so that the DKIM signature
+// covers the S/MIME one.
+func SMIMESender(s Sender, config SMIMEConfig) Sender {
+	return &smimeSender{wrapper: wrapper{s}, config: config}
+}
+
+func (s *smimeSender) Send(from string, to []string, msg io.WriterTo) error {
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return err
+	}
+
+	signed, err := s.config.Sign(buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return s.s.Send(from, to, rawMessage(signed))
+}
+
+// Sign returns a copy of the rendered email msg whose content, made of its
+// "Content-" header fields and its body, is wrapped in a multipart/signed
+// entity.
+func (c *SMIMEConfig) Sign(msg []byte) ([]byte, error) {
+	header, body := splitMessage(msg)
+
+	out := new(bytes.Buffer)
+	entity := new(bytes.Buffer)
+	for _, f := range parseHeaderFields(header) {
+		if strings.HasPrefix(strings.ToLower(f.name), "content-") {
+			entity.WriteString(f.raw)
+		} else {
+			out.WriteString(f.raw)
+		}
+	}
+	entity.WriteString("\r\n")
+	entity.Write(body)
+
+	sig, err := c.signature(entity.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	boundary := multipart.NewWriter(ioutil.Discard).Boundary()
+	out.WriteString("Content-Type: multipart/signed;\r\n" +
+		" protocol=\"application/pkcs7-signature\"; micalg=sha-256;\r\n" +
+		" boundary=" + boundary + "\r\n\r\n")
+
+	out.WriteString("--" + boundary + "\r\n")
+	out.Write(entity.Bytes())
+	out.WriteString("\r\n--" + boundary + "\r\n")
+	out.WriteString("Content-Type: application/pkcs7-signature; name=\"smime.p7s\"\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-Disposition: attachment; filename=\"smime.p7s\"\r\n\r\n")
+	wc := base64.NewEncoder(base64.StdEncoding, newBase64LineWriter(out))
+	wc.Write(sig)
+	wc.Close()
+	out.WriteString("\r\n--" + boundary + "--\r\n")
+
+	return out.Bytes(), nil
+}
+
+// signature returns the DER encoded PKCS #7 detached signature of content.
+func (c *SMIMEConfig) signature(content []byte) ([]byte, error) {
+	if c.Certificate == nil || c.PrivateKey == nil {
+		return nil, errors.New("mailer: S/MIME certificate and private key must be set")
+	}
+
+	var sigAlgorithm pkcs7AlgorithmIdentifier
+	switch c.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		sigAlgorithm = pkcs7AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1Null}
+	case *ecdsa.PrivateKey:
+		sigAlgorithm = pkcs7AlgorithmIdentifier{Algorithm: oidECDSASHA256}
+	default:
+		return nil, fmt.Errorf("mailer: unsupported S/MIME private key type %T", c.PrivateKey)
+	}
+
+	digest := sha256.Sum256(content)
+	attrs, err := signedAttributes(digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// The signature covers the DER encoding of the attributes as a SET OF,
+	// while they are stored with an implicit [0] tag (RFC 5652, 5.4).
+	toSign, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(toSign)
+	sig, err := c.PrivateKey.Sign(rand.Reader, h[:], crypto.SHA256)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: could not sign email with S/MIME: %v", err)
+	}
+
+	var certs []byte
+	for _, cert := range append([]*x509.Certificate{c.Certificate}, c.Chain...) {
+		certs = append(certs, cert.Raw...)
+	}
+
+	sha256Algorithm := pkcs7AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1Null}
+	signedData, err := asn1.Marshal(pkcs7SignedData{
+		Version:          1,
+		DigestAlgorithms: []pkcs7AlgorithmIdentifier{sha256Algorithm},
+		ContentInfo:      pkcs7EncapsulatedContent{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: certs},
+		SignerInfos: []pkcs7SignerInfo{{
+			Version: 1,
+			IssuerAndSerial: pkcs7IssuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: c.Certificate.RawIssuer},
+				SerialNumber: c.Certificate.SerialNumber,
+			},
+			DigestAlgorithm:    sha256Algorithm,
+			SignedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: attrs},
+			SignatureAlgorithm: sigAlgorithm,
+			Signature:          sig,
+		}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return asn1.Marshal(pkcs7ContentInfo{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData},
+	})
+}
+
+// signedAttributes returns the DER encoded content type, signing time and
+// message digest attributes, sorted as required for a DER SET OF.
+func signedAttributes(digest []byte) ([]byte, error) {
+	values := []struct {
+		oid   asn1.ObjectIdentifier
+		value interface{}
+	}{
+		{oidContentType, oidData},
+		{oidSigningTime, now().UTC()},
+		{oidMessageDigest, digest},
+	}
+
+	encoded := make([][]byte, 0, len(values))
+	for _, v := range values {
+		value, err := asn1.Marshal(v.value)
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(pkcs7Attribute{
+			Type:   v.oid,
+			Values: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attr)
+	}
+
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
@@ -0,0 +1,141 @@
+package mailer
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSMIMESender(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	for _, key := range []crypto.Signer{rsaKey, ecKey} {
+		cert := testCertificate(t, key)
+
+		mem := &MemorySender{}
+		s := SMIMESender(mem, SMIMEConfig{Certificate: cert, PrivateKey: key})
+
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetHeader("Subject", "Signed")
+		m.SetBody("text/plain", "Test message")
+		m.AttachBytes("test.txt", []byte("Content"))
+		assert.NoError(t, Send(s, m))
+
+		msgs := mem.Messages()
+		assert.Len(t, msgs, 1)
+		parsed, err := msgs[0].Parse()
+		assert.NoError(t, err)
+		assert.Equal(t, "Signed", parsed.Header.Get("Subject"))
+
+		mediaType, params, err := mime.ParseMediaType(parsed.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		assert.Equal(t, "multipart/signed", mediaType)
+		assert.Equal(t, "application/pkcs7-signature", params["protocol"])
+		assert.Equal(t, "sha-256", params["micalg"])
+
+		content, sig := splitSigned(t, msgs[0].Data, params["boundary"])
+		assert.True(t, bytes.HasPrefix(content, []byte("Content-Type: multipart/mixed;")))
+		verifySMIME(t, cert, content, sig)
+	}
+}
+
+func TestSMIMESignErrors(t *testing.T) {
+	c := &SMIMEConfig{}
+	_, err := c.Sign([]byte("Subject: Test\r\n\r\nTest"))
+	assert.EqualError(t, err, "mailer: S/MIME certificate and private key must be set")
+}
+
+func testCertificate(t *testing.T, key crypto.Signer) *x509.Certificate {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "from@example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return cert
+}
+
+// splitSigned returns the signed content and the decoded signature of the
+// multipart/signed email msg.
+func splitSigned(t *testing.T, msg []byte, boundary string) (content, sig []byte) {
+	_, body := splitMessage(msg)
+	delimiter := []byte("--" + boundary + "\r\n")
+	assert.True(t, bytes.HasPrefix(body, delimiter))
+	end := bytes.Index(body, []byte("\r\n--"+boundary+"\r\n"))
+	content = body[len(delimiter):end]
+
+	r := multipart.NewReader(bytes.NewReader(body), boundary)
+	_, err := r.NextPart()
+	assert.NoError(t, err)
+	p, err := r.NextPart()
+	assert.NoError(t, err)
+	assert.Equal(t, "application/pkcs7-signature; name=\"smime.p7s\"", p.Header.Get("Content-Type"))
+	sig, err = ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, p))
+	assert.NoError(t, err)
+	return content, sig
+}
+
+func verifySMIME(t *testing.T, cert *x509.Certificate, content, sig []byte) {
+	var info pkcs7ContentInfo
+	_, err := asn1.Unmarshal(sig, &info)
+	assert.NoError(t, err)
+	assert.True(t, info.ContentType.Equal(oidSignedData))
+
+	var sd struct {
+		Version          int
+		DigestAlgorithms asn1.RawValue
+		ContentInfo      asn1.RawValue
+		Certificates     asn1.RawValue `asn1:"tag:0"`
+		SignerInfos      []struct {
+			Version            int
+			IssuerAndSerial    asn1.RawValue
+			DigestAlgorithm    asn1.RawValue
+			SignedAttributes   asn1.RawValue `asn1:"tag:0"`
+			SignatureAlgorithm asn1.RawValue
+			Signature          []byte
+		} `asn1:"set"`
+	}
+	_, err = asn1.Unmarshal(info.Content.Bytes, &sd)
+	assert.NoError(t, err)
+	assert.Equal(t, cert.Raw, sd.Certificates.Bytes)
+	assert.Len(t, sd.SignerInfos, 1)
+	si := sd.SignerInfos[0]
+
+	digest := sha256.Sum256(content)
+	assert.True(t, bytes.Contains(si.SignedAttributes.Bytes, digest[:]), "missing message digest")
+
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: si.SignedAttributes.Bytes})
+	assert.NoError(t, err)
+	algorithm := x509.SHA256WithRSA
+	if _, ok := cert.PublicKey.(*ecdsa.PublicKey); ok {
+		algorithm = x509.ECDSAWithSHA256
+	}
+	assert.NoError(t, cert.CheckSignature(algorithm, signed, si.Signature))
+}
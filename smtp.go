@@ -2,18 +2,28 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"net"
+	"net/mail"
 	"net/smtp"
+	"net/textproto"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-// A Dialer is a dialer to an SMTP server.
+// A Dialer is a dialer to an SMTP server. It is safe to call Dial from several
+// goroutines with the same Dialer as long as its fields are not modified, but a
+// SendCloser returned by Dial must only be used by one goroutine at a time.
 type (
 	Dialer struct {
 		// Host represents the host of the SMTP server.
@@ -24,6 +34,10 @@ type (
 		Username string
 		// Password is the password to use to authenticate to the SMTP server.
 		Password string
+		// Identity is the authorization identity sent with the PLAIN
+		// authentication mechanism, to act as another user than Username. It is
+		// usually left empty so the server derives it from Username.
+		Identity string
 		// Auth represents the authentication mechanism used to authenticate to the
 		// SMTP server.
 		Auth smtp.Auth
@@ -31,17 +45,139 @@ type (
 		// most cases since the authentication mechanism should use the STARTTLS
 		// extension instead.
 		SSL bool
+		// TLSPolicy defines whether the STARTTLS extension is used when SSL is
+		// false. By default, it is used when the server advertises it.
+		TLSPolicy TLSPolicy
 		// TSLConfig represents the TLS configuration used for the TLS (when the
-		// STARTTLS extension is used) or SSL connection.
+		// STARTTLS extension is used) or SSL connection. The certificate of the
+		// server is verified against Host when its ServerName is empty.
 		TLSConfig *tls.Config
 		// LocalName is the hostname sent to the SMTP server with the HELO command.
 		// By default, "localhost" is sent.
 		LocalName string
+		// DetectLocalName, if set and LocalName is empty, makes the Dialer send
+		// the fully qualified domain name of the machine with the HELO command
+		// instead of "localhost". Many spam filters penalize emails whose HELO
+		// name is not a real hostname resolving to the sending machine. The
+		// name is determined once with os.Hostname and DNS lookups of its
+		// addresses, "localhost" being still used if it cannot be found. The
+		// lookups are aborted after Timeout or when the context of the dial is
+		// done.
+		DetectLocalName bool
+		// Timeout is the maximum amount of time a dial to the SMTP server will
+		// wait for the TCP connection to be established. By default, 10 seconds.
+		Timeout time.Duration
+		// SendTimeout, if set, is the maximum amount of time allowed for the SMTP
+		// commands exchange. The deadline is applied to the connection once for
+		// the handshake done by Dial and again at the beginning of each email
+		// sent.
+		SendTimeout time.Duration
+		// AuthMechanism, if set, forces the SMTP AUTH mechanism used when Auth is
+		// nil instead of choosing one based on what the server advertises. The
+		// supported mechanisms are "SCRAM-SHA-256", "PLAIN", "LOGIN" and
+		// "CRAM-MD5". Dial returns an error if the server does not advertise it.
+		AuthMechanism string
+		// AllowPlaintextAuth allows authenticating to the SMTP server over a
+		// connection which is not encrypted, exposing the credentials to
+		// anyone on the network. By default, Dial returns an error instead of
+		// sending them unless the server is on the loopback interface.
+		AllowPlaintextAuth bool
+		// AuthPreference is the order in which the SMTP AUTH mechanisms are
+		// considered when Auth is nil and AuthMechanism is empty: the first one
+		// advertised by the server is used, PLAIN and LOGIN being skipped when
+		// the connection is not encrypted. By default, DefaultAuthPreference is
+		// used.
+		AuthPreference []string
+		// ProxyDialer, if set, is used to open the TCP connection to the SMTP
+		// server instead of dialing it directly, for example to go through a
+		// SOCKS5 proxy with the DialContext method of a golang.org/x/net/proxy
+		// dialer. The SSL or STARTTLS negotiation is still done by the Dialer on
+		// top of the returned connection. Timeout also applies to it.
+		ProxyDialer func(ctx context.Context, network, address string) (net.Conn, error)
+		// Hooks, if set, holds the callbacks called on the events of the SMTP
+		// sessions opened by the Dialer.
+		Hooks *Hooks
+		// Logger, if set, receives the debug logs of the connections to the
+		// server, the TLS negotiation and the authentication mechanism
+		// selection, and the warnings when they fail. Nothing is logged by
+		// default.
+		Logger *slog.Logger
+		// Chunking enables the CHUNKING extension (RFC 3030): when the server
+		// advertises it, emails are sent in chunks with BDAT commands instead
+		// of the DATA command, so their content is not dot-stuffed.
+		Chunking bool
+		// Pipelining enables the PIPELINING extension (RFC 2920): when the
+		// server advertises it, the MAIL and RCPT commands of an email are
+		// sent together before their replies are read. If the server answers
+		// the MAIL command that it is unknown or out of sequence, Send
+		// reconnects and sends the commands one at a time, for the rest of the
+		// connection.
+		Pipelining bool
+		// ContinueOnRcptError, if set, makes Send record the recipients
+		// rejected by the server instead of aborting the email, which is still
+		// sent to the accepted recipients. Send then returns a
+		// *RecipientsError listing the rejected recipients.
+		ContinueOnRcptError bool
+		// AutoSender, if set, makes Send add a "Sender" header with the
+		// address of Username to the *Message emails whose "From" address is a
+		// different one, as RFC 5322 requires when the author of an email is
+		// not the one sending it. It is only added once authenticated with a
+		// Username which is an email address and if the email has no "Sender"
+		// header yet.
+		AutoSender bool
+		// SeparateBcc, if set, makes Send deliver a *Message in several SMTP
+		// transactions: one to the To and Cc recipients and then one to each
+		// Bcc recipient, so a relay cannot disclose the Bcc recipients to the
+		// other recipients. With ContinueOnRcptError, the returned
+		// *RecipientsError covers all the transactions.
+		SeparateBcc bool
+		// MaxRecipients, if positive, is the maximum number of recipients of
+		// an SMTP transaction, as many providers limit it. All the envelope
+		// recipients count, which for a *Message are the To, Cc and Bcc
+		// addresses; with SeparateBcc, each transaction is checked on its own
+		// so only the To and Cc addresses count. Send fails before sending
+		// anything when an email has too many recipients, unless
+		// SplitRecipients is set.
+		MaxRecipients int
+		// SplitRecipients makes Send deliver an email having more than
+		// MaxRecipients recipients in several transactions over the same
+		// connection, each one to at most MaxRecipients of them in order.
+		SplitRecipients bool
+		// MaxMessageSize, if positive, is the maximum size in bytes of the
+		// emails sent. The limit advertised by the server with the SIZE
+		// extension is enforced even if MaxMessageSize is not set, and the
+		// size is then declared in the MAIL command, so Send fails before
+		// transmitting an email which would be rejected. The size is only
+		// known once the email is rendered, so each email is then rendered in
+		// memory before being sent.
+		MaxMessageSize int64
 	}
 
+	// RecipientsError is returned by Send when Dialer.ContinueOnRcptError is
+	// set and the server rejected some recipients. The email was sent to the
+	// Accepted recipients, if any.
+	RecipientsError struct {
+		// Accepted holds the recipients accepted by the server.
+		Accepted []string
+		// Rejected maps each rejected recipient to the error answered by the
+		// server.
+		Rejected map[string]error
+	}
+
+	// TLSPolicy defines how a Dialer uses the STARTTLS extension.
+	TLSPolicy int
+
 	smtpSender struct {
 		smtpClient
-		d *Dialer
+		d    *Dialer
+		conn net.Conn
+		ctx  context.Context
+		stop func()
+		used bool
+		// username is the username authenticated on the connection.
+		username string
+		// noPipelining is set once pipelining failed on the connection.
+		noPipelining bool
 	}
 
 	smtpClient interface {
@@ -52,158 +188,1258 @@ type (
 		Mail(string) error
 		Rcpt(string) error
 		Data() (io.WriteCloser, error)
+		Reset() error
 		Quit() error
 		Close() error
 	}
 
+	// tlsStater is implemented by the smtpClient reporting the TLS state of
+	// its connection.
+	tlsStater interface {
+		TLSConnectionState() (tls.ConnectionState, bool)
+	}
+
+	// textClient is implemented by the smtpClient giving access to the
+	// underlying text protocol connection, used for the commands net/smtp does
+	// not support.
+	textClient interface {
+		text() *textproto.Conn
+	}
+
+	netSMTPClient struct {
+		*smtp.Client
+	}
+
+	bdatWriter struct {
+		text *textproto.Conn
+		buf  []byte
+		err  error
+	}
+
 	loginAuth struct {
 		username string
 		password string
 		host     string
 	}
+
+	xoauth2Auth struct {
+		username    string
+		accessToken string
+	}
 )
 
 var (
-	netDialTimeout = net.DialTimeout
-	tlsClient      = tls.Client
-	smtpNewClient  = func(conn net.Conn, host string) (smtpClient, error) {
-		return smtp.NewClient(conn, host)
+	sleep          = time.Sleep
+	netDialTimeout = func(ctx context.Context, network, address string, timeout time.Duration) (net.Conn, error) {
+		d := &net.Dialer{Timeout: timeout}
+		return d.DialContext(ctx, network, address)
 	}
+	tlsClient     = tls.Client
+	tlsHandshake  = (*tls.Conn).Handshake
+	smtpNewClient = newSMTPClient
+	osHostname    = os.Hostname
+	lookupHost    = net.DefaultResolver.LookupHost
+	lookupAddr    = net.DefaultResolver.LookupAddr
+
+	localFQDNMu       sync.Mutex
+	localFQDNName     string
+	localFQDNDetected bool
+)
+
+// DefaultAuthPreference is the order in which the SMTP AUTH mechanisms are
+// chosen by default, see Dialer.AuthPreference. SCRAM-SHA-256 never reveals
+// the password, even on a connection which is not encrypted, and PLAIN over
+// TLS is preferred to CRAM-MD5, which relies on MD5 and requires the server to
+// store the password.
+var DefaultAuthPreference = []string{"SCRAM-SHA-256", "PLAIN", "CRAM-MD5", "LOGIN"}
+
+const (
+	// TLSOpportunistic uses STARTTLS when the server advertises it and
+	// continues in cleartext otherwise.
+	TLSOpportunistic TLSPolicy = iota
+	// TLSMandatory requires STARTTLS: Dial returns an error and closes the
+	// connection if the server does not advertise it, before any credentials
+	// or email is sent.
+	TLSMandatory
+	// NoTLS never uses STARTTLS, even if the server advertises it.
+	NoTLS
 )
 
+// discardLogger is the logger used when Dialer.Logger is not set.
+var discardLogger = slog.New(discardHandler{})
+
+// discardHandler is a slog.Handler discarding all the records.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
+
+// bdatChunkSize is the size of the BDAT chunks sent when Dialer.Chunking is
+// set.
+const bdatChunkSize = 64 * 1024
+
 // NewDialer returns a new SMTP Dialer.
 // The given parameters are used to connect to the SMTP server.
+//
+// NewDialer calls log.Fatal if Config has not been initialized, use NewDialerE
+// to get an error instead.
 func NewDialer() *Dialer {
-	if Config == nil {
-		log.Fatal("please define smtp config")
-
-		return nil
+	d, err := NewDialerE()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	d := &Dialer{
-		Host:     Config.Host,
-		Username: Config.Username,
-		Password: Config.Password,
-		Port:     Config.Port,
-		SSL:      Config.Port == 465,
+	return d
+}
+
+// NewDialerE returns a new SMTP Dialer using the credentials from Config.
+// It returns an error if Config has not been initialized via New.
+func NewDialerE() (*Dialer, error) {
+	if Config == nil {
+		return nil, errors.New("mailer: Config must be initialized via mailer.New before dialing")
 	}
 
-	return d
+	return NewDialerFromConfig(*Config), nil
+}
+
+// NewDialerFromConfig returns a new SMTP Dialer using the credentials from cfg
+// instead of the global Config, so several Dialers connecting to different SMTP
+// servers can be used in the same program.
+func NewDialerFromConfig(cfg ConfigMailer) *Dialer {
+	return &Dialer{
+		Host:     cfg.Host,
+		Identity: cfg.Identity,
+		Username: cfg.Username,
+		Password: cfg.Password,
+		Port:     cfg.Port,
+		SSL:      cfg.Port == 465,
+	}
 }
 
 // Dial dials and authenticates to an SMTP server. The returned SendCloser
 // should be closed when done using it.
+//
+// The returned SendCloser can be used to send many emails over the same
+// connection, an RSET command is issued between emails to reset the
+// transaction state. Servers usually close connections left idle for a few
+// minutes, in that case the next Send reconnects transparently.
 func (d *Dialer) Dial() (SendCloser, error) {
-	conn, err := netDialTimeout("tcp", addr(d.Host, d.Port), 10*time.Second)
+	return d.DialContext(context.Background())
+}
+
+// DialContext is like Dial but uses the given context for the lifetime of the
+// connection: if ctx is cancelled or expires, the connection to the SMTP server
+// is closed and any pending command fails.
+func (d *Dialer) DialContext(ctx context.Context) (SendCloser, error) {
+	s, err := d.dialContext(ctx)
+	if err != nil {
+		d.Hooks.error(err)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Ping connects to the SMTP server, negotiates TLS and authenticates like Dial,
+// then closes the connection without sending any email. It can be used to
+// check the connectivity and the credentials when a program starts or in a
+// readiness probe.
+func (d *Dialer) Ping() error {
+	return d.PingContext(context.Background())
+}
+
+// PingContext is like Ping but uses the given context like DialContext.
+func (d *Dialer) PingContext(ctx context.Context) error {
+	s, err := d.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	return s.Close()
+}
+
+func (d *Dialer) dialContext(ctx context.Context) (*smtpSender, error) {
+	address := addr(d.Host, d.Port)
+	d.logger().Debug("connecting to SMTP server", "addr", address, "proxy", d.ProxyDialer != nil)
+	start := d.Hooks.start()
+	conn, err := d.dial(ctx)
+	d.Hooks.connect(address, start, err)
+	if err != nil {
+		d.logger().Warn("could not connect to SMTP server", "addr", address, "error", err)
+		return nil, err
+	}
+
+	stop := closeOnDone(ctx, conn)
+	if err := d.setDeadline(conn); err != nil {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+
+	s, err := d.handshake(ctx, conn)
 	if err != nil {
+		stop()
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
 		return nil, err
 	}
 
+	s.conn = conn
+	s.ctx = ctx
+	s.stop = stop
+	return s, nil
+}
+
+func (d *Dialer) dial(ctx context.Context) (net.Conn, error) {
+	if d.ProxyDialer == nil {
+		return netDialTimeout(ctx, "tcp", addr(d.Host, d.Port), d.timeout())
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, d.timeout())
+	defer cancel()
+	return d.ProxyDialer(ctx, "tcp", addr(d.Host, d.Port))
+}
+
+// logger returns the Logger of d or a logger discarding everything.
+func (d *Dialer) logger() *slog.Logger {
+	if d.Logger == nil {
+		return discardLogger
+	}
+	return d.Logger
+}
+
+func (d *Dialer) timeout() time.Duration {
+	if d.Timeout == 0 {
+		return 10 * time.Second
+	}
+	return d.Timeout
+}
+
+func (d *Dialer) setDeadline(conn net.Conn) error {
+	if d.SendTimeout <= 0 {
+		return nil
+	}
+	return conn.SetDeadline(time.Now().Add(d.SendTimeout))
+}
+
+func (d *Dialer) handshake(ctx context.Context, conn net.Conn) (*smtpSender, error) {
 	if d.SSL {
-		conn = tlsClient(conn, d.tlsConfig())
+		d.logger().Debug("using implicit TLS", "host", d.Host)
+		// The handshake is done right away, instead of on the first read of
+		// the SMTP client, so that a certificate which cannot be verified is
+		// reported clearly.
+		tlsConn := tlsClient(conn, d.tlsConfig())
+		if err := tlsHandshake(tlsConn); err != nil {
+			d.logger().Warn("TLS handshake failed", "host", d.Host, "error", err)
+			conn.Close()
+			return nil, fmt.Errorf("mailer: TLS handshake with %s failed: %w", d.Host, err)
+		}
+		conn = tlsConn
 	}
 
 	c, err := smtpNewClient(conn, d.Host)
 	if err != nil {
+		d.logger().Warn("SMTP session could not be started", "host", d.Host, "error", err)
 		return nil, err
 	}
 
-	if d.LocalName != "" {
-		if err := c.Hello(d.LocalName); err != nil {
+	localName := d.LocalName
+	if localName == "" && d.DetectLocalName {
+		// The lookups are bounded like the dial, which they delay.
+		lookupCtx, cancel := context.WithTimeout(ctx, d.timeout())
+		localName = localFQDN(lookupCtx)
+		cancel()
+		d.logger().Debug("detected local name", "name", localName)
+	}
+	if localName != "" {
+		if err := c.Hello(localName); err != nil {
 			return nil, err
 		}
 	}
 
-	if !d.SSL {
+	encrypted := d.SSL
+	if !d.SSL && d.TLSPolicy != NoTLS {
 		if ok, _ := c.Extension("STARTTLS"); ok {
+			d.logger().Debug("starting TLS", "host", d.Host)
 			if err := c.StartTLS(d.tlsConfig()); err != nil {
+				d.logger().Warn("STARTTLS failed", "host", d.Host, "error", err)
 				c.Close()
 				return nil, err
 			}
+			encrypted = true
+			if ts, ok := c.(tlsStater); ok {
+				state, ok := ts.TLSConnectionState()
+				encrypted = ok && state.HandshakeComplete
+			}
+		} else if d.TLSPolicy == TLSMandatory {
+			c.Close()
+			return nil, errors.New("mailer: the server does not support STARTTLS, required by the TLS policy")
+		} else {
+			d.logger().Warn("server does not support STARTTLS, continuing without TLS", "host", d.Host)
 		}
 	}
 
-	if d.Auth == nil && d.Username != "" {
+	// The Dialer may be shared by several goroutines so the negotiated
+	// mechanism is kept in a local variable instead of being stored in d.
+	auth := d.Auth
+	if a, ok := auth.(*scramAuth); ok {
+		// The state of a SCRAM exchange must not be shared either.
+		auth = SCRAMSHA256Auth(a.username, a.password)
+	}
+	if auth == nil && d.Username != "" && d.AuthMechanism != "" {
+		if auth, err = d.newAuth(d.AuthMechanism); err != nil {
+			c.Close()
+			return nil, err
+		}
+		if ok, auths := c.Extension("AUTH"); !ok || !hasMechanism(auths, d.AuthMechanism) {
+			c.Close()
+			return nil, fmt.Errorf("mailer: the server does not support %s authentication", d.AuthMechanism)
+		}
+		d.logger().Debug("using configured auth mechanism", "mechanism", d.AuthMechanism)
+	}
+
+	if auth == nil && d.Username != "" {
 		if ok, auths := c.Extension("AUTH"); ok {
-			if strings.Contains(auths, "CRAM-MD5") {
-				d.Auth = smtp.CRAMMD5Auth(d.Username, d.Password)
-			} else if strings.Contains(auths, "LOGIN") &&
-				!strings.Contains(auths, "PLAIN") {
-				d.Auth = &loginAuth{
-					username: d.Username,
-					password: d.Password,
-					host:     d.Host,
-				}
-			} else {
-				d.Auth = smtp.PlainAuth("", d.Username, d.Password, d.Host)
+			mechanism := d.selectMechanism(auths, encrypted)
+			d.logger().Debug("selected auth mechanism", "mechanism", mechanism, "advertised", auths)
+			if auth, err = d.newAuth(mechanism); err != nil {
+				c.Close()
+				return nil, err
 			}
+		} else {
+			d.logger().Warn("server does not support AUTH, continuing without authentication", "host", d.Host)
 		}
 	}
 
-	if d.Auth != nil {
-		if err = c.Auth(d.Auth); err != nil {
+	if _, ok := auth.(*xoauth2Auth); ok {
+		if ok, auths := c.Extension("AUTH"); !ok || !hasMechanism(auths, "XOAUTH2") {
+			c.Close()
+			return nil, errors.New("mailer: the server does not support XOAUTH2 authentication")
+		}
+	}
+
+	if auth != nil && !encrypted && !d.AllowPlaintextAuth && !isLoopback(d.Host) {
+		d.logger().Warn("refusing to authenticate without TLS", "host", d.Host)
+		c.Close()
+		return nil, errors.New("mailer: refusing to authenticate over a connection which is not encrypted, see Dialer.AllowPlaintextAuth")
+	}
+
+	if auth != nil {
+		start := d.Hooks.start()
+		err = c.Auth(auth)
+		d.Hooks.auth(d.Username, start, err)
+		if err != nil {
+			d.logger().Warn("authentication failed", "username", d.Username, "error", err)
 			c.Close()
 			return nil, err
 		}
 	}
 
-	return &smtpSender{c, d}, nil
+	s := &smtpSender{smtpClient: c, d: d}
+	if auth != nil {
+		s.username = d.Username
+	}
+	return s, nil
+}
+
+// isLoopback reports whether host designates the local machine, like
+// net/smtp does to allow PLAIN authentication without TLS.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// localFQDN returns the fully qualified domain name of the machine, see
+// Dialer.DetectLocalName. It is only detected once, unless ctx is done before
+// the lookups end.
+func localFQDN(ctx context.Context) string {
+	localFQDNMu.Lock()
+	defer localFQDNMu.Unlock()
+	if !localFQDNDetected {
+		localFQDNName = detectFQDN(ctx)
+		localFQDNDetected = ctx.Err() == nil
+	}
+	return localFQDNName
+}
+
+// detectFQDN looks up the name of the addresses of the hostname of the machine
+// to find its fully qualified domain name.
+func detectFQDN(ctx context.Context) string {
+	hostname, err := osHostname()
+	if err != nil || hostname == "" {
+		return "localhost"
+	}
+
+	if addrs, err := lookupHost(ctx, hostname); err == nil {
+		for _, a := range addrs {
+			names, err := lookupAddr(ctx, a)
+			if err != nil {
+				continue
+			}
+			for _, name := range names {
+				name = strings.TrimSuffix(name, ".")
+				if strings.Contains(name, ".") && !strings.HasPrefix(name, "localhost") {
+					return name
+				}
+			}
+		}
+	}
+
+	if strings.Contains(hostname, ".") {
+		return hostname
+	}
+	return "localhost"
+}
+
+// selectMechanism returns the first mechanism of the AuthPreference of d
+// listed in auths. PLAIN and LOGIN, which send the password in clear, are only
+// chosen on a connection which is not encrypted if no other mechanism is
+// advertised. PLAIN is the fallback.
+func (d *Dialer) selectMechanism(auths string, encrypted bool) string {
+	preference := d.AuthPreference
+	if preference == nil {
+		preference = DefaultAuthPreference
+	}
+
+	fallback := ""
+	for _, m := range preference {
+		if !hasMechanism(auths, m) {
+			continue
+		}
+		if encrypted || !strings.EqualFold(m, "PLAIN") && !strings.EqualFold(m, "LOGIN") {
+			return m
+		}
+		if fallback == "" {
+			fallback = m
+		}
+	}
+	if fallback == "" {
+		return "PLAIN"
+	}
+	return fallback
+}
+
+// newAuth returns the smtp.Auth implementing the given SASL mechanism with the
+// credentials of d.
+func (d *Dialer) newAuth(mechanism string) (smtp.Auth, error) {
+	switch strings.ToUpper(mechanism) {
+	case "PLAIN":
+		return smtp.PlainAuth(d.Identity, d.Username, d.Password, d.Host), nil
+	case "LOGIN":
+		return &loginAuth{
+			username: d.Username,
+			password: d.Password,
+			host:     d.Host,
+		}, nil
+	case "CRAM-MD5":
+		return smtp.CRAMMD5Auth(d.Username, d.Password), nil
+	case "SCRAM-SHA-256":
+		return SCRAMSHA256Auth(d.Username, d.Password), nil
+	}
+
+	return nil, fmt.Errorf("mailer: unsupported authentication mechanism %q", mechanism)
+}
+
+// hasMechanism reports whether mechanism is listed in auths, the parameters
+// of the AUTH extension advertised by the server.
+func hasMechanism(auths, mechanism string) bool {
+	for _, m := range strings.Fields(auths) {
+		if strings.EqualFold(m, mechanism) {
+			return true
+		}
+	}
+	return false
 }
 
+// tlsConfig returns the TLS configuration of d. The certificate of the server
+// is verified against Host unless TLSConfig sets another ServerName.
 func (d *Dialer) tlsConfig() *tls.Config {
 	if d.TLSConfig == nil {
 		return &tls.Config{ServerName: d.Host}
 	}
+	if d.TLSConfig.ServerName == "" {
+		config := d.TLSConfig.Clone()
+		config.ServerName = d.Host
+		return config
+	}
 	return d.TLSConfig
 }
 
 // DialAndSend opens a connection to the SMTP server, sends the given emails and
 // closes the connection.
 func (d *Dialer) DialAndSend(m ...*Message) error {
-	s, err := d.Dial()
+	return d.DialAndSendContext(context.Background(), m...)
+}
+
+// DialAndSendContext is like DialAndSend but aborts the SMTP conversation and
+// closes the connection if ctx is cancelled or expires before all the emails
+// are sent. In that case the context error is returned.
+func (d *Dialer) DialAndSendContext(ctx context.Context, m ...*Message) error {
+	s, err := d.DialContext(ctx)
 	if err != nil {
 		return err
 	}
 	defer s.Close()
 
-	return Send(s, m...)
+	if err := Send(s, m...); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		return err
+	}
+
+	return nil
 }
 
-func (c *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
-	if err := c.Mail(from); err != nil {
-		if err == io.EOF {
-			// This is probably due to a timeout, so reconnect and try again.
-			sc, derr := c.d.Dial()
-			if derr == nil {
-				if sx, ok := sc.(*smtpSender); ok {
-					*c = *sx
-					return c.Send(from, to, msg)
-				}
+// DialAndSendWithRetry is like DialAndSend but retries up to attempts times
+// when the connection fails or the server answers with a temporary (4xx)
+// error, typically because of greylisting. The delay between two attempts
+// starts at backoff and doubles after each attempt. Permanent (5xx) errors are
+// not retried. Emails that were already sent are not sent again.
+//
+// The returned error wraps the last failure.
+func (d *Dialer) DialAndSendWithRetry(attempts int, backoff time.Duration, m ...*Message) error {
+	sent := 0
+	for i := 1; ; i++ {
+		n, err := d.dialAndSend(m[sent:])
+		sent += n
+		if err == nil {
+			return nil
+		}
+		if !isTemporary(err) || i >= attempts {
+			return fmt.Errorf("mailer: could not send email %d after %d attempt(s): %w", sent+1, i, err)
+		}
+
+		sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// SendConcurrent sends msgs using up to workers connections opened with d in
+// parallel. Each connection is reused for several emails and is opened again
+// when sending an email fails because of a connection error.
+//
+// The order in which the emails are sent is not specified but the returned
+// slice is aligned with msgs: the error at index i, if not nil, is the error
+// returned when sending msgs[i].
+func SendConcurrent(d *Dialer, workers int, msgs []*Message) []error {
+	errs := make([]error, len(msgs))
+	if workers > len(msgs) {
+		workers = len(msgs)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			d.sendWorker(jobs, msgs, errs)
+		}()
+	}
+
+	for i := range msgs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return errs
+}
+
+// sendWorker sends the emails whose indexes are received from jobs.
+func (d *Dialer) sendWorker(jobs <-chan int, msgs []*Message, errs []error) {
+	var s SendCloser
+	defer func() {
+		if s != nil {
+			s.Close()
+		}
+	}()
+
+	for i := range jobs {
+		if s == nil {
+			var err error
+			if s, err = d.Dial(); err != nil {
+				errs[i] = fmt.Errorf("mailer: could not send email %d: %w", i+1, err)
+				continue
 			}
 		}
+
+		if err := send(s, msgs[i]); err != nil {
+			errs[i] = fmt.Errorf("mailer: could not send email %d: %w", i+1, err)
+
+			// The connection is still usable after an error answered by the
+			// server.
+			var protoErr *textproto.Error
+			var rcptErr *RecipientsError
+			if !errors.As(err, &protoErr) && !errors.As(err, &rcptErr) {
+				s.Close()
+				s = nil
+			}
+		}
+	}
+}
+
+// dialAndSend is like DialAndSend but reports how many emails were sent.
+func (d *Dialer) dialAndSend(m []*Message) (int, error) {
+	s, err := d.Dial()
+	if err != nil {
+		return 0, err
+	}
+	defer s.Close()
+
+	for i, msg := range m {
+		if err := send(s, msg); err != nil {
+			return i, err
+		}
+	}
+
+	return len(m), nil
+}
+
+// isTemporary reports whether err is a connection error or a temporary SMTP
+// error which may succeed if the email is sent again later.
+func isTemporary(err error) bool {
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 400 && protoErr.Code < 500
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// closeOnDone closes conn as soon as ctx is done. The returned function stops
+// watching ctx and must be called once conn is no longer in use.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+func (c *smtpSender) Send(from string, to []string, msg io.WriterTo) error {
+	if c.d.AutoSender {
+		msg = c.addSender(msg)
+	}
+	err := c.sendGroups(from, to, msg)
+	c.d.Hooks.error(err)
+	return err
+}
+
+// addSender returns a copy of msg with a "Sender" header holding the
+// authenticated address if msg is a *Message needing it, see AutoSender, and
+// msg otherwise.
+func (c *smtpSender) addSender(msg io.WriterTo) io.WriterTo {
+	m, ok := msg.(*Message)
+	if !ok || c.username == "" || len(m.header["Sender"]) > 0 {
+		return msg
+	}
+	sender, err := mail.ParseAddress(c.username)
+	if err != nil {
+		return msg
+	}
+	for _, field := range m.header["From"] {
+		if addr, err := parseAddress(field); err == nil && strings.EqualFold(addr, sender.Address) {
+			return msg
+		}
+	}
+
+	m = m.Clone()
+	m.header["Sender"] = []string{sender.Address}
+	return m
+}
+
+// sendGroups sends msg once to each group of recipients returned by
+// recipientGroups.
+func (c *smtpSender) sendGroups(from string, to []string, msg io.WriterTo) error {
+	groups, err := c.recipientGroups(to, msg)
+	if err != nil {
 		return err
 	}
+	if len(groups) == 1 {
+		return c.send(from, groups[0], msg)
+	}
+
+	var rcptErr *RecipientsError
+	for _, group := range groups {
+		err := c.send(from, group, msg)
+		var e *RecipientsError
+		switch {
+		case errors.As(err, &e):
+			rcptErr = rcptErr.merge(e)
+		case err != nil:
+			return err
+		case c.d.ContinueOnRcptError:
+			for _, addr := range group {
+				rcptErr = rcptErr.add(addr, nil)
+			}
+		}
+	}
+	if rcptErr != nil && len(rcptErr.Rejected) > 0 {
+		return rcptErr
+	}
+	return nil
+}
 
+// recipientGroups splits to into the groups of recipients receiving msg in
+// the same transaction. There is a single group unless SeparateBcc is set, in
+// which case the Bcc recipients of msg each have their own group, or unless
+// a group has more than MaxRecipients recipients with SplitRecipients set.
+func (c *smtpSender) recipientGroups(to []string, msg io.WriterTo) ([][]string, error) {
+	groups, err := c.bccGroups(to, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	limit := c.d.MaxRecipients
+	if limit <= 0 {
+		return groups, nil
+	}
+	var split [][]string
+	for _, group := range groups {
+		if len(group) > limit && !c.d.SplitRecipients {
+			return nil, fmt.Errorf("mailer: the email has %d recipients, more than the %d allowed in a transaction by Dialer.MaxRecipients", len(group), limit)
+		}
+		for len(group) > limit {
+			split = append(split, group[:limit])
+			group = group[limit:]
+		}
+		split = append(split, group)
+	}
+	return split, nil
+}
+
+// bccGroups returns to in a single group, or with a group for each Bcc
+// recipient of msg if SeparateBcc is set.
+func (c *smtpSender) bccGroups(to []string, msg io.WriterTo) ([][]string, error) {
+	m, ok := msg.(*Message)
+	if !c.d.SeparateBcc || !ok {
+		return [][]string{to}, nil
+	}
+	bcc, err := m.bccRecipients()
+	if err != nil {
+		return nil, err
+	}
+
+	var visible []string
+	var groups [][]string
 	for _, addr := range to {
-		if err := c.Rcpt(addr); err != nil {
+		if hasAddress(bcc, addr) {
+			groups = append(groups, []string{addr})
+		} else {
+			visible = append(visible, addr)
+		}
+	}
+	if len(visible) > 0 || len(groups) == 0 {
+		groups = append([][]string{visible}, groups...)
+	}
+	return groups, nil
+}
+
+func (c *smtpSender) send(from string, to []string, msg io.WriterTo) error {
+	if err := c.d.setDeadline(c.conn); err != nil {
+		return err
+	}
+
+	if c.used {
+		// Reset the transaction state left by the previous email before
+		// starting a new one on the same connection.
+		if err := c.Reset(); err != nil {
+			if err == io.EOF && c.reconnect() {
+				return c.send(from, to, msg)
+			}
 			return err
 		}
 	}
+	c.used = true
+
+	// net/smtp adds the SMTPUTF8 parameter to the MAIL command when the server
+	// supports it, but internationalized addresses must not be sent to a server
+	// which does not.
+	if needsSMTPUTF8(from, to) {
+		if ok, _ := c.Extension("SMTPUTF8"); !ok {
+			return errors.New("mailer: the server does not support SMTPUTF8, required to send to or from an internationalized address")
+		}
+	}
+
+	// The DSN parameters are read from msg before it is replaced by its
+	// rendering, which the retries below send as is.
+	dsn := c.dsn(msg)
+	var size int64
+	if limit := c.sizeLimit(); limit > 0 {
+		b, err := checkSize(msg, limit)
+		if err != nil {
+			return err
+		}
+		msg, size = rawMessage(b), int64(len(b))
+	}
+	return c.transmit(from, to, msg, dsn, size)
+}
+
+// transmit sends the envelope and the content of msg, which is sent again on
+// a new connection if the server closed this one or rejected pipelining.
+func (c *smtpSender) transmit(from string, to []string, msg io.WriterTo, dsn *dsnRequest, size int64) error {
+	start := c.d.Hooks.start()
+	var err error
+	var rcptErrs []error
+	if c.pipelining() {
+		var rejected bool
+		err, rcptErrs, rejected = c.pipelineEnvelope(from, to, dsn, size)
+		if rejected && c.fallBackFromPipelining() {
+			return c.retransmit(from, to, msg, dsn, size)
+		}
+	} else {
+		err = c.mail(from, dsn, size)
+	}
+	c.d.Hooks.mailFrom(from, start, err)
+	if err != nil {
+		// This is probably due to a timeout, so reconnect and try again.
+		if err == io.EOF && c.reconnect() {
+			return c.retransmit(from, to, msg, dsn, size)
+		}
+		return err
+	}
+
+	var rcptErr *RecipientsError
+	for i, addr := range to {
+		var err error
+		if rcptErrs != nil {
+			err = rcptErrs[i]
+		} else {
+			start = c.d.Hooks.start()
+			err = c.rcpt(addr, dsn)
+		}
+		c.d.Hooks.rcptTo(addr, start, err)
+		var protoErr *textproto.Error
+		if c.d.ContinueOnRcptError && (err == nil || errors.As(err, &protoErr)) {
+			rcptErr = rcptErr.add(addr, err)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if rcptErr != nil && len(rcptErr.Accepted) == 0 {
+		return rcptErr
+	}
 
-	w, err := c.Data()
+	start = c.d.Hooks.start()
+	n, err := c.writeData(msg)
+	c.d.Hooks.data(n, start, err)
 	if err != nil {
 		return err
 	}
+	if rcptErr != nil && len(rcptErr.Rejected) > 0 {
+		return rcptErr
+	}
+	return nil
+}
 
-	if _, err = msg.WriteTo(w); err != nil {
+// retransmit sends msg on the new connection opened by reconnect.
+func (c *smtpSender) retransmit(from string, to []string, msg io.WriterTo, dsn *dsnRequest, size int64) error {
+	if err := c.d.setDeadline(c.conn); err != nil {
+		return err
+	}
+	c.used = true
+	return c.transmit(from, to, msg, dsn, size)
+}
+
+// add records the result of the RCPT command for addr and returns e, which is
+// allocated if nil.
+func (e *RecipientsError) add(addr string, err error) *RecipientsError {
+	if e == nil {
+		e = &RecipientsError{}
+	}
+	if err == nil {
+		e.Accepted = append(e.Accepted, addr)
+		return e
+	}
+	if e.Rejected == nil {
+		e.Rejected = make(map[string]error)
+	}
+	e.Rejected[addr] = err
+	return e
+}
+
+// merge adds the results recorded in other to e and returns e, which is
+// allocated if nil.
+func (e *RecipientsError) merge(other *RecipientsError) *RecipientsError {
+	for _, addr := range other.Accepted {
+		e = e.add(addr, nil)
+	}
+	for addr, err := range other.Rejected {
+		e = e.add(addr, err)
+	}
+	return e
+}
+
+func (e *RecipientsError) Error() string {
+	addrs := make([]string, 0, len(e.Rejected))
+	for addr := range e.Rejected {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	msgs := make([]string, len(addrs))
+	for i, addr := range addrs {
+		msgs[i] = fmt.Sprintf("%s: %v", addr, e.Rejected[addr])
+	}
+	return fmt.Sprintf("mailer: %d recipient(s) rejected: %s", len(addrs), strings.Join(msgs, "; "))
+}
+
+// writeData sends the content of msg and returns the number of bytes written.
+func (c *smtpSender) writeData(msg io.WriterTo) (int64, error) {
+	w, err := c.data()
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := msg.WriteTo(w)
+	if err != nil {
 		w.Close()
+		return n, err
+	}
+
+	return n, w.Close()
+}
+
+// dsn returns the delivery status notification request of msg, or nil if there
+// is none or if the server does not support it.
+func (c *smtpSender) dsn(msg io.WriterTo) *dsnRequest {
+	m, ok := msg.(*Message)
+	if !ok || m.dsn == nil {
+		return nil
+	}
+	if _, ok := c.smtpClient.(textClient); !ok {
+		return nil
+	}
+	if ok, _ := c.Extension("DSN"); !ok {
+		return nil
+	}
+	return m.dsn
+}
+
+// mail sends the MAIL command, with the DSN parameters if dsn is not nil and
+// the SIZE parameter if size is positive and the server supports it. net/smtp
+// does not support them so the command is then sent directly, along with the
+// parameters net/smtp would have added.
+func (c *smtpSender) mail(from string, dsn *dsnRequest, size int64) error {
+	if _, ok := c.smtpClient.(textClient); !ok || (dsn == nil && size <= 0) {
+		return c.Mail(from)
+	}
+	return c.cmd(250, "MAIL FROM:<%s>%s", from, c.mailParams(dsn, size))
+}
+
+// mailParams returns the parameters of the MAIL command sent by mail.
+func (c *smtpSender) mailParams(dsn *dsnRequest, size int64) string {
+	var params string
+	if ok, _ := c.Extension("SIZE"); ok && size > 0 {
+		params += fmt.Sprintf(" SIZE=%d", size)
+	}
+	if dsn != nil {
+		params += dsn.mailParams()
+	}
+
+	if ok, _ := c.Extension("SMTPUTF8"); ok {
+		params = " SMTPUTF8" + params
+	}
+	if ok, _ := c.Extension("8BITMIME"); ok {
+		params = " BODY=8BITMIME" + params
+	}
+	return params
+}
+
+// pipelining reports whether the MAIL and RCPT commands are pipelined.
+func (c *smtpSender) pipelining() bool {
+	if !c.d.Pipelining || c.noPipelining {
+		return false
+	}
+	if _, ok := c.smtpClient.(textClient); !ok {
+		return false
+	}
+	ok, _ := c.Extension("PIPELINING")
+	return ok
+}
+
+// pipelineEnvelope sends the MAIL command and the RCPT commands of to without
+// waiting for the replies, as allowed by the PIPELINING extension (RFC 2920),
+// and then reads all the replies. It returns the error answered to the MAIL
+// command and, if it succeeded, to each RCPT command. rejected reports whether
+// the server answered the MAIL command that it is unknown or out of sequence,
+// in which case the commands should be sent again without pipelining.
+func (c *smtpSender) pipelineEnvelope(from string, to []string, dsn *dsnRequest, size int64) (mailErr error, rcptErrs []error, rejected bool) {
+	lines := []string{fmt.Sprintf("MAIL FROM:<%s>%s", from, c.mailParams(dsn, size))}
+	for _, addr := range to {
+		var params string
+		if dsn != nil {
+			params = dsn.rcptParams(addr)
+		}
+		lines = append(lines, fmt.Sprintf("RCPT TO:<%s>%s", addr, params))
+	}
+
+	text := c.smtpClient.(textClient).text()
+	ids := make([]uint, len(lines))
+	for i, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return errors.New("mailer: a line must not contain CR or LF"), nil, false
+		}
+		var err error
+		if ids[i], err = text.Cmd("%s", line); err != nil {
+			return err, nil, false
+		}
+	}
+
+	errs := make([]error, len(lines))
+	for i, id := range ids {
+		code := 25
+		if i == 0 {
+			code = 250
+		}
+		text.StartResponse(id)
+		_, _, errs[i] = text.ReadResponse(code)
+		text.EndResponse(id)
+
+		var protoErr *textproto.Error
+		switch {
+		case i == 0 && errors.As(errs[0], &protoErr):
+			if protoErr.Code == 500 || protoErr.Code == 503 {
+				return errs[0], nil, true
+			}
+		case errs[i] != nil && !errors.As(errs[i], &protoErr):
+			// The connection failed, the following replies cannot be read.
+			if i == 0 {
+				return errs[0], nil, false
+			}
+			for j := i + 1; j < len(errs); j++ {
+				errs[j] = errs[i]
+			}
+			return errs[0], errs[1:], false
+		}
+	}
+	if errs[0] != nil {
+		// The RCPT commands were answered 503 since there is no transaction.
+		return errs[0], nil, false
+	}
+	return nil, errs[1:], false
+}
+
+// fallBackFromPipelining replaces the connection of c, on which the server
+// rejected pipelining, by a new one on which pipelining is disabled.
+// It reports whether the new connection is established.
+func (c *smtpSender) fallBackFromPipelining() bool {
+	c.d.logger().Warn("pipelined commands failed, sending them again without pipelining", "host", c.d.Host)
+	c.conn.Close()
+	if !c.reconnect() {
+		return false
+	}
+	c.noPipelining = true
+	return true
+}
+
+// sizeLimit returns the maximum size of the emails, the lowest of
+// Dialer.MaxMessageSize and the limit advertised by the server with the SIZE
+// extension, or 0 if there is none.
+func (c *smtpSender) sizeLimit() int64 {
+	limit := c.d.MaxMessageSize
+	if ok, param := c.Extension("SIZE"); ok {
+		if n, err := strconv.ParseInt(param, 10, 64); err == nil && n > 0 && (limit <= 0 || n < limit) {
+			limit = n
+		}
+	}
+	return limit
+}
+
+// checkSize renders msg and checks that its size does not exceed limit.
+func checkSize(msg io.WriterTo, limit int64) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := msg.WriteTo(buf); err != nil {
+		return nil, err
+	}
+	if int64(buf.Len()) > limit {
+		return nil, fmt.Errorf("mailer: the email size (%d bytes) exceeds the limit of %d bytes", buf.Len(), limit)
+	}
+	return buf.Bytes(), nil
+}
+
+// rcpt sends the RCPT command, with the DSN parameters if dsn is not nil.
+func (c *smtpSender) rcpt(to string, dsn *dsnRequest) error {
+	if dsn == nil {
+		return c.Rcpt(to)
+	}
+	return c.cmd(25, "RCPT TO:<%s>%s", to, dsn.rcptParams(to))
+}
+
+// cmd sends a command directly on the text protocol connection and checks the
+// code of the reply. It must only be called when the client is a textClient.
+func (c *smtpSender) cmd(code int, format string, args ...interface{}) error {
+	line := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(line, "\r\n") {
+		return errors.New("mailer: a line must not contain CR or LF")
+	}
+
+	text := c.smtpClient.(textClient).text()
+	id, err := text.Cmd("%s", line)
+	if err != nil {
+		return err
+	}
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(code)
+	return err
+}
+
+// data returns the writer of the content of the email, sent with BDAT commands
+// when chunking is enabled and supported by the server, and with the DATA
+// command otherwise.
+func (c *smtpSender) data() (io.WriteCloser, error) {
+	if c.d.Chunking {
+		tc, ok := c.smtpClient.(textClient)
+		if ok {
+			ok, _ = c.Extension("CHUNKING")
+		}
+		if ok {
+			return &bdatWriter{text: tc.text(), buf: make([]byte, 0, bdatChunkSize)}, nil
+		}
+	}
+	return c.Data()
+}
+
+func newSMTPClient(conn net.Conn, host string) (smtpClient, error) {
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return nil, err
+	}
+	return &netSMTPClient{c}, nil
+}
+
+func (c *netSMTPClient) text() *textproto.Conn {
+	return c.Text
+}
+
+func (w *bdatWriter) Write(p []byte) (int, error) {
+	n := 0
+	for w.err == nil && len(p) > 0 {
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+		n += k
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.chunk(false)
+		}
+	}
+	return n, w.err
+}
+
+// Close sends the buffered content in the last chunk.
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.chunk(true)
+	if w.err == nil {
+		w.err = errors.New("mailer: BDAT writer already closed")
+		return nil
+	}
+	return w.err
+}
+
+// chunk sends the buffered content in a BDAT command and waits for the reply
+// of the server.
+func (w *bdatWriter) chunk(last bool) error {
+	cmd := fmt.Sprintf("BDAT %d", len(w.buf))
+	if last {
+		cmd += " LAST"
+	}
+
+	id, err := w.text.Cmd("%s", cmd)
+	if err != nil {
+		return err
+	}
+	if _, err := w.text.W.Write(w.buf); err != nil {
 		return err
 	}
+	if err := w.text.W.Flush(); err != nil {
+		return err
+	}
+	w.buf = w.buf[:0]
+
+	w.text.StartResponse(id)
+	defer w.text.EndResponse(id)
+	_, _, err = w.text.ReadResponse(250)
+	return err
+}
+
+// needsSMTPUTF8 reports whether one of the envelope addresses contains non-ASCII
+// characters.
+func needsSMTPUTF8(from string, to []string) bool {
+	if !isASCII(from) {
+		return true
+	}
+	for _, addr := range to {
+		if !isASCII(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reconnect replaces the connection of c by a new one, it reports whether the
+// new connection is established.
+func (c *smtpSender) reconnect() bool {
+	sc, err := c.d.DialContext(c.ctx)
+	if err != nil {
+		return false
+	}
 
-	return w.Close()
+	sx, ok := sc.(*smtpSender)
+	if !ok {
+		return false
+	}
+
+	c.stop()
+	*c = *sx
+	return true
+}
+
+// Reset implements Resetter by sending the RSET command. Send resets the
+// transaction left by the previous email itself, Reset allows to do it right
+// after a failure, for example before putting the connection back in a pool.
+func (c *smtpSender) Reset() error {
+	if err := c.d.setDeadline(c.conn); err != nil {
+		return err
+	}
+	if err := c.smtpClient.Reset(); err != nil {
+		return err
+	}
+	c.used = false
+	return nil
 }
 
 func (c *smtpSender) Close() error {
+	defer c.stop()
 	return c.Quit()
 }
 
@@ -240,3 +1476,32 @@ func (a *loginAuth) Next(fromServer []byte, more bool) ([]byte, error) {
 		return nil, fmt.Errorf("unexpected server challenge: %s", fromServer)
 	}
 }
+
+// XOAuth2Auth returns an smtp.Auth that implements the XOAUTH2 authentication
+// mechanism used by Gmail and Office 365, accessToken is an OAuth 2.0 bearer
+// token for username. Set it as the Dialer Auth before dialing, Dial returns an
+// error if the server does not advertise XOAUTH2.
+func XOAuth2Auth(username, accessToken string) smtp.Auth {
+	return &xoauth2Auth{
+		username:    username,
+		accessToken: accessToken,
+	}
+}
+
+func (a *xoauth2Auth) Start(server *smtp.ServerInfo) (string, []byte, error) {
+	if !server.TLS {
+		return "", nil, errors.New("unencrypted connection")
+	}
+	resp := "user=" + a.username + "\x01auth=Bearer " + a.accessToken + "\x01\x01"
+	return "XOAUTH2", []byte(resp), nil
+}
+
+func (a *xoauth2Auth) Next(fromServer []byte, more bool) ([]byte, error) {
+	if !more {
+		return nil, nil
+	}
+
+	// The server only sends a challenge when the authentication failed, it
+	// contains a JSON object describing the error.
+	return nil, fmt.Errorf("mailer: XOAUTH2 authentication failed: %s", fromServer)
+}
@@ -2,12 +2,26 @@ package mailer
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"log/slog"
+	"math/big"
 	"net"
 	"net/smtp"
+	"net/textproto"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,6 +57,7 @@ func TestDialer(t *testing.T) {
 		"StartTLS",
 		"Extension AUTH",
 		"Auth",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Rcpt " + testTo1,
 		"Rcpt " + testTo2,
@@ -54,12 +69,231 @@ func TestDialer(t *testing.T) {
 	})
 }
 
+func TestNewDialerE(t *testing.T) {
+	d, err := NewDialerE()
+	assert.NoError(t, err)
+	assert.Equal(t, testHost, d.Host)
+	assert.Equal(t, testPort, d.Port)
+	assert.False(t, d.SSL)
+
+	cfg := Config
+	defer func() { Config = cfg }()
+
+	Config = nil
+	d, err = NewDialerE()
+	assert.Nil(t, d)
+	assert.EqualError(t, err, "mailer: Config must be initialized via mailer.New before dialing")
+}
+
+func TestNewDialerFromConfig(t *testing.T) {
+	cfg := Config
+	defer func() { Config = cfg }()
+	Config = nil
+
+	d := NewDialerFromConfig(ConfigMailer{
+		Identity: "admin",
+		Host:     "smtp.example.org",
+		Port:     465,
+		Username: "user",
+		Password: "pwd",
+	})
+	assert.Equal(t, &Dialer{
+		Host:     "smtp.example.org",
+		Port:     465,
+		Identity: "admin",
+		Username: "user",
+		Password: "pwd",
+		SSL:      true,
+	}, d)
+}
+
 func TestDialerSSL(t *testing.T) {
 	d := NewDialer()
 	d.SSL = true
 	testSendMail(t, d, []string{
 		"Extension AUTH",
 		"Auth",
+		"Extension SIZE",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+}
+
+func TestDialerTLSPolicy(t *testing.T) {
+	d := NewDialer()
+	d.TLSPolicy = NoTLS
+	d.AllowPlaintextAuth = true
+	testSendMail(t, d, []string{
+		"Extension AUTH",
+		"Auth",
+		"Extension SIZE",
+		"Mail " + testFrom,
+		"Rcpt " + testTo1,
+		"Rcpt " + testTo2,
+		"Data",
+		"Write message",
+		"Close writer",
+		"Quit",
+		"Close",
+	})
+
+	srv := &fakeServer{ext: []string{"AUTH PLAIN"}}
+	srv.stub(t)
+	d = &Dialer{Host: testHost, Port: testPort, Username: testUser, Password: testPwd, TLSPolicy: TLSMandatory}
+	_, err := d.Dial()
+	assert.EqualError(t, err, "mailer: the server does not support STARTTLS, required by the TLS policy")
+	srv.wait()
+	assert.Equal(t, []string{"EHLO localhost"}, srv.cmds)
+}
+
+func TestDialerAllowPlaintextAuth(t *testing.T) {
+	srv := &fakeServer{ext: []string{"AUTH PLAIN"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Username: testUser, Password: testPwd}
+	_, err := d.Dial()
+	assert.EqualError(t, err, "mailer: refusing to authenticate over a connection which is not encrypted, see Dialer.AllowPlaintextAuth")
+	srv.wait()
+	assert.Equal(t, []string{"EHLO localhost"}, srv.cmds)
+
+	// The connection is not encrypted even though STARTTLS succeeded.
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Close",
+		},
+		addr: addr(testHost, testPort),
+	}
+	stubDial(t, testClient, testConn)
+	smtpNewClient = func(net.Conn, string) (smtpClient, error) {
+		return &plaintextClient{testClient}, nil
+	}
+	_, err = NewDialer().Dial()
+	assert.EqualError(t, err, "mailer: refusing to authenticate over a connection which is not encrypted, see Dialer.AllowPlaintextAuth")
+
+	assert.True(t, isLoopback("localhost"))
+	assert.True(t, isLoopback("127.0.0.1"))
+	assert.True(t, isLoopback("::1"))
+	assert.False(t, isLoopback(testHost))
+}
+
+func TestDialerSSLVerify(t *testing.T) {
+	cert := testServerCertificate(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert.Leaf)
+
+	tests := []struct {
+		config *tls.Config
+		err    string
+	}{
+		{nil, "certificate signed by unknown authority"},
+		{&tls.Config{RootCAs: roots}, ""},
+		{&tls.Config{RootCAs: roots, ServerName: "other.example.com"}, "certificate is valid for mail.example.com, not other.example.com"},
+		{&tls.Config{InsecureSkipVerify: true}, ""},
+	}
+	for _, test := range tests {
+		srv := &fakeServer{tls: &tls.Config{Certificates: []tls.Certificate{cert}}}
+		srv.stub(t)
+		d := &Dialer{Host: testHost, Port: 465, SSL: true, TLSConfig: test.config}
+		err := d.DialAndSend(getTestMessage())
+		srv.wait()
+
+		if test.err == "" {
+			assert.NoError(t, err)
+			assert.Contains(t, srv.cmds, "DATA")
+			continue
+		}
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "mailer: TLS handshake with mail.example.com failed: ")
+			assert.Contains(t, err.Error(), test.err)
+		}
+		assert.Empty(t, srv.cmds)
+	}
+}
+
+// testServerCertificate returns a self-signed certificate for testHost.
+func testServerCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: testHost},
+		DNSNames:     []string{testHost},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	assert.NoError(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestDetectFQDN(t *testing.T) {
+	defer func() {
+		osHostname, lookupHost, lookupAddr = os.Hostname, net.DefaultResolver.LookupHost, net.DefaultResolver.LookupAddr
+		localFQDNDetected = false
+	}()
+
+	tests := []struct {
+		hostname string
+		names    []string
+		want     string
+	}{
+		{"web1", []string{"localhost.", "web1.example.org."}, "web1.example.org"},
+		{"web1.example.org", nil, "web1.example.org"},
+		{"web1", nil, "localhost"},
+		{"", nil, "localhost"},
+	}
+	for _, test := range tests {
+		osHostname = func() (string, error) { return test.hostname, nil }
+		lookupHost = func(ctx context.Context, host string) ([]string, error) {
+			assert.Equal(t, test.hostname, host)
+			if test.names == nil {
+				return nil, errors.New("no such host")
+			}
+			return []string{"192.0.2.1"}, nil
+		}
+		lookupAddr = func(ctx context.Context, addr string) ([]string, error) {
+			assert.Equal(t, "192.0.2.1", addr)
+			return test.names, nil
+		}
+		assert.Equal(t, test.want, detectFQDN(context.Background()))
+	}
+
+	// The lookups are abandoned when the context is done, and the name is
+	// then detected again.
+	osHostname = func() (string, error) { return "web1", nil }
+	lookupHost = func(ctx context.Context, host string) ([]string, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, "localhost", localFQDN(ctx))
+	assert.False(t, localFQDNDetected)
+
+	osHostname = func() (string, error) { return "mx.example.org", nil }
+	lookupHost = func(context.Context, string) ([]string, error) { return nil, errors.New("no such host") }
+	d := NewDialer()
+	d.DetectLocalName = true
+	testSendMail(t, d, []string{
+		"Hello mx.example.org",
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Auth",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Rcpt " + testTo1,
 		"Rcpt " + testTo2,
@@ -81,6 +315,7 @@ func TestDialerConfig(t *testing.T) {
 		"StartTLS",
 		"Extension AUTH",
 		"Auth",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Rcpt " + testTo1,
 		"Rcpt " + testTo2,
@@ -101,6 +336,7 @@ func TestDialerSSLConfig(t *testing.T) {
 		"Hello test",
 		"Extension AUTH",
 		"Auth",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Rcpt " + testTo1,
 		"Rcpt " + testTo2,
@@ -120,6 +356,7 @@ func TestDialerNoAuth(t *testing.T) {
 	testSendMail(t, d, []string{
 		"Extension STARTTLS",
 		"StartTLS",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Rcpt " + testTo1,
 		"Rcpt " + testTo2,
@@ -139,6 +376,7 @@ func TestDialerTimeout(t *testing.T) {
 	testSendMailTimeout(t, d, []string{
 		"Extension STARTTLS",
 		"StartTLS",
+		"Extension SIZE",
 		"Mail " + testFrom,
 		"Extension STARTTLS",
 		"StartTLS",
@@ -153,6 +391,1318 @@ func TestDialerTimeout(t *testing.T) {
 	})
 }
 
+func TestDialAndSendContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, peer := net.Pipe()
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, peer)
+		close(closed)
+	}()
+
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Quit",
+			"Close",
+		},
+		addr: addr(d.Host, d.Port),
+		data: func() error {
+			cancel()
+			<-closed
+			return io.ErrClosedPipe
+		},
+	}
+	stubDial(t, testClient, conn)
+
+	err := d.DialAndSendContext(ctx, getTestMessage())
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDialContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return nil, ctx.Err()
+	}
+
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	_, err := d.DialContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestDialerReuse(t *testing.T) {
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Reset",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Reset",
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+		},
+		addr: addr(d.Host, d.Port),
+	}
+	stubDial(t, testClient, testConn)
+
+	s, err := d.Dial()
+	assert.NoError(t, err)
+	assert.NoError(t, Send(s, getTestMessage(), getTestMessage()))
+
+	// The server closed the idle connection.
+	testClient.resetTimeout = true
+	assert.NoError(t, Send(s, getTestMessage()))
+	assert.NoError(t, s.Close())
+	assert.Equal(t, len(testClient.want), testClient.i)
+}
+
+func TestDialAndSendWithRetry(t *testing.T) {
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Reset",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Quit",
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Quit",
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+		},
+		addr: addr(d.Host, d.Port),
+		mailErrs: []error{
+			nil,
+			&textproto.Error{Code: 451, Msg: "Greylisted, try again later"},
+			&textproto.Error{Code: 421, Msg: "Service not available"},
+		},
+	}
+	stubDial(t, testClient, testConn)
+
+	var delays []time.Duration
+	sleep = func(d time.Duration) { delays = append(delays, d) }
+	defer func() { sleep = time.Sleep }()
+
+	err := d.DialAndSendWithRetry(3, time.Second, getTestMessage(), getTestMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second}, delays)
+	assert.Equal(t, len(testClient.want), testClient.i)
+}
+
+func TestDialAndSendWithRetryPermanent(t *testing.T) {
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Quit",
+		},
+		addr: addr(d.Host, d.Port),
+		mailErrs: []error{
+			&textproto.Error{Code: 550, Msg: "Mailbox unavailable"},
+		},
+	}
+	stubDial(t, testClient, testConn)
+
+	sleep = func(d time.Duration) { t.Error("permanent errors should not be retried") }
+	defer func() { sleep = time.Sleep }()
+
+	err := d.DialAndSendWithRetry(3, time.Second, getTestMessage())
+	assert.Contains(t, err.Error(), "mailer: could not send email 1 after 1 attempt(s): 550")
+
+	var protoErr *textproto.Error
+	assert.True(t, errors.As(err, &protoErr))
+}
+
+type deadlineConn struct {
+	net.Conn
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) SetDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestDialerTimeouts(t *testing.T) {
+	d := &Dialer{
+		Host:        testHost,
+		Port:        testPort,
+		Timeout:     time.Minute,
+		SendTimeout: time.Hour,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt " + testTo1,
+			"Rcpt " + testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+		},
+		addr: addr(d.Host, d.Port),
+	}
+	conn := &deadlineConn{}
+	stubDial(t, testClient, conn)
+
+	var timeout time.Duration
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		timeout = d
+		return conn, nil
+	}
+
+	start := time.Now()
+	err := d.DialAndSend(getTestMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, timeout)
+	assert.Len(t, conn.deadlines, 2)
+	for _, deadline := range conn.deadlines {
+		assert.False(t, deadline.Before(start.Add(time.Hour)))
+	}
+
+	d.Timeout = 0
+	d.SendTimeout = 0
+	conn.deadlines = nil
+	testClient.i = 0
+	err = d.DialAndSend(getTestMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Second, timeout)
+	assert.Empty(t, conn.deadlines)
+}
+
+func TestDialerProxy(t *testing.T) {
+	for _, ssl := range []bool{false, true} {
+		d := NewDialer()
+		d.SSL = ssl
+		d.Timeout = time.Minute
+
+		want := []string{"Extension STARTTLS", "StartTLS"}
+		if ssl {
+			want = nil
+		}
+		want = append(want,
+			"Extension AUTH",
+			"Auth",
+			"Extension SIZE",
+			"Mail "+testFrom,
+			"Rcpt "+testTo1,
+			"Rcpt "+testTo2,
+			"Data",
+			"Write message",
+			"Close writer",
+			"Quit",
+		)
+		testClient := &mockClient{
+			t:    t,
+			want: want,
+			addr: addr(d.Host, d.Port),
+		}
+		conn := &deadlineConn{}
+		stubDial(t, testClient, conn)
+		netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+			t.Fatal("netDialTimeout should not be called when ProxyDialer is set")
+			return nil, nil
+		}
+
+		var proxied bool
+		d.ProxyDialer = func(ctx context.Context, network, address string) (net.Conn, error) {
+			proxied = true
+			assert.Equal(t, "tcp", network)
+			assert.Equal(t, testClient.addr, address)
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(time.Minute), deadline, time.Second)
+			return conn, nil
+		}
+
+		assert.NoError(t, d.DialAndSend(getTestMessage()))
+		assert.True(t, proxied)
+	}
+}
+
+func TestDialerXOAuth2(t *testing.T) {
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+		Auth: XOAuth2Auth(testUser, "token"),
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+		},
+		addr:  addr(d.Host, d.Port),
+		auths: "LOGIN PLAIN XOAUTH2",
+		auth:  d.Auth,
+	}
+	stubDial(t, testClient, testConn)
+
+	_, err := d.Dial()
+	assert.NoError(t, err)
+
+	testClient.i = 0
+	testClient.auths = "LOGIN PLAIN"
+	testClient.want = []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Close",
+	}
+	_, err = d.Dial()
+	assert.EqualError(t, err, "mailer: the server does not support XOAUTH2 authentication")
+}
+
+func TestXOAuth2Auth(t *testing.T) {
+	a := XOAuth2Auth(testUser, "token")
+
+	_, _, err := a.Start(&smtp.ServerInfo{Name: testHost, Auth: []string{"XOAUTH2"}})
+	assert.EqualError(t, err, "unencrypted connection")
+
+	proto, resp, err := a.Start(&smtp.ServerInfo{Name: testHost, TLS: true, Auth: []string{"XOAUTH2"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "XOAUTH2", proto)
+	assert.Equal(t, "user="+testUser+"\x01auth=Bearer token\x01\x01", string(resp))
+
+	_, err = a.Next([]byte(`{"status":"401"}`), true)
+	assert.EqualError(t, err, `mailer: XOAUTH2 authentication failed: {"status":"401"}`)
+
+	resp, err = a.Next(nil, false)
+	assert.NoError(t, err)
+	assert.Nil(t, resp)
+}
+
+func TestDialerIdentity(t *testing.T) {
+	d := NewDialer()
+	d.Identity = "admin"
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+			"Quit",
+		},
+		addr: addr(d.Host, d.Port),
+		auth: smtp.PlainAuth("admin", testUser, testPwd, testHost),
+	}
+	stubDial(t, testClient, testConn)
+
+	s, err := d.Dial()
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+}
+
+func TestDialerAuthMechanism(t *testing.T) {
+	d := &Dialer{
+		Host:          testHost,
+		Port:          testPort,
+		Username:      testUser,
+		Password:      testPwd,
+		AuthMechanism: "PLAIN",
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension AUTH",
+			"Auth",
+		},
+		addr:  addr(d.Host, d.Port),
+		auths: "CRAM-MD5 PLAIN",
+	}
+	stubDial(t, testClient, testConn)
+
+	_, err := d.Dial()
+	assert.NoError(t, err)
+
+	d.Auth = nil
+	d.AuthMechanism = "LOGIN"
+	testClient.i = 0
+	testClient.want = []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension AUTH",
+		"Close",
+	}
+	_, err = d.Dial()
+	assert.EqualError(t, err, "mailer: the server does not support LOGIN authentication")
+
+	d.AuthMechanism = "GSSAPI"
+	testClient.i = 0
+	testClient.want = []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Close",
+	}
+	_, err = d.Dial()
+	assert.EqualError(t, err, `mailer: unsupported authentication mechanism "GSSAPI"`)
+}
+
+func TestDialerAuthPreference(t *testing.T) {
+	tests := []struct {
+		auths      string
+		noTLS      bool
+		preference []string
+		want       smtp.Auth
+	}{
+		{"CRAM-MD5 PLAIN LOGIN", false, nil, testAuth},
+		{"CRAM-MD5 PLAIN SCRAM-SHA-256", false, nil, SCRAMSHA256Auth(testUser, testPwd)},
+		{"CRAM-MD5 PLAIN", true, nil, smtp.CRAMMD5Auth(testUser, testPwd)},
+		{"LOGIN", true, nil, &loginAuth{testUser, testPwd, testHost}},
+		{"CRAM-MD5 PLAIN", false, []string{"CRAM-MD5", "PLAIN"}, smtp.CRAMMD5Auth(testUser, testPwd)},
+		{"LOGIN", false, []string{"CRAM-MD5"}, testAuth},
+	}
+	for _, test := range tests {
+		d := &Dialer{
+			Host:           testHost,
+			Port:           testPort,
+			Username:       testUser,
+			Password:       testPwd,
+			AuthPreference: test.preference,
+		}
+		want := []string{"Extension STARTTLS", "StartTLS", "Extension AUTH", "Auth"}
+		if test.noTLS {
+			d.TLSPolicy = NoTLS
+			d.AllowPlaintextAuth = true
+			want = want[2:]
+		}
+		stubDial(t, &mockClient{
+			t:     t,
+			want:  want,
+			addr:  addr(d.Host, d.Port),
+			auths: test.auths,
+			auth:  test.want,
+		}, testConn)
+
+		_, err := d.Dial()
+		assert.NoError(t, err)
+	}
+}
+
+func TestSMTPUTF8(t *testing.T) {
+	d := &Dialer{
+		Host: testHost,
+		Port: testPort,
+	}
+	testClient := &mockClient{
+		t: t,
+		want: []string{
+			"Extension STARTTLS",
+			"StartTLS",
+			"Extension SMTPUTF8",
+			"Extension SIZE",
+			"Mail " + testFrom,
+			"Rcpt 测试@example.com",
+			"Data",
+			"Write message",
+			"Close writer",
+		},
+		addr: addr(d.Host, d.Port),
+	}
+	stubDial(t, testClient, testConn)
+
+	s, err := d.Dial()
+	assert.NoError(t, err)
+	err = s.Send(testFrom, []string{"测试@example.com"}, getTestMessage())
+	assert.NoError(t, err)
+	assert.Equal(t, len(testClient.want), testClient.i)
+
+	testClient.i = 0
+	testClient.unsupported = []string{"SMTPUTF8"}
+	testClient.want = []string{
+		"Extension STARTTLS",
+		"StartTLS",
+		"Extension SMTPUTF8",
+	}
+	s, err = d.Dial()
+	assert.NoError(t, err)
+	err = s.Send(testFrom, []string{"测试@example.com"}, getTestMessage())
+	assert.EqualError(t, err, "mailer: the server does not support SMTPUTF8, required to send to or from an internationalized address")
+}
+
+func TestNeedsSMTPUTF8(t *testing.T) {
+	assert.False(t, needsSMTPUTF8(testFrom, []string{testTo1, testTo2}))
+	assert.True(t, needsSMTPUTF8("josé@example.com", []string{testTo1}))
+	assert.True(t, needsSMTPUTF8(testFrom, []string{testTo1, "测试@example.com"}))
+}
+
+func TestSendConcurrent(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		dials int
+		sent  []string
+		open  int
+		max   int
+	)
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return testConn, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		dials++
+		open++
+		if open > max {
+			max = open
+		}
+		return &poolClient{
+			sent: func(to string) {
+				mu.Lock()
+				sent = append(sent, to)
+				mu.Unlock()
+			},
+			quit: func() {
+				mu.Lock()
+				open--
+				mu.Unlock()
+			},
+		}, nil
+	}
+
+	var msgs []*Message
+	for _, to := range []string{
+		"to1@example.com", "rejected@example.com", "to2@example.com",
+		"dropped@example.com", "to3@example.com", "to4@example.com",
+	} {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", to)
+		m.SetBody("text/plain", "Hello!")
+		msgs = append(msgs, m)
+	}
+
+	d := &Dialer{Host: testHost, Port: testPort, Auth: testAuth, AllowPlaintextAuth: true}
+	for _, workers := range []int{1, 3} {
+		dials, max, sent = 0, 0, nil
+		errs := SendConcurrent(d, workers, msgs)
+
+		assert.Len(t, errs, len(msgs))
+		for i, err := range errs {
+			switch i {
+			case 1:
+				var protoErr *textproto.Error
+				assert.True(t, errors.As(err, &protoErr))
+				assert.Contains(t, err.Error(), "mailer: could not send email 2: 550")
+			case 3:
+				assert.EqualError(t, err, "mailer: could not send email 4: EOF")
+			default:
+				assert.NoError(t, err)
+			}
+		}
+		assert.ElementsMatch(t, []string{"to1@example.com", "to2@example.com", "to3@example.com", "to4@example.com"}, sent)
+		assert.Equal(t, 0, open)
+		assert.LessOrEqual(t, max, workers)
+		if workers == 1 {
+			assert.Equal(t, 2, dials, "only the connection error should cause a new connection")
+		}
+	}
+}
+
+func TestDialerConcurrentDial(t *testing.T) {
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return testConn, nil
+	}
+	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
+		return &authClient{poolClient{sent: func(string) {}, quit: func() {}}}, nil
+	}
+
+	d := &Dialer{Host: testHost, Port: testPort, Username: testUser, Password: testPwd, AllowPlaintextAuth: true}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, d.DialAndSend(getTestMessage()))
+		}()
+	}
+	wg.Wait()
+
+	assert.Nil(t, d.Auth, "Dial should not modify the Dialer")
+}
+
+func TestDialerDotStuffing(t *testing.T) {
+	body := "Start\r\n.\r\n..Two dots\r\n.End\r\n"
+	for _, enc := range []Encoding{Unencoded, QuotedPrintable} {
+		m := NewMessage()
+		m.SetHeader("To", "to@example.com")
+		m.SetBody("text/plain", body, SetPartEncoding(enc))
+
+		// The rendered message is not dot-stuffed.
+		want, err := m.Render()
+		assert.NoError(t, err)
+		assert.True(t, strings.HasSuffix(string(want), "\r\n\r\n"+body), "unexpected body:\n%s", want)
+
+		srv := &fakeServer{}
+		srv.stub(t)
+		d := &Dialer{Host: testHost, Port: testPort}
+		assert.NoError(t, d.DialAndSend(m))
+		srv.wait()
+
+		// The lone period line did not end the DATA command early.
+		compareBodies(t, srv.data.String(), string(want))
+	}
+}
+
+func TestDialerChunking(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", strings.Repeat(".A line starting with a dot.\r\n", 5000), SetPartEncoding(Unencoded))
+	want, err := m.Render()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		chunking bool
+		ext      []string
+		bdat     bool
+	}{
+		{true, []string{"CHUNKING"}, true},
+		{false, []string{"CHUNKING"}, false},
+		{true, nil, false},
+	}
+	for _, test := range tests {
+		srv := &fakeServer{ext: test.ext}
+		srv.stub(t)
+
+		d := &Dialer{Host: testHost, Port: testPort, Chunking: test.chunking}
+		assert.NoError(t, d.DialAndSend(m))
+		srv.wait()
+
+		if !test.bdat {
+			assert.Contains(t, srv.cmds, "DATA")
+			assert.NotContains(t, strings.Join(srv.cmds, "\n"), "BDAT")
+			continue
+		}
+		assert.Equal(t, []string{
+			"MAIL FROM:<noreply@example.com>",
+			"RCPT TO:<to@example.com>",
+			fmt.Sprintf("BDAT %d", bdatChunkSize),
+			fmt.Sprintf("BDAT %d", bdatChunkSize),
+			fmt.Sprintf("BDAT %d LAST", len(want)-2*bdatChunkSize),
+			"QUIT",
+		}, srv.cmds[1:])
+		compareBodies(t, srv.data.String(), string(want))
+	}
+}
+
+func TestDialerLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	logger := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+	srv := &fakeServer{}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Logger: logger}
+	assert.NoError(t, d.DialAndSend(getTestMessage()))
+	srv.wait()
+
+	logs := buf.String()
+	assert.Contains(t, logs, `level=DEBUG msg="connecting to SMTP server" addr=mail.example.com:587 proxy=false`)
+	assert.Contains(t, logs, `level=WARN msg="server does not support STARTTLS, continuing without TLS" host=mail.example.com`)
+
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	buf.Reset()
+	_, err := d.Dial()
+	assert.Error(t, err)
+	assert.Contains(t, buf.String(), `level=WARN msg="could not connect to SMTP server" addr=mail.example.com:587 error="connection refused"`)
+}
+
+func TestDialerContinueOnRcptError(t *testing.T) {
+	tests := []struct {
+		reject   []string
+		accepted []string
+		data     bool
+	}{
+		{[]string{"to1@example.com"}, []string{"to2@example.com"}, true},
+		{[]string{"to1@example.com", "to2@example.com"}, nil, false},
+	}
+	for _, test := range tests {
+		srv := &fakeServer{reject: test.reject}
+		srv.stub(t)
+		d := &Dialer{Host: testHost, Port: testPort, ContinueOnRcptError: true}
+		err := d.DialAndSend(getTestMessage())
+		srv.wait()
+
+		var rcptErr *RecipientsError
+		if assert.True(t, errors.As(err, &rcptErr)) {
+			assert.Equal(t, test.accepted, rcptErr.Accepted)
+			assert.Len(t, rcptErr.Rejected, len(test.reject))
+			for _, addr := range test.reject {
+				assert.Contains(t, rcptErr.Rejected[addr].Error(), "No such user")
+			}
+		}
+		assert.Equal(t, test.data, strings.Contains(strings.Join(srv.cmds, "\n"), "DATA"))
+	}
+
+	srv := &fakeServer{reject: []string{"to1@example.com"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort}
+	err := d.DialAndSend(getTestMessage())
+	srv.wait()
+	var protoErr *textproto.Error
+	assert.True(t, errors.As(err, &protoErr))
+	assert.NotContains(t, srv.cmds, "DATA")
+}
+
+func TestDialerPipelining(t *testing.T) {
+	srv := &fakeServer{ext: []string{"PIPELINING"}, reject: []string{"to1@example.com"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, ContinueOnRcptError: true, Pipelining: true}
+	err := d.DialAndSend(getTestMessage())
+	srv.wait()
+
+	var rcptErr *RecipientsError
+	if assert.True(t, errors.As(err, &rcptErr)) {
+		assert.Equal(t, []string{"to2@example.com"}, rcptErr.Accepted)
+		assert.Contains(t, rcptErr.Rejected["to1@example.com"].Error(), "No such user")
+	}
+	assert.Equal(t, []string{
+		"EHLO localhost",
+		"MAIL FROM:<from@example.com>",
+		"RCPT TO:<to1@example.com>",
+		"RCPT TO:<to2@example.com>",
+		"DATA",
+		"QUIT",
+	}, srv.cmds)
+
+	// The RCPT commands following a rejected MAIL command are answered 503,
+	// which does not mean that the server does not support pipelining.
+	srv = &fakeServer{ext: []string{"PIPELINING"}, reject: []string{"from@example.com"}}
+	srv.stub(t)
+	err = d.DialAndSend(getTestMessage())
+	srv.wait()
+	var protoErr *textproto.Error
+	if assert.True(t, errors.As(err, &protoErr)) {
+		assert.Equal(t, 550, protoErr.Code)
+	}
+	assert.Equal(t, []string{
+		"EHLO localhost",
+		"MAIL FROM:<from@example.com>",
+		"RCPT TO:<to1@example.com>",
+		"RCPT TO:<to2@example.com>",
+		"QUIT",
+	}, srv.cmds)
+}
+
+func TestDialerPipeliningFallback(t *testing.T) {
+	srv := &fakeServer{ext: []string{"PIPELINING"}, rejectPipelining: true}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Pipelining: true}
+	s, err := d.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, Send(s, getTestMessage()))
+	assert.NoError(t, Send(s, getTestMessage()))
+	assert.NoError(t, s.Close())
+	srv.wait()
+
+	var ehlo int
+	for _, cmd := range srv.cmds {
+		if strings.HasPrefix(cmd, "EHLO") {
+			ehlo++
+		}
+	}
+	assert.Equal(t, 2, ehlo, "the server should be reconnected once")
+	assert.Equal(t, []string{
+		"RSET",
+		"MAIL FROM:<from@example.com>",
+		"RCPT TO:<to1@example.com>",
+		"RCPT TO:<to2@example.com>",
+		"DATA",
+		"QUIT",
+	}, srv.cmds[len(srv.cmds)-6:])
+
+	srv = &fakeServer{ext: []string{"PIPELINING"}, rejectPipelining: true}
+	srv.stub(t)
+	d.Pipelining = false
+	assert.NoError(t, d.DialAndSend(getTestMessage()))
+	srv.wait()
+	assert.Equal(t, "EHLO localhost", srv.cmds[0])
+	assert.NotContains(t, srv.cmds[1:], "EHLO localhost")
+}
+
+func TestDialerAutoSender(t *testing.T) {
+	tests := []struct {
+		username string
+		from     string
+		sender   string
+	}{
+		{"user@example.com", "Team <team@example.com>", "user@example.com"},
+		{"User@Example.com", "user@example.com", ""},
+		{"apikey", "team@example.com", ""},
+		{"", "team@example.com", ""},
+	}
+	for _, test := range tests {
+		srv := &fakeServer{ext: []string{"AUTH LOGIN"}}
+		srv.stub(t)
+		d := &Dialer{
+			Host:               testHost,
+			Port:               testPort,
+			Username:           test.username,
+			AuthMechanism:      "LOGIN",
+			AllowPlaintextAuth: true,
+			AutoSender:         true,
+		}
+		m := NewMessage()
+		m.SetHeader("From", test.from)
+		m.SetHeader("To", "to@example.com")
+		m.SetBody("text/plain", "Test")
+		assert.NoError(t, d.DialAndSend(m))
+		srv.wait()
+
+		parsed, err := ParseMessage(&srv.data)
+		assert.NoError(t, err)
+		assert.Equal(t, test.sender, firstValue(parsed.Header, "Sender"))
+		assert.Empty(t, m.GetHeader("Sender"), "Send should not modify the message")
+	}
+}
+
+func TestDialerPing(t *testing.T) {
+	srv := &fakeServer{ext: []string{"AUTH LOGIN"}}
+	srv.stub(t)
+	d := &Dialer{
+		Host:               testHost,
+		Port:               testPort,
+		Username:           testUser,
+		Password:           testPwd,
+		AuthMechanism:      "LOGIN",
+		AllowPlaintextAuth: true,
+	}
+	assert.NoError(t, d.Ping())
+	srv.wait()
+
+	if assert.Len(t, srv.cmds, 3) {
+		assert.Equal(t, "AUTH LOGIN", srv.cmds[1])
+		assert.Equal(t, "QUIT", srv.cmds[2])
+	}
+	assert.Zero(t, srv.data.Len())
+
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		return nil, errors.New("connection refused")
+	}
+	assert.EqualError(t, d.Ping(), "connection refused")
+}
+
+func TestDialerMaxRecipients(t *testing.T) {
+	newMessage := func() *Message {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to1@example.com", "to2@example.com")
+		m.SetHeader("Cc", "cc@example.com")
+		m.Bcc("bcc1@example.com", "bcc2@example.com")
+		m.SetBody("text/plain", "Test")
+		return m
+	}
+	transactions := func(cmds []string) [][]string {
+		var groups [][]string
+		var group []string
+		for _, cmd := range cmds {
+			switch {
+			case strings.HasPrefix(cmd, "RCPT TO:"):
+				group = append(group, strings.TrimPrefix(cmd, "RCPT TO:"))
+			case cmd == "DATA":
+				groups = append(groups, group)
+				group = nil
+			}
+		}
+		return groups
+	}
+
+	srv := &fakeServer{}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, MaxRecipients: 2}
+	err := d.DialAndSend(newMessage())
+	assert.EqualError(t, err, "mailer: could not send email 1: mailer: the email has 5 recipients, more than the 2 allowed in a transaction by Dialer.MaxRecipients")
+	srv.wait()
+	assert.Empty(t, transactions(srv.cmds))
+
+	srv = &fakeServer{}
+	srv.stub(t)
+	d.SplitRecipients = true
+	assert.NoError(t, d.DialAndSend(newMessage()))
+	srv.wait()
+	assert.Equal(t, [][]string{
+		{"<to1@example.com>", "<to2@example.com>"},
+		{"<cc@example.com>", "<bcc1@example.com>"},
+		{"<bcc2@example.com>"},
+	}, transactions(srv.cmds))
+	assert.Equal(t, 3, strings.Count(srv.data.String(), "From: from@example.com\r\n"))
+
+	srv = &fakeServer{}
+	srv.stub(t)
+	d = &Dialer{Host: testHost, Port: testPort, MaxRecipients: 3, SeparateBcc: true}
+	assert.NoError(t, d.DialAndSend(newMessage()))
+	srv.wait()
+	assert.Equal(t, [][]string{
+		{"<to1@example.com>", "<to2@example.com>", "<cc@example.com>"},
+		{"<bcc1@example.com>"},
+		{"<bcc2@example.com>"},
+	}, transactions(srv.cmds))
+}
+
+func TestDialerSeparateBcc(t *testing.T) {
+	newMessage := func() *Message {
+		m := NewMessage()
+		m.SetHeader("From", "from@example.com")
+		m.SetHeader("To", "to@example.com")
+		m.SetHeader("Cc", "cc@example.com", "both@example.com")
+		m.Bcc("bcc1@example.com", "both@example.com", "bcc2@example.com")
+		m.SetBody("text/plain", "Test")
+		return m
+	}
+
+	srv := &fakeServer{}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, SeparateBcc: true}
+	assert.NoError(t, d.DialAndSend(newMessage()))
+	srv.wait()
+
+	var cmds []string
+	for _, cmd := range srv.cmds {
+		if strings.HasPrefix(cmd, "RCPT") || cmd == "DATA" {
+			cmds = append(cmds, cmd)
+		}
+	}
+	assert.Equal(t, []string{
+		"RCPT TO:<to@example.com>",
+		"RCPT TO:<cc@example.com>",
+		"RCPT TO:<both@example.com>",
+		"DATA",
+		"RCPT TO:<bcc1@example.com>",
+		"DATA",
+		"RCPT TO:<bcc2@example.com>",
+		"DATA",
+	}, cmds)
+	assert.Equal(t, 3, strings.Count(srv.data.String(), "From: from@example.com\r\n"))
+	assert.NotContains(t, srv.data.String(), "bcc1@example.com")
+
+	srv = &fakeServer{reject: []string{"cc@example.com", "bcc2@example.com"}}
+	srv.stub(t)
+	d.ContinueOnRcptError = true
+	err := d.DialAndSend(newMessage())
+	srv.wait()
+	var rcptErr *RecipientsError
+	if assert.True(t, errors.As(err, &rcptErr)) {
+		assert.Equal(t, []string{"to@example.com", "both@example.com", "bcc1@example.com"}, rcptErr.Accepted)
+		assert.Len(t, rcptErr.Rejected, 2)
+		assert.Contains(t, rcptErr.Rejected, "cc@example.com")
+		assert.Contains(t, rcptErr.Rejected, "bcc2@example.com")
+	}
+}
+
+func TestSMTPSenderReset(t *testing.T) {
+	srv := &fakeServer{reject: []string{"to1@example.com"}}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort}
+	s, err := d.Dial()
+	assert.NoError(t, err)
+
+	var protoErr *textproto.Error
+	assert.True(t, errors.As(Send(s, getTestMessage()), &protoErr))
+	assert.NoError(t, s.(Resetter).Reset())
+
+	m := getTestMessage()
+	m.SetHeader("To", "to2@example.com")
+	assert.NoError(t, Send(s, m))
+	assert.NoError(t, s.Close())
+	srv.wait()
+
+	assert.Equal(t, []string{
+		"EHLO localhost",
+		"MAIL FROM:<from@example.com>",
+		"RCPT TO:<to1@example.com>",
+		"RSET",
+		"MAIL FROM:<from@example.com>",
+		"RCPT TO:<to2@example.com>",
+		"DATA",
+		"QUIT",
+	}, srv.cmds)
+}
+
+func TestRecipientsError(t *testing.T) {
+	err := &RecipientsError{Rejected: map[string]error{
+		"b@example.com": errors.New("550 Unknown"),
+		"a@example.com": errors.New("550 Full"),
+	}}
+	assert.EqualError(t, err, "mailer: 2 recipient(s) rejected: a@example.com: 550 Full; b@example.com: 550 Unknown")
+}
+
+func TestDialerMaxMessageSize(t *testing.T) {
+	m := getTestMessage()
+	b, err := m.Render()
+	assert.NoError(t, err)
+	size := len(b)
+
+	tests := []struct {
+		max int64
+		ext []string
+		err string
+	}{
+		{int64(size), []string{"SIZE 10240"}, ""},
+		{10240, []string{"SIZE 100"}, fmt.Sprintf("mailer: the email size (%d bytes) exceeds the limit of 100 bytes", size)},
+		{100, []string{"SIZE"}, fmt.Sprintf("mailer: the email size (%d bytes) exceeds the limit of 100 bytes", size)},
+		{100, nil, fmt.Sprintf("mailer: the email size (%d bytes) exceeds the limit of 100 bytes", size)},
+		{0, []string{"SIZE 10240"}, ""},
+		{0, []string{"SIZE 100"}, fmt.Sprintf("mailer: the email size (%d bytes) exceeds the limit of 100 bytes", size)},
+	}
+	for _, test := range tests {
+		srv := &fakeServer{ext: test.ext}
+		srv.stub(t)
+		d := &Dialer{Host: testHost, Port: testPort, MaxMessageSize: test.max}
+		err := d.DialAndSend(m)
+		srv.wait()
+
+		if test.err != "" {
+			assert.EqualError(t, err, "mailer: could not send email 1: "+test.err)
+			assert.Equal(t, []string{"EHLO localhost", "QUIT"}, srv.cmds)
+			continue
+		}
+		assert.NoError(t, err)
+		assert.Equal(t, fmt.Sprintf("MAIL FROM:<from@example.com> SIZE=%d", size), srv.cmds[1])
+		compareBodies(t, srv.data.String(), string(b)+"\r\n")
+	}
+}
+
+func TestDialerMaxMessageSizeRetry(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Test")
+	assert.NoError(t, m.RequestDSN([]DSNEvent{DSNFailure}, DSNReturnHeaders))
+	b, err := m.Render()
+	assert.NoError(t, err)
+
+	// The DSN parameters and the size of the rendered email are still sent
+	// after falling back from pipelining on a new connection.
+	srv := &fakeServer{ext: []string{"PIPELINING", "DSN", "SIZE 10240"}, rejectPipelining: true}
+	srv.stub(t)
+	d := &Dialer{Host: testHost, Port: testPort, Pipelining: true, MaxMessageSize: 10240}
+	assert.NoError(t, d.DialAndSend(m))
+	srv.wait()
+
+	assert.Equal(t, []string{
+		fmt.Sprintf("MAIL FROM:<noreply@example.com> SIZE=%d RET=HDRS", len(b)),
+		"RCPT TO:<to@example.com> NOTIFY=FAILURE ORCPT=rfc822;to@example.com",
+		"DATA",
+		"QUIT",
+	}, srv.cmds[len(srv.cmds)-4:])
+}
+
+// fakeServer is an SMTP server stub serving a single connection.
+type fakeServer struct {
+	ext    []string
+	reject []string    // senders and recipients rejected by the server
+	tls    *tls.Config // configuration of the implicit TLS, if any
+	// rejectPipelining makes the server answer 500 to a MAIL command followed
+	// by other commands before its reply, and drop the connection.
+	rejectPipelining bool
+	cmds             []string
+	data             bytes.Buffer
+	done             chan struct{}
+}
+
+// stub makes the dialers connect to s with a net/smtp client.
+func (s *fakeServer) stub(t *testing.T) {
+	s.done = make(chan struct{})
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
+		client, server := tcpPipe(t)
+		if s.tls != nil {
+			server = tls.Server(server, s.tls)
+		}
+		go s.serve(t, server)
+		return client, nil
+	}
+	tlsClient = tls.Client
+	tlsHandshake = (*tls.Conn).Handshake
+	smtpNewClient = newSMTPClient
+}
+
+// tcpPipe returns both ends of a loopback TCP connection. Unlike net.Pipe, the
+// writes are buffered so a TLS handshake failure does not block.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, server
+}
+
+func (s *fakeServer) wait() {
+	<-s.done
+}
+
+func (s *fakeServer) rejects(rcpt string) bool {
+	for _, addr := range s.reject {
+		if strings.HasPrefix(rcpt, "RCPT TO:<"+addr+">") || strings.HasPrefix(rcpt, "MAIL FROM:<"+addr+">") {
+			return true
+		}
+	}
+	return false
+}
+
+// pipelined reports whether the client sent more commands without waiting for
+// the reply to the last one.
+func (s *fakeServer) pipelined(conn net.Conn, text *textproto.Conn) bool {
+	if text.R.Buffered() > 0 {
+		return true
+	}
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := text.R.Peek(1)
+	return err == nil
+}
+
+func (s *fakeServer) serve(t *testing.T, conn net.Conn) {
+	// The dropped connections are reconnected, so the server is done when the
+	// last one ends.
+	dropped := false
+	defer func() {
+		if !dropped {
+			close(s.done)
+		}
+	}()
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 %s ESMTP", testHost)
+	var transaction bool
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		s.cmds = append(s.cmds, line)
+
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO":
+			lines := append([]string{testHost}, s.ext...)
+			for i, l := range lines {
+				sep := "-"
+				if i == len(lines)-1 {
+					sep = " "
+				}
+				text.PrintfLine("250%s%s", sep, l)
+			}
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			data, err := text.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			// ReadDotBytes converts the line endings to LF.
+			s.data.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+			transaction = false
+			text.PrintfLine("250 OK")
+		case "BDAT":
+			var size int
+			fmt.Sscanf(line, "BDAT %d", &size)
+			if _, err := io.CopyN(&s.data, text.R, int64(size)); err != nil {
+				return
+			}
+			text.PrintfLine("250 OK")
+		case "RCPT":
+			if !transaction {
+				text.PrintfLine("503 5.5.1 Bad sequence of commands")
+			} else if s.rejects(line) {
+				text.PrintfLine("550 5.1.1 No such user")
+			} else {
+				text.PrintfLine("250 OK")
+			}
+		case "MAIL":
+			if s.rejectPipelining && s.pipelined(conn, text) {
+				text.PrintfLine("500 5.5.1 Command unrecognized")
+				dropped = true
+				return
+			}
+			if s.rejects(line) {
+				text.PrintfLine("550 5.7.1 Sender rejected")
+			} else {
+				transaction = true
+				text.PrintfLine("250 OK")
+			}
+		case "RSET":
+			transaction = false
+			text.PrintfLine("250 OK")
+		case "AUTH":
+			text.PrintfLine("235 Authenticated")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+// plaintextClient is a mockClient whose connection is not encrypted after
+// STARTTLS.
+type plaintextClient struct {
+	*mockClient
+}
+
+func (c *plaintextClient) TLSConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, false
+}
+
+// authClient is a poolClient advertising the PLAIN and LOGIN mechanisms.
+type authClient struct {
+	poolClient
+}
+
+func (c *authClient) Extension(ext string) (bool, string) {
+	if ext == "AUTH" {
+		return true, "PLAIN LOGIN"
+	}
+	return false, ""
+}
+
+func (c *authClient) Auth(a smtp.Auth) error {
+	if a == nil {
+		return errors.New("no auth")
+	}
+	return nil
+}
+
+// poolClient is a smtpClient safe to use in concurrent tests, it rejects the
+// "rejected@example.com" recipient and drops the connection when sending to
+// "dropped@example.com".
+type poolClient struct {
+	to   string
+	sent func(to string)
+	quit func()
+}
+
+func (c *poolClient) Hello(string) error              { return nil }
+func (c *poolClient) Extension(string) (bool, string) { return false, "" }
+func (c *poolClient) StartTLS(*tls.Config) error      { return nil }
+func (c *poolClient) Auth(smtp.Auth) error            { return nil }
+func (c *poolClient) Mail(string) error               { return nil }
+func (c *poolClient) Reset() error                    { return nil }
+func (c *poolClient) Close() error                    { return nil }
+func (c *poolClient) Quit() error                     { c.quit(); return nil }
+
+func (c *poolClient) Rcpt(to string) error {
+	if to == "rejected@example.com" {
+		return &textproto.Error{Code: 550, Msg: "no such user"}
+	}
+	c.to = to
+	return nil
+}
+
+func (c *poolClient) Data() (io.WriteCloser, error) {
+	if c.to == "dropped@example.com" {
+		return nil, io.EOF
+	}
+	return &poolWriter{c}, nil
+}
+
+type poolWriter struct {
+	c *poolClient
+}
+
+func (w *poolWriter) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (w *poolWriter) Close() error {
+	w.c.sent(w.c.to)
+	return nil
+}
+
 type mockClient struct {
 	t       *testing.T
 	i       int
@@ -160,6 +1710,13 @@ type mockClient struct {
 	addr    string
 	config  *tls.Config
 	timeout bool
+	data    func() error
+
+	resetTimeout bool
+	mailErrs     []error
+	auths        string
+	auth         smtp.Auth
+	unsupported  []string
 }
 
 func (c *mockClient) Hello(localName string) error {
@@ -169,6 +1726,14 @@ func (c *mockClient) Hello(localName string) error {
 
 func (c *mockClient) Extension(ext string) (bool, string) {
 	c.do("Extension " + ext)
+	for _, e := range c.unsupported {
+		if e == ext {
+			return false, ""
+		}
+	}
+	if ext == "AUTH" {
+		return true, c.auths
+	}
 	return true, ""
 }
 
@@ -179,7 +1744,11 @@ func (c *mockClient) StartTLS(config *tls.Config) error {
 }
 
 func (c *mockClient) Auth(a smtp.Auth) error {
-	assert.True(c.t, reflect.DeepEqual(a, testAuth), fmt.Sprintf("Invalid auth, got %#v, want %#v", a, testAuth))
+	want := c.auth
+	if want == nil {
+		want = testAuth
+	}
+	assert.True(c.t, reflect.DeepEqual(a, want), fmt.Sprintf("Invalid auth, got %#v, want %#v", a, want))
 	c.do("Auth")
 	return nil
 }
@@ -190,6 +1759,11 @@ func (c *mockClient) Mail(from string) error {
 		c.timeout = false
 		return io.EOF
 	}
+	if len(c.mailErrs) > 0 {
+		err := c.mailErrs[0]
+		c.mailErrs = c.mailErrs[1:]
+		return err
+	}
 	return nil
 }
 
@@ -200,9 +1774,23 @@ func (c *mockClient) Rcpt(to string) error {
 
 func (c *mockClient) Data() (io.WriteCloser, error) {
 	c.do("Data")
+	if c.data != nil {
+		if err := c.data(); err != nil {
+			return nil, err
+		}
+	}
 	return &mockWriter{c: c, want: testMsg}, nil
 }
 
+func (c *mockClient) Reset() error {
+	c.do("Reset")
+	if c.resetTimeout {
+		c.resetTimeout = false
+		return io.EOF
+	}
+	return nil
+}
+
 func (c *mockClient) Quit() error {
 	c.do("Quit")
 	return nil
@@ -255,8 +1843,14 @@ func doTestSendMail(t *testing.T, d *Dialer, want []string, timeout bool) {
 		config:  d.TLSConfig,
 		timeout: timeout,
 	}
+	stubDial(t, testClient, testConn)
+
+	err := d.DialAndSend(getTestMessage())
+	assert.NoError(t, err)
+}
 
-	netDialTimeout = func(network, address string, d time.Duration) (net.Conn, error) {
+func stubDial(t *testing.T, testClient *mockClient, testConn net.Conn) {
+	netDialTimeout = func(ctx context.Context, network, address string, d time.Duration) (net.Conn, error) {
 		assert.Equal(t, "tcp", network)
 		assert.Equal(t, testClient.addr, address)
 
@@ -268,14 +1862,12 @@ func doTestSendMail(t *testing.T, d *Dialer, want []string, timeout bool) {
 		assertConfig(t, config, testClient.config)
 		return testTLSConn
 	}
+	tlsHandshake = func(*tls.Conn) error { return nil }
 
 	smtpNewClient = func(conn net.Conn, host string) (smtpClient, error) {
 		assert.Equal(t, testHost, host)
 		return testClient, nil
 	}
-
-	err := d.DialAndSend(getTestMessage())
-	assert.NoError(t, err)
 }
 
 func assertConfig(t *testing.T, got, want *tls.Config) {
@@ -283,6 +1875,10 @@ func assertConfig(t *testing.T, got, want *tls.Config) {
 		want = &tls.Config{ServerName: testHost}
 	}
 
-	assert.Equal(t, want.ServerName, got.ServerName)
+	serverName := want.ServerName
+	if serverName == "" {
+		serverName = testHost
+	}
+	assert.Equal(t, serverName, got.ServerName)
 	assert.Equal(t, want.InsecureSkipVerify, got.InsecureSkipVerify)
 }
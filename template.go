@@ -0,0 +1,86 @@
+package mailer
+
+import (
+	"fmt"
+	"html/template"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type (
+	// TemplateCache keeps the templates parsed from files in memory so they
+	// are not read and parsed again each time an email is rendered. A template
+	// is parsed again when the modification time or the size of its file
+	// changes. The zero value is ready to use and it is safe for concurrent
+	// use.
+	TemplateCache struct {
+		// Dir is the directory holding the templates. By default, the
+		// EMAIL_TEMPLATE_DIR environment variable is used like ParseTemplate.
+		Dir string
+
+		mu        sync.Mutex
+		templates map[string]*cachedTemplate
+	}
+
+	cachedTemplate struct {
+		t       *template.Template
+		modTime time.Time
+		size    int64
+	}
+)
+
+// defaultTemplateCache is the cache used by BodyTemplate.
+var defaultTemplateCache = &TemplateCache{}
+
+// BodyTemplate is like ParseTemplateE but the parsed templates are cached in
+// memory, see TemplateCache.
+func BodyTemplate(name string, data interface{}) (string, error) {
+	return defaultTemplateCache.Execute(name, data)
+}
+
+// Execute executes the template of the file name with data. The returned error
+// wraps ErrParseTemplate when the template cannot be read or parsed, and
+// ErrExecuteTemplate when it fails to execute with data.
+func (c *TemplateCache) Execute(name string, data interface{}) (string, error) {
+	t, err := c.Template(name)
+	if err != nil {
+		return "", err
+	}
+
+	return executeTemplate(t, data)
+}
+
+// Template returns the parsed template of the file name, parsing it only if it
+// is not cached yet or if the file changed since it was parsed.
+func (c *TemplateCache) Template(name string) (*template.Template, error) {
+	dir := c.Dir
+	if dir == "" {
+		dir = os.Getenv("EMAIL_TEMPLATE_DIR")
+	}
+	filename := filepath.Join(dir, name)
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrParseTemplate, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ct, ok := c.templates[filename]; ok && ct.modTime.Equal(info.ModTime()) && ct.size == info.Size() {
+		return ct.t, nil
+	}
+
+	t, err := template.ParseFiles(filename)
+	if err != nil {
+		return nil, fmt.Errorf("%w, %v", ErrParseTemplate, err)
+	}
+
+	if c.templates == nil {
+		c.templates = make(map[string]*cachedTemplate)
+	}
+	c.templates[filename] = &cachedTemplate{t: t, modTime: info.ModTime(), size: info.Size()}
+	return t, nil
+}
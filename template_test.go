@@ -0,0 +1,54 @@
+package mailer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBodyTemplate(t *testing.T) {
+	got, err := BodyTemplate("_fixture/example.html", struct{ Name string }{Name: "Testing"})
+	assert.NoError(t, err)
+	assert.Equal(t, "Hi, Testing", got)
+
+	_, err = BodyTemplate("_fixture/missing.html", nil)
+	assert.True(t, errors.Is(err, ErrParseTemplate))
+
+	_, err = BodyTemplate("_fixture/example.html", struct{}{})
+	assert.True(t, errors.Is(err, ErrExecuteTemplate))
+}
+
+func TestTemplateCache(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "welcome.html")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("Hello {{.}}"), 0644))
+
+	c := &TemplateCache{Dir: dir}
+	t1, err := c.Template("welcome.html")
+	assert.NoError(t, err)
+	t2, err := c.Template("welcome.html")
+	assert.NoError(t, err)
+	assert.True(t, t1 == t2, "the template should be cached")
+
+	got, err := c.Execute("welcome.html", "Bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello Bob", got)
+
+	// The template is parsed again when its file changes.
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("Welcome {{.}}"), 0644))
+	later := time.Now().Add(time.Hour)
+	assert.NoError(t, os.Chtimes(filename, later, later))
+
+	got, err = c.Execute("welcome.html", "Bob")
+	assert.NoError(t, err)
+	assert.Equal(t, "Welcome Bob", got)
+
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("{{.Broken"), 0644))
+	_, err = c.Execute("welcome.html", "Bob")
+	assert.True(t, errors.Is(err, ErrParseTemplate))
+}
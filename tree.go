@@ -0,0 +1,185 @@
+package mailer
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// An Entity is a node of the MIME tree of an email set with Message.SetTree:
+// a part such as a plain text or an HTML body, a file, or a multipart entity
+// holding other entities. Entities are created with the methods of the
+// Message they are used in, so the parts get its charset and encoding.
+type Entity struct {
+	// subtype is the multipart subtype, it is empty for the parts and the
+	// files.
+	subtype  string
+	children []*Entity
+
+	part       *part
+	file       *file
+	attachment bool
+}
+
+// SetTree sets the MIME structure of the email to the tree root, instead of
+// the structure chosen from the parts, attachments and embedded files. It is
+// useful when the default structure does not suit the clients, for example to
+// put the HTML part and its inline images in a multipart/related entity inside
+// the multipart/alternative one:
+//
+//	m.SetTree(m.Alternative(
+//		m.Plain(text),
+//		m.Related(m.HTML(html), m.Embedded("/tmp/logo.png")),
+//	))
+//
+// While a tree is set, the content added with SetBody, AddAlternative, Attach,
+// Embed and similar methods is not written and AutoPlainText has no effect.
+// SetTree(nil) reverts to the default structure.
+func (m *Message) SetTree(root *Entity) {
+	m.tree = root
+}
+
+// Multipart returns a multipart entity of the given subtype, such as "mixed",
+// "related" or "alternative", holding the entities in order.
+func (m *Message) Multipart(subtype string, entities ...*Entity) *Entity {
+	return &Entity{subtype: strings.ToLower(subtype), children: entities}
+}
+
+// Mixed returns a multipart/mixed entity, typically holding the body of the
+// email followed by its attachments.
+func (m *Message) Mixed(entities ...*Entity) *Entity {
+	return m.Multipart("mixed", entities...)
+}
+
+// Alternative returns a multipart/alternative entity whose entities are
+// versions of the same content, from the simplest to the richest.
+func (m *Message) Alternative(entities ...*Entity) *Entity {
+	return m.Multipart("alternative", entities...)
+}
+
+// Related returns a multipart/related entity, typically holding an HTML part
+// followed by the embedded files it references.
+func (m *Message) Related(entities ...*Entity) *Entity {
+	return m.Multipart("related", entities...)
+}
+
+// Part returns a part of the given content type, like the one added by
+// AddAlternative.
+func (m *Message) Part(contentType, body string, settings ...PartSetting) *Entity {
+	return &Entity{part: m.newStringPart(contentType, body, settings)}
+}
+
+// PartWriter returns a part of the given content type whose content is written
+// by f, like the one added by AddAlternativeWriter.
+func (m *Message) PartWriter(contentType string, f func(io.Writer) error, settings ...PartSetting) *Entity {
+	return &Entity{part: m.newPart(contentType, f, settings)}
+}
+
+// Plain returns a text/plain part.
+func (m *Message) Plain(body string, settings ...PartSetting) *Entity {
+	return m.Part("text/plain", body, settings...)
+}
+
+// HTML returns a text/html part.
+func (m *Message) HTML(body string, settings ...PartSetting) *Entity {
+	return m.Part("text/html", body, settings...)
+}
+
+// Attachment returns a file attachment, like the one added by Attach. The
+// content of the file can be given with SetCopyFunc.
+func (m *Message) Attachment(filename string, settings ...FileSetting) *Entity {
+	return &Entity{file: m.appendFile(nil, filename, settings)[0], attachment: true}
+}
+
+// Embedded returns an embedded file, like the one added by Embed. The content
+// of the file can be given with SetCopyFunc.
+func (m *Message) Embedded(filename string, settings ...FileSetting) *Entity {
+	return &Entity{file: m.appendFile(nil, filename, settings)[0]}
+}
+
+// clone returns a deep copy of e.
+func (e *Entity) clone() *Entity {
+	if e == nil {
+		return nil
+	}
+	c := *e
+	if e.part != nil {
+		cp := *e.part
+		c.part = &cp
+	}
+	if e.file != nil {
+		c.file = cloneFiles([]*file{e.file})[0]
+	}
+	if e.children != nil {
+		c.children = make([]*Entity, len(e.children))
+		for i, child := range e.children {
+			c.children[i] = child.clone()
+		}
+	}
+	return &c
+}
+
+// errNilEntity is returned when the tree set with Message.SetTree holds a nil
+// Entity.
+var errNilEntity = errors.New("mailer: nil Entity in the MIME tree")
+
+// leaves returns the parts, the embedded files and the attachments of the
+// tree e in order, and errNilEntity if a nil entity was skipped.
+func (e *Entity) leaves() (parts []*part, embedded, attachments []*file, err error) {
+	var walk func(*Entity)
+	walk = func(e *Entity) {
+		switch {
+		case e == nil:
+			err = errNilEntity
+		case e.part != nil:
+			parts = append(parts, e.part)
+		case e.file != nil && e.attachment:
+			attachments = append(attachments, e.file)
+		case e.file != nil:
+			embedded = append(embedded, e.file)
+		default:
+			for _, child := range e.children {
+				walk(child)
+			}
+		}
+	}
+	walk(e)
+	return parts, embedded, attachments, err
+}
+
+// treePart returns p with the transformations of writtenParts which apply to
+// a single part.
+func (m *Message) treePart(p *part) *part {
+	parts := []*part{p}
+	if m.inlineCSS {
+		parts = inlineCSSParts(parts)
+	}
+	if m.autoEncoding && !m.encodingSet {
+		parts = autoEncodeParts(parts)
+	}
+	return parts[0]
+}
+
+func (w *messageWriter) writeEntity(m *Message, e *Entity) {
+	if w.err != nil {
+		return
+	}
+	switch {
+	case e == nil:
+		w.err = errNilEntity
+	case e.part != nil:
+		w.writePart(m.treePart(e.part), m.charset)
+	case e.file != nil:
+		w.addFiles([]*file{e.file}, e.attachment)
+	default:
+		if int(w.depth) == len(w.writers) {
+			w.err = errors.New("mailer: too many nested multipart entities")
+			return
+		}
+		w.openMultipart(e.subtype)
+		for _, child := range e.children {
+			w.writeEntity(m, child)
+		}
+		w.closeMultipart()
+	}
+}
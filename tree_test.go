@@ -0,0 +1,150 @@
+package mailer
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetTree(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetBody("text/plain", "Ignored")
+	m.Attach(mockCopyFile("ignored.pdf"))
+	m.SetTree(m.Mixed(
+		m.Alternative(
+			m.Plain("Test"),
+			m.Related(
+				m.HTML("<img src=\"cid:image.jpg\">"),
+				m.Embedded(mockCopyFile("image.jpg")),
+			),
+		),
+		m.Attachment(mockCopyFile("test.pdf")),
+	))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: multipart/mixed;\r\n" +
+			" boundary=_BOUNDARY_1_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: multipart/alternative;\r\n" +
+			" boundary=_BOUNDARY_2_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: text/plain; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"Test\r\n" +
+			"--_BOUNDARY_2_\r\n" +
+			"Content-Type: multipart/related;\r\n" +
+			" boundary=_BOUNDARY_3_\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_3_\r\n" +
+			"Content-Type: text/html; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: quoted-printable\r\n" +
+			"\r\n" +
+			"<img src=3D\"cid:image.jpg\">\r\n" +
+			"--_BOUNDARY_3_\r\n" +
+			"Content-Type: image/jpeg; name=\"image.jpg\"\r\n" +
+			"Content-Disposition: inline; filename=\"image.jpg\"\r\n" +
+			"Content-ID: <image.jpg>\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of image.jpg")) + "\r\n" +
+			"--_BOUNDARY_3_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_2_--\r\n" +
+			"\r\n" +
+			"--_BOUNDARY_1_\r\n" +
+			"Content-Type: application/pdf; name=\"test.pdf\"\r\n" +
+			"Content-Disposition: attachment; filename=\"test.pdf\"\r\n" +
+			"Content-Transfer-Encoding: base64\r\n" +
+			"\r\n" +
+			base64.StdEncoding.EncodeToString([]byte("Content of test.pdf")) + "\r\n" +
+			"--_BOUNDARY_1_--\r\n",
+	}
+
+	testMessage(t, m, 3, want)
+
+	c := m.Clone()
+	m.SetTree(nil)
+	b, err := m.Render()
+	assert.NoError(t, err)
+	assert.Contains(t, string(b), "ignored.pdf")
+
+	b, err = c.Render()
+	assert.NoError(t, err)
+	assert.NotContains(t, string(b), "ignored.pdf")
+	assert.Contains(t, string(b), "test.pdf")
+}
+
+func TestSetTreeSinglePart(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("From", "from@example.com")
+	m.SetHeader("To", "to@example.com")
+	m.SetTree(m.Part("text/markdown", "*Test*", SetPartEncoding(Unencoded)))
+
+	want := &message{
+		from: "from@example.com",
+		to:   []string{"to@example.com"},
+		content: "From: from@example.com\r\n" +
+			"To: to@example.com\r\n" +
+			"Content-Type: text/markdown; charset=UTF-8\r\n" +
+			"Content-Transfer-Encoding: 8bit\r\n" +
+			"\r\n" +
+			"*Test*",
+	}
+
+	testMessage(t, m, 0, want)
+}
+
+func TestSetTreeTooDeep(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	m.SetTree(m.Mixed(m.Alternative(m.Related(m.Multipart("digest", m.Plain("Test"))))))
+
+	_, err := m.Render()
+	assert.EqualError(t, err, "mailer: too many nested multipart entities")
+}
+
+func TestSetTreeNilEntity(t *testing.T) {
+	m := NewMessage()
+	m.SetHeader("To", "to@example.com")
+	var missing *Entity
+	m.SetTree(m.Mixed(m.Alternative(m.Plain("Test"), missing), m.Attachment("report.pdf")))
+
+	_, err := m.Render()
+	assert.EqualError(t, err, "mailer: nil Entity in the MIME tree")
+	assert.True(t, m.EstimatedSize() > 0)
+	assert.NotNil(t, m.Clone())
+
+	_, err = m.sendGridMail("from@example.com", []string{"to@example.com"})
+	assert.EqualError(t, err, "mailer: nil Entity in the MIME tree")
+}
+
+func TestEntityLeaves(t *testing.T) {
+	m := NewMessage()
+	tree := m.Mixed(
+		m.Alternative(m.Plain("Test"), m.Related(m.HTML("Test"), m.Embedded("image.jpg"))),
+		m.Attachment("test.pdf"),
+	)
+
+	parts, embedded, attachments, err := tree.leaves()
+	assert.NoError(t, err)
+	if assert.Len(t, parts, 2) {
+		assert.Equal(t, "text/plain", parts[0].contentType)
+		assert.Equal(t, "text/html", parts[1].contentType)
+	}
+	if assert.Len(t, embedded, 1) {
+		assert.Equal(t, "image.jpg", embedded[0].Name)
+	}
+	if assert.Len(t, attachments, 1) {
+		assert.Equal(t, "test.pdf", attachments[0].Name)
+	}
+}
@@ -2,14 +2,24 @@ package mailer
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
 	"mime"
 	"mime/quotedprintable"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
 )
 
 type (
@@ -21,6 +31,14 @@ type (
 		Name     string
 		Header   map[string][]string
 		CopyFunc func(w io.Writer) error
+
+		mediaType string
+		// size returns the size of the content of the file, or -1 if it is
+		// unknown. It is nil when the content is written by a SetCopyFunc.
+		size func() int64
+		// modTime and creationTime are the dates added to the
+		// "Content-Disposition" header, if they are set.
+		modTime, creationTime time.Time
 	}
 
 	// header type represents an request header
@@ -29,6 +47,9 @@ type (
 	// Encoding represents a MIME encoding scheme like quoted-printable or base64.
 	Encoding string
 
+	// Priority represents the priority of an email as displayed by clients.
+	Priority int
+
 	// A MessageSetting can be used as an argument in NewMessage to configure an email.
 	MessageSetting func(m *Message)
 
@@ -39,6 +60,11 @@ type (
 		contentType string
 		copier      func(io.Writer) error
 		encoding    Encoding
+		// encodingSet records that encoding was set with SetPartEncoding.
+		encodingSet bool
+		// body is the content of the part when it is given as a string, for
+		// Message.EstimatedSize.
+		body *string
 	}
 
 	// A PartSetting can be used as an argument in Message.SetBody,
@@ -50,10 +76,41 @@ type (
 	base64LineWriter struct {
 		w       io.Writer
 		lineLen int
+		buf     []byte
+	}
+
+	// crlfWriter converts the lone LF line endings of unencoded text to CRLF,
+	// as required by SMTP and MIME.
+	crlfWriter struct {
+		w   io.Writer
+		cr  bool
+		buf []byte
+	}
+
+	// sevenBitWriter rejects the content which is not 7-bit ASCII, see
+	// Encoding7bit.
+	sevenBitWriter struct {
+		w io.Writer
+	}
+
+	// urlQPWriter is a quoted-printable writer which inserts its soft line
+	// breaks before the URLs rather than inside them, see KeepURLs. Each line
+	// of the input is buffered until it is complete.
+	urlQPWriter struct {
+		w    io.Writer
+		line []byte
+		buf  []byte
 	}
 )
 
 var (
+	// ErrParseTemplate is wrapped by the errors returned when a template
+	// cannot be read or parsed.
+	ErrParseTemplate = errors.New("mailer: Error when parsing template")
+	// ErrExecuteTemplate is wrapped by the errors returned when a template
+	// fails to execute with the given data.
+	ErrExecuteTemplate = errors.New("mailer: Error when compiling template")
+
 	newQPWriter   = quotedprintable.NewWriter
 	bEncoding     = mimeEncoder{mime.BEncoding}
 	qEncoding     = mimeEncoder{mime.QEncoding}
@@ -67,36 +124,313 @@ const (
 	// Base64 represents the base64 encoding as defined in RFC 2045.
 	Base64 Encoding = "base64"
 	// Unencoded can be used to avoid encoding the body of an email. The headers
-	// will still be encoded using quoted-printable encoding.
+	// will still be encoded using quoted-printable encoding and the lone LF
+	// line endings of the body are converted to CRLF.
 	Unencoded Encoding = "8bit"
+	// Encoding7bit declares ASCII-only content, which is written as is like
+	// with Unencoded. Writing a byte which is not 7-bit ASCII fails.
+	Encoding7bit Encoding = "7bit"
 
 	// As required by RFC 2045, 6.7. (page 21) for quoted-printable, and
 	// RFC 2045, 6.8. (page 25) for base64.
 	maxLineLen = 76
 )
 
+const (
+	// PriorityNormal is the default priority of an email.
+	PriorityNormal Priority = iota
+	// PriorityHigh marks an email as urgent.
+	PriorityHigh
+	// PriorityLow marks an email as non-urgent.
+	PriorityLow
+)
+
 func (f *file) setHeader(field, value string) {
 	f.Header[field] = []string{value}
 }
 
+// setDefaultHeaders sets the mandatory MIME headers of the part containing
+// the file which are not already set.
+func (f *file) setDefaultHeaders(isAttachment bool) {
+	if _, ok := f.Header["Content-Type"]; !ok {
+		mediaType := f.mediaType
+		if mediaType == "" {
+			mediaType = mime.TypeByExtension(filepath.Ext(f.Name))
+		}
+		if mediaType == "" {
+			mediaType = "application/octet-stream"
+		}
+		f.setHeader("Content-Type", mediaType+"; "+fileParam("name", f.Name))
+	}
+
+	if _, ok := f.Header["Content-Transfer-Encoding"]; !ok {
+		f.setHeader("Content-Transfer-Encoding", string(Base64))
+	}
+
+	if _, ok := f.Header["Content-Disposition"]; !ok {
+		var disp string
+		if isAttachment {
+			disp = "attachment"
+		} else {
+			disp = "inline"
+		}
+		disp += "; " + fileParam("filename", f.Name)
+		if !f.creationTime.IsZero() {
+			disp += `; creation-date="` + f.creationTime.Format(time.RFC1123Z) + `"`
+		}
+		if !f.modTime.IsZero() {
+			disp += `; modification-date="` + f.modTime.Format(time.RFC1123Z) + `"`
+		}
+		f.setHeader("Content-Disposition", disp)
+	}
+
+	if !isAttachment {
+		if _, ok := f.Header["Content-ID"]; !ok {
+			f.setHeader("Content-ID", "<"+f.Name+">")
+		}
+	}
+}
+
+// fileParam formats the MIME parameter param holding the file name. A name
+// which is not ASCII is encoded as described in RFC 2231, split in continuations
+// so that the header can be folded, and preceded by an ASCII version of the name
+// for the clients which do not support it.
+func fileParam(param, name string) string {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace
+	if isASCII(name) {
+		return param + `="` + quote(name) + `"`
+	}
+
+	var b strings.Builder
+	b.WriteString(param + `="` + quote(asciiFileName(name)) + `"`)
+	var segments []string
+	var seg strings.Builder
+	for i := 0; i < len(name); i++ {
+		if seg.Len() >= maxParamSegmentLen {
+			segments = append(segments, seg.String())
+			seg.Reset()
+		}
+		c := name[i]
+		if isAttrChar(c) {
+			seg.WriteByte(c)
+		} else {
+			fmt.Fprintf(&seg, "%%%02X", c)
+		}
+	}
+	segments = append(segments, seg.String())
+
+	if len(segments) == 1 {
+		b.WriteString("; " + param + "*=UTF-8''" + segments[0])
+		return b.String()
+	}
+	for i, seg := range segments {
+		b.WriteString("; " + param + "*" + strconv.Itoa(i) + "*=")
+		if i == 0 {
+			b.WriteString("UTF-8''")
+		}
+		b.WriteString(seg)
+	}
+	return b.String()
+}
+
+// maxParamSegmentLen is the length above which the value of an RFC 2231
+// parameter is continued in another segment.
+const maxParamSegmentLen = 50
+
+// asciiFileName returns the name with the diacritics removed and the other
+// characters which are not ASCII replaced with underscores.
+func asciiFileName(name string) string {
+	var b strings.Builder
+	for _, r := range norm.NFD.String(name) {
+		switch {
+		case r < utf8.RuneSelf:
+			b.WriteRune(r)
+		case !unicode.Is(unicode.Mn, r):
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+// isAttrChar reports whether c can be used unencoded in an RFC 5987 value.
+func isAttrChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$&+-.^_`|~", c) != -1
+}
+
 func newBase64LineWriter(w io.Writer) *base64LineWriter {
 	return &base64LineWriter{w: w}
 }
 
+// Write writes p with the line breaks inserted in a single call to the
+// underlying writer, the buffer holding the output being reused between calls.
 func (w *base64LineWriter) Write(p []byte) (int, error) {
-	n := 0
+	n := len(p)
+	w.buf = w.buf[:0]
 	for len(p)+w.lineLen > maxLineLen {
-		w.w.Write(p[:maxLineLen-w.lineLen])
-		w.w.Write([]byte("\r\n"))
+		w.buf = append(w.buf, p[:maxLineLen-w.lineLen]...)
+		w.buf = append(w.buf, '\r', '\n')
 		p = p[maxLineLen-w.lineLen:]
-		n += maxLineLen - w.lineLen
 		w.lineLen = 0
 	}
-
-	w.w.Write(p)
+	w.buf = append(w.buf, p...)
 	w.lineLen += len(p)
 
-	return n + len(p), nil
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Write writes p with a CR inserted before each LF which does not follow one,
+// including across calls.
+func (w *crlfWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	if n == 0 {
+		return 0, nil
+	}
+	if bytes.IndexByte(p, '\n') == -1 {
+		w.cr = p[n-1] == '\r'
+		return w.w.Write(p)
+	}
+
+	w.buf = w.buf[:0]
+	for _, c := range p {
+		if c == '\n' && !w.cr {
+			w.buf = append(w.buf, '\r')
+		}
+		w.buf = append(w.buf, c)
+		w.cr = c == '\r'
+	}
+
+	if _, err := w.w.Write(w.buf); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (w sevenBitWriter) Write(p []byte) (int, error) {
+	for _, c := range p {
+		if c > 127 {
+			return 0, fmt.Errorf("mailer: the content of a 7bit part has the non-ASCII byte 0x%02X", c)
+		}
+	}
+	return w.w.Write(p)
+}
+
+func newURLQPWriter(w io.Writer) *urlQPWriter {
+	return &urlQPWriter{w: w}
+}
+
+// Write encodes the complete lines of p, the rest being kept until its line
+// ends.
+func (w *urlQPWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i == -1 {
+			w.line = append(w.line, p...)
+			break
+		}
+		w.line = append(w.line, p[:i]...)
+		p = p[i+1:]
+		if err := w.writeLine(true); err != nil {
+			return 0, err
+		}
+	}
+	return n, nil
+}
+
+// Close encodes the last line if it does not end with a line break.
+func (w *urlQPWriter) Close() error {
+	if len(w.line) == 0 {
+		return nil
+	}
+	return w.writeLine(false)
+}
+
+// writeLine encodes the buffered line. The line is broken like
+// quotedprintable.Writer does, except that a URL which would be split while it
+// fits on a line of its own is moved to the next line.
+func (w *urlQPWriter) writeLine(eol bool) error {
+	line := w.line
+	if eol && len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+
+	w.buf = w.buf[:0]
+	n := 0
+	softBreak := func() {
+		w.buf = append(w.buf, "=\r\n"...)
+		n = 0
+	}
+	urlEnd := -1
+	for i := 0; i < len(line); i++ {
+		if i > urlEnd {
+			if end := urlAt(line, i); end != -1 {
+				urlEnd = end - 1
+				if size := qpSize(line[i:end]); n > 0 && n+size > maxLineLen-1 && size <= maxLineLen-1 {
+					softBreak()
+				}
+			}
+		}
+
+		c := line[i]
+		size := 1
+		encode := !(c >= '!' && c <= '~' && c != '=') && !((c == ' ' || c == '\t') && i != len(line)-1)
+		if encode {
+			size = 3
+		}
+		if n+size > maxLineLen-1 {
+			softBreak()
+		}
+		if encode {
+			w.buf = append(w.buf, '=', upperhex[c>>4], upperhex[c&0x0f])
+		} else {
+			w.buf = append(w.buf, c)
+		}
+		n += size
+	}
+	if eol {
+		w.buf = append(w.buf, '\r', '\n')
+	}
+	w.line = w.line[:0]
+
+	_, err := w.w.Write(w.buf)
+	return err
+}
+
+const upperhex = "0123456789ABCDEF"
+
+// urlAt returns the end of the http or https URL starting at line[i], or -1 if
+// there is none.
+func urlAt(line []byte, i int) int {
+	if i > 0 && isWordChar(line[i-1]) {
+		return -1
+	}
+	rest := line[i:]
+	if !bytes.HasPrefix(rest, []byte("http://")) && !bytes.HasPrefix(rest, []byte("https://")) {
+		return -1
+	}
+	end := bytes.IndexAny(rest, " \t\r<>\"")
+	if end == -1 {
+		end = len(rest)
+	}
+	return i + end
+}
+
+// qpSize returns the length of the quoted-printable encoding of the ASCII
+// text s.
+func qpSize(s []byte) int {
+	size := 0
+	for _, c := range s {
+		if c >= '!' && c <= '~' && c != '=' {
+			size++
+		} else {
+			size += 3
+		}
+	}
+	return size
 }
 
 // SetCharset is a message setting to set the charset of the email.
@@ -110,24 +444,190 @@ func SetCharset(charset string) MessageSetting {
 func SetEncoding(enc Encoding) MessageSetting {
 	return func(m *Message) {
 		m.encoding = enc
+		m.encodingSet = true
 	}
 }
 
-// ParseTemplate perform template parsing from path into template html
+// AutoEncoding is a message setting to choose the encoding of each part of the
+// email between quoted-printable and base64 when it is written, whichever
+// gives the smaller output for its content: quoted-printable for mostly ASCII
+// text and base64 for text with a lot of non-ASCII characters. It has no effect
+// with SetEncoding and on the parts added with SetPartEncoding. Each part is
+// rendered in memory to be measured.
+func AutoEncoding() MessageSetting {
+	return func(m *Message) {
+		m.autoEncoding = true
+	}
+}
+
+// AutoHeaderEncoding is a message setting to encode each header value which is
+// not ASCII with whichever of the B (base64) and Q (quoted-printable) encodings
+// of RFC 2047 gives the shorter output, instead of the one matching the
+// encoding of the body: B for mostly non-ASCII text, such as a subject in
+// Japanese, and Q for mostly ASCII text with a few accented letters.
+func AutoHeaderEncoding() MessageSetting {
+	return func(m *Message) {
+		m.autoHEncoding = true
+	}
+}
+
+// KeepURLs is a message setting to keep the http and https URLs of the
+// quoted-printable parts on a single line whenever they fit on one: the soft
+// line break is inserted before a URL rather than inside it. The decoded
+// content is the same, but a URL survives the clients and filters which wrap
+// the encoded lines again or do not decode the soft line breaks. The URLs
+// longer than a line are still split.
+func KeepURLs() MessageSetting {
+	return func(m *Message) {
+		m.keepURLs = true
+	}
+}
+
+// SetBoundary is a message setting to use deterministic boundaries for the
+// multipart entities of the email instead of random ones, for example to
+// compare the output of WriteTo with a snapshot in tests. The n-th multipart
+// entity written gets the boundary prefix followed by "_n". The boundaries
+// must be made of at most 70 letters, digits and characters among
+// '()+_,-./:=? and must not appear in the content of the email, writing the
+// email fails if they are invalid.
+func SetBoundary(prefix string) MessageSetting {
+	return func(m *Message) {
+		m.boundary = prefix
+	}
+}
+
+// WithConfig is a message setting to set the "From" header of the email from
+// the sender of cfg instead of the global Config.
+func WithConfig(cfg ConfigMailer) MessageSetting {
+	return func(m *Message) {
+		m.config = &cfg
+	}
+}
+
+// SetNoDefaultDate is a message setting to not add the "Date" header set to
+// the current time when the email is written. A "Date" header set with
+// SetDateHeader or SetHeader is still written.
+func SetNoDefaultDate() MessageSetting {
+	return func(m *Message) {
+		m.noDefaultDate = true
+	}
+}
+
+// SetClock is a message setting to set the function returning the current
+// time used for the default "Date" header, instead of time.Now. It lets tests
+// render emails deterministically without changing any global state.
+func SetClock(clock func() time.Time) MessageSetting {
+	return func(m *Message) {
+		m.clock = clock
+	}
+}
+
+// AutoPlainText is a message setting to automatically add a plain text
+// alternative to emails which only have an HTML body, as many clients and spam
+// filters penalize HTML-only emails. The text is derived from the HTML when the
+// email is written by stripping the tags, keeping the link URLs in parentheses.
+func AutoPlainText() MessageSetting {
+	return func(m *Message) {
+		m.autoPlainText = true
+	}
+}
+
+// InlineCSS is a message setting to move the CSS rules of the <style> blocks of
+// the HTML bodies into the style attributes of the elements they match when
+// the email is written, since many email clients ignore <style> blocks. The
+// rules using type, class and ID selectors, such as "p", ".note" or
+// "td#total", are inlined while the other ones and the media queries are kept
+// in a <style> block.
+func InlineCSS() MessageSetting {
+	return func(m *Message) {
+		m.inlineCSS = true
+	}
+}
+
+// AutoMessageID is a message setting to automatically add a "Message-ID"
+// header generated by GenerateMessageID when the email is written, unless it
+// is set with SetMessageID. If domain is empty, the domain of the "From"
+// address is used.
+func AutoMessageID(domain string) MessageSetting {
+	return func(m *Message) {
+		m.autoMessageID = true
+		m.idDomain = domain
+	}
+}
+
+// GenerateMessageID returns a new unique RFC 5322 message identifier of the
+// form "<random@domain>" using crypto/rand.
+func GenerateMessageID(domain string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("mailer: could not generate Message-ID: %v", err)
+	}
+
+	return "<" + strconv.FormatInt(now().UnixNano(), 36) + "." + hex.EncodeToString(b) + "@" + domain + ">", nil
+}
+
+// validateMessageID checks that id is a bracketed RFC 5322 message identifier.
+func validateMessageID(id string) error {
+	at := strings.IndexByte(id, '@')
+	if len(id) < 5 || id[0] != '<' || id[len(id)-1] != '>' || at < 2 || at > len(id)-3 ||
+		strings.ContainsAny(id, " \t\r\n") || strings.Count(id, "<") != 1 || strings.Count(id, ">") != 1 {
+		return fmt.Errorf("mailer: invalid message ID %q, it must be of the form <id@domain>", id)
+	}
+	return nil
+}
+
+// ParseTemplate perform template parsing from path into template html, it
+// panics on error, use ParseTemplateE to get the error instead.
 func ParseTemplate(filename string, data interface{}) string {
+	return mustTemplate(ParseTemplateE(filename, data))
+}
+
+// ParseTemplateE perform template parsing from path into template html. The
+// returned error wraps ErrParseTemplate when the template cannot be read or
+// parsed, and ErrExecuteTemplate when it fails to execute with data.
+func ParseTemplateE(filename string, data interface{}) (string, error) {
 	tf := filepath.Join(os.Getenv("EMAIL_TEMPLATE_DIR"), filename)
 
 	t, err := template.ParseFiles(tf)
 	if err != nil {
-		panic("mailer: Error when parsing template, " + err.Error())
+		return "", fmt.Errorf("%w, %v", ErrParseTemplate, err)
 	}
 
+	return executeTemplate(t, data)
+}
+
+// ParseTemplateFS perform template parsing from the file name of fsys into
+// template html, it is useful with templates shipped in an embed.FS. It panics
+// on error, use ParseTemplateFSE to get the error instead.
+func ParseTemplateFS(fsys fs.FS, name string, data interface{}) string {
+	return mustTemplate(ParseTemplateFSE(fsys, name, data))
+}
+
+// ParseTemplateFSE is like ParseTemplateE but reads the template from fsys.
+func ParseTemplateFSE(fsys fs.FS, name string, data interface{}) (string, error) {
+	t, err := template.ParseFS(fsys, name)
+	if err != nil {
+		return "", fmt.Errorf("%w, %v", ErrParseTemplate, err)
+	}
+
+	return executeTemplate(t, data)
+}
+
+func executeTemplate(t *template.Template, data interface{}) (string, error) {
 	buf := new(bytes.Buffer)
 	if err := t.Execute(buf, data); err != nil {
-		panic("mailer: Error when compiling template, " + err.Error())
+		return "", fmt.Errorf("%w, %v", ErrExecuteTemplate, err)
 	}
 
-	return buf.String()
+	return buf.String(), nil
+}
+
+func mustTemplate(s string, err error) string {
+	if err != nil {
+		panic(err.Error())
+	}
+
+	return s
 }
 
 func hasSpecials(text string) bool {
@@ -141,6 +641,41 @@ func hasSpecials(text string) bool {
 	return false
 }
 
+// isLanguageTag loosely checks that s is a BCP 47 language tag.
+func isLanguageTag(s string) bool {
+	if s == "" || s[0] == '-' || s[len(s)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// isIANAToken checks that s is an iCalendar iana-token as defined in RFC 5545.
+func isIANAToken(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+
+	return true
+}
+
 func newCopier(s string) func(io.Writer) error {
 	return func(w io.Writer) error {
 		_, err := io.WriteString(w, s)
@@ -148,6 +683,76 @@ func newCopier(s string) func(io.Writer) error {
 	}
 }
 
+func newReaderCopier(r io.Reader) func(io.Writer) error {
+	return func(w io.Writer) error {
+		c, isCloser := r.(io.Closer)
+		if _, err := io.Copy(w, r); err != nil {
+			if isCloser {
+				c.Close()
+			}
+			return err
+		}
+		if isCloser {
+			return c.Close()
+		}
+		return nil
+	}
+}
+
+// readerSettings prepends a copy function streaming from r to settings, so a
+// SetCopyFunc given by the caller still takes precedence.
+func readerSettings(r io.Reader, settings []FileSetting) []FileSetting {
+	size := func() int64 {
+		switch r := r.(type) {
+		case interface{ Len() int }:
+			return int64(r.Len())
+		case interface{ Stat() (fs.FileInfo, error) }:
+			if info, err := r.Stat(); err == nil {
+				return info.Size()
+			}
+		}
+		return -1
+	}
+	return append([]FileSetting{SetCopyFunc(newReaderCopier(r)), fileSize(size)}, settings...)
+}
+
+// bytesSettings is like readerSettings but reads from a new reader over b
+// every time the message is written, so it can be sent more than once.
+func bytesSettings(b []byte, settings []FileSetting) []FileSetting {
+	copyFunc := func(w io.Writer) error {
+		return newReaderCopier(bytes.NewReader(b))(w)
+	}
+	size := func() int64 { return int64(len(b)) }
+	return append([]FileSetting{SetCopyFunc(copyFunc), fileSize(size)}, settings...)
+}
+
+// fsSettings is like readerSettings but opens the file name of fsys every
+// time the message is written.
+func fsSettings(fsys fs.FS, name string, settings []FileSetting) []FileSetting {
+	copyFunc := func(w io.Writer) error {
+		f, err := fsys.Open(name)
+		if err != nil {
+			return err
+		}
+		return newReaderCopier(f)(w)
+	}
+	size := func() int64 {
+		if info, err := fs.Stat(fsys, name); err == nil {
+			return info.Size()
+		}
+		return -1
+	}
+	return append([]FileSetting{SetCopyFunc(copyFunc), fileSize(size)}, settings...)
+}
+
+// fileSize records how to get the size of the content of the file, for
+// Message.EstimatedSize.
+func fileSize(size func() int64) FileSetting {
+	return func(f *file) {
+		f.size = size
+	}
+}
+
 // SetHeader is a file setting to set the MIME header of the message part that
 // contains the file content.
 //
@@ -169,6 +774,43 @@ func Rename(name string) FileSetting {
 	}
 }
 
+// ContentType is a file setting to set the media type of the file, such as
+// "application/pdf", instead of guessing it from the extension of its name.
+// The name parameter is still added to the "Content-Type" header, so it can be
+// combined with Rename.
+func ContentType(mediaType string) FileSetting {
+	return func(f *file) {
+		f.mediaType = mediaType
+	}
+}
+
+// ContentID is a file setting to set the "Content-ID" header of the file so it
+// can be referenced from an HTML body with a cid: URL, such as
+// <img src="cid:logo"> for ContentID("logo"). The angle brackets are added if
+// id does not have them. By default, embedded files use their name.
+func ContentID(id string) FileSetting {
+	value := "<" + strings.TrimSuffix(strings.TrimPrefix(id, "<"), ">") + ">"
+	return func(f *file) {
+		f.setHeader("Content-ID", value)
+	}
+}
+
+// ModTime is a file setting to add the modification-date parameter (RFC 2183)
+// to the "Content-Disposition" header of the file, which some clients display.
+func ModTime(t time.Time) FileSetting {
+	return func(f *file) {
+		f.modTime = t
+	}
+}
+
+// CreationTime is a file setting to add the creation-date parameter (RFC 2183)
+// to the "Content-Disposition" header of the file.
+func CreationTime(t time.Time) FileSetting {
+	return func(f *file) {
+		f.creationTime = t
+	}
+}
+
 // SetCopyFunc is a file setting to replace the function that runs when the
 // message is sent. It should copy the content of the file to the io.Writer.
 //
@@ -177,14 +819,35 @@ func Rename(name string) FileSetting {
 func SetCopyFunc(f func(io.Writer) error) FileSetting {
 	return func(fi *file) {
 		fi.CopyFunc = f
+		fi.size = nil
 	}
 }
 
+// PreloadFile reads the file filename once and returns a file setting copying
+// its content from memory, to be used with Attach or Embed and the same
+// filename. By default, the file is opened again every time a message is
+// written, PreloadFile avoids it when the file is attached to many messages at
+// the cost of keeping its whole content in memory, shared by the messages.
+func PreloadFile(filename string) (FileSetting, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("mailer: could not preload file: %w", err)
+	}
+	return func(f *file) {
+		f.CopyFunc = func(w io.Writer) error {
+			_, err := w.Write(b)
+			return err
+		}
+		f.size = func() int64 { return int64(len(b)) }
+	}, nil
+}
+
 // SetPartEncoding sets the encoding of the part added to the message. By
 // default, parts use the same encoding than the message.
 func SetPartEncoding(e Encoding) PartSetting {
 	return PartSetting(func(p *part) {
 		p.encoding = e
+		p.encodingSet = true
 	})
 }
 
@@ -0,0 +1,218 @@
+package mailer
+
+import (
+	"errors"
+	"io"
+	"strings"
+)
+
+// MessageWriter streams an email to an io.Writer piece by piece, for programs
+// generating emails which do not want to build a Message first. The header
+// fields are written first, then either a single part or multipart entities
+// holding parts, attachments and embedded files:
+//
+//	mw := mailer.NewMessageWriter(w)
+//	mw.WriteAddressHeader("From", "from@example.com", "Example")
+//	mw.WriteHeader("To", "to@example.com")
+//	mw.WriteHeader("Subject", "Report")
+//	mw.StartMultipart("mixed")
+//	mw.StartAlternative()
+//	mw.WritePart("text/plain", func(w io.Writer) error { return text.Execute(w, data) })
+//	mw.WritePart("text/html", func(w io.Writer) error { return html.Execute(w, data) })
+//	mw.EndMultipart()
+//	mw.AddAttachment("report.pdf", f)
+//	err := mw.Close()
+//
+// The errors are sticky: once a method failed, the following ones return the
+// same error. Unlike Message.WriteTo, which writes a complete email in a single
+// call, each method writes its part of the email to w as soon as it is called,
+// so the output is not a valid email until Close ends the multipart entities.
+type MessageWriter struct {
+	w      messageWriter
+	msg    *Message
+	fields map[string]bool
+	body   bool
+	done   bool
+	closed bool
+}
+
+// NewMessageWriter returns a MessageWriter writing an email to w with
+// DefaultCharset. The parts are encoded with DefaultEncoding unless they are
+// given SetPartEncoding.
+func NewMessageWriter(w io.Writer) *MessageWriter {
+	msg := &Message{charset: DefaultCharset, encoding: DefaultEncoding, hEncoder: qEncoding}
+	if msg.encoding == Base64 {
+		msg.hEncoder = bEncoding
+	}
+	return &MessageWriter{
+		w:      messageWriter{w: w},
+		msg:    msg,
+		fields: make(map[string]bool),
+	}
+}
+
+// WriteHeader writes a header field of the email, the values being encoded
+// like with Message.SetHeader. The header fields must be written before the
+// body and the "Bcc" field is ignored.
+func (mw *MessageWriter) WriteHeader(field string, value ...string) error {
+	if err := mw.checkHeader(); err != nil {
+		return err
+	}
+	field = canonicalHeaderKey(field)
+	if isBcc(field) {
+		return nil
+	}
+
+	value = append([]string(nil), value...)
+	mw.msg.encodeHeader(value)
+	mw.fields[field] = true
+	mw.w.writeHeader(field, value...)
+	return mw.w.err
+}
+
+// WriteAddressHeader writes a header field holding an address, formatted like
+// with Message.SetAddressHeader.
+func (mw *MessageWriter) WriteAddressHeader(field, address, name string) error {
+	if err := mw.checkHeader(); err != nil {
+		return err
+	}
+	field = canonicalHeaderKey(field)
+	mw.fields[field] = true
+	mw.w.writeHeader(field, mw.msg.FormatAddress(address, name))
+	return mw.w.err
+}
+
+func (mw *MessageWriter) checkHeader() error {
+	if mw.w.err != nil {
+		return mw.w.err
+	}
+	if mw.body {
+		return errors.New("mailer: the header fields must be written before the body")
+	}
+	return nil
+}
+
+// startBody writes the default header fields before the first part or
+// multipart entity, and checks that the body can still be written.
+func (mw *MessageWriter) startBody() error {
+	if mw.w.err != nil {
+		return mw.w.err
+	}
+	if mw.closed || mw.done {
+		return errors.New("mailer: the body of the email is already complete")
+	}
+	if mw.body {
+		return nil
+	}
+
+	mw.body = true
+	if !mw.fields[canonicalHeaderKey("MIME-Version")] {
+		mw.w.writeString("Mime-Version: 1.0\r\n")
+	}
+	if !mw.fields["Date"] {
+		mw.w.writeHeader("Date", mw.msg.FormatDate(now()))
+	}
+	return mw.w.err
+}
+
+// StartMultipart starts a multipart entity of the given subtype, such as
+// "mixed", "related" or "alternative", in which the following parts are
+// written until EndMultipart is called.
+func (mw *MessageWriter) StartMultipart(subtype string) error {
+	if err := mw.startBody(); err != nil {
+		return err
+	}
+	if int(mw.w.depth) == len(mw.w.writers) {
+		return errors.New("mailer: too many nested multipart entities")
+	}
+	mw.w.openMultipart(strings.ToLower(subtype))
+	return mw.w.err
+}
+
+// StartAlternative starts a multipart/alternative entity, its parts being
+// alternative versions of the same content such as a plain text and an HTML
+// one.
+func (mw *MessageWriter) StartAlternative() error {
+	return mw.StartMultipart("alternative")
+}
+
+// EndMultipart ends the last multipart entity started.
+func (mw *MessageWriter) EndMultipart() error {
+	if mw.w.err != nil {
+		return mw.w.err
+	}
+	if mw.w.depth == 0 {
+		return errors.New("mailer: no multipart entity to end")
+	}
+	mw.w.closeMultipart()
+	if mw.w.depth == 0 {
+		mw.done = true
+	}
+	return mw.w.err
+}
+
+// WritePart writes a part of the given content type, its content being
+// written by f, like Message.AddAlternativeWriter. Outside of a multipart
+// entity, it is the whole body of the email.
+func (mw *MessageWriter) WritePart(contentType string, f func(io.Writer) error, settings ...PartSetting) error {
+	if err := mw.startBody(); err != nil {
+		return err
+	}
+	mw.w.writePart(mw.msg.newPart(contentType, f, settings), mw.msg.charset)
+	mw.leaf()
+	return mw.w.err
+}
+
+// AddAttachment writes a file attachment whose content is read from r, like
+// Message.AttachReader.
+func (mw *MessageWriter) AddAttachment(name string, r io.Reader, settings ...FileSetting) error {
+	return mw.addFile(name, r, settings, true)
+}
+
+// AddEmbedded writes a file embedded in the email whose content is read from
+// r, like Message.EmbedReader. It is usually written in a multipart/related
+// entity along with the HTML part referencing it.
+func (mw *MessageWriter) AddEmbedded(name string, r io.Reader, settings ...FileSetting) error {
+	return mw.addFile(name, r, settings, false)
+}
+
+func (mw *MessageWriter) addFile(name string, r io.Reader, settings []FileSetting, isAttachment bool) error {
+	if err := mw.startBody(); err != nil {
+		return err
+	}
+	files := mw.msg.appendFile(nil, name, readerSettings(r, settings))
+	mw.w.addFiles(files, isAttachment)
+	mw.leaf()
+	return mw.w.err
+}
+
+// leaf records that a part was written, which completes the body when it is
+// not in a multipart entity.
+func (mw *MessageWriter) leaf() {
+	if mw.w.depth == 0 {
+		mw.done = true
+	}
+}
+
+// Close ends the multipart entities which are still open and completes the
+// email. It does not close the underlying io.Writer.
+func (mw *MessageWriter) Close() error {
+	if mw.closed {
+		return mw.w.err
+	}
+	if !mw.body {
+		if mw.startBody() == nil {
+			mw.w.writeString("\r\n")
+		}
+	}
+	for mw.w.depth > 0 {
+		mw.w.closeMultipart()
+	}
+	mw.closed = true
+	return mw.w.err
+}
+
+// Written returns the number of bytes written so far.
+func (mw *MessageWriter) Written() int64 {
+	return mw.w.n
+}
@@ -0,0 +1,68 @@
+package mailer
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMessageWriter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	mw := NewMessageWriter(buf)
+	assert.NoError(t, mw.WriteAddressHeader("From", "from@example.com", "Señor"))
+	assert.NoError(t, mw.WriteHeader("To", "to@example.com"))
+	assert.NoError(t, mw.WriteHeader("Bcc", "bcc@example.com"))
+	assert.NoError(t, mw.WriteHeader("Subject", "Café"))
+	assert.NoError(t, mw.StartMultipart("mixed"))
+	assert.NoError(t, mw.StartAlternative())
+	assert.NoError(t, mw.WritePart("text/plain", newCopier("¡Hola, señor!")))
+	assert.NoError(t, mw.WritePart("text/html", newCopier("<p>¡Hola, señor!</p>"), SetPartEncoding(Base64)))
+	assert.NoError(t, mw.EndMultipart())
+	assert.NoError(t, mw.AddAttachment("test.pdf", strings.NewReader("Content of test.pdf")))
+	assert.EqualError(t, mw.WriteHeader("Cc", "cc@example.com"), "mailer: the header fields must be written before the body")
+	assert.NoError(t, mw.Close())
+	assert.Equal(t, int64(buf.Len()), mw.Written())
+
+	assert.NotContains(t, buf.String(), "bcc@example.com")
+	parsed, err := ParseMessage(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Señor <from@example.com>"}, parsed.Header["From"])
+	assert.Equal(t, []string{"Café"}, parsed.Header["Subject"])
+	assert.Equal(t, []string{"1.0"}, parsed.Header["Mime-Version"])
+	assert.Equal(t, []string{"Wed, 25 Jun 2014 17:46:00 +0000"}, parsed.Header["Date"])
+	if assert.Len(t, parsed.Parts, 3) {
+		assert.Equal(t, "text/plain", parsed.Parts[0].ContentType)
+		assert.Equal(t, "¡Hola, señor!", parsed.Parts[0].Body)
+		assert.Equal(t, "base64", firstValue(parsed.Parts[1].Header, "Content-Transfer-Encoding"))
+		assert.Equal(t, "<p>¡Hola, señor!</p>", parsed.Parts[1].Body)
+		assert.Equal(t, "application/pdf", parsed.Parts[2].ContentType)
+		assert.Equal(t, "Content of test.pdf", parsed.Parts[2].Body)
+	}
+}
+
+func TestMessageWriterSinglePart(t *testing.T) {
+	buf := new(bytes.Buffer)
+	mw := NewMessageWriter(buf)
+	assert.NoError(t, mw.WriteHeader("Date", "Thu, 02 Jan 2020 03:04:05 +0000"))
+	assert.NoError(t, mw.WritePart("text/plain", newCopier("Test")))
+	assert.EqualError(t, mw.WritePart("text/plain", newCopier("Test")), "mailer: the body of the email is already complete")
+	assert.EqualError(t, mw.EndMultipart(), "mailer: no multipart entity to end")
+	assert.NoError(t, mw.Close())
+
+	compareBodies(t, buf.String(), "Date: Thu, 02 Jan 2020 03:04:05 +0000\r\n"+
+		"Mime-Version: 1.0\r\n"+
+		"Content-Type: text/plain; charset=UTF-8\r\n"+
+		"Content-Transfer-Encoding: quoted-printable\r\n"+
+		"\r\n"+
+		"Test")
+}
+
+func TestMessageWriterError(t *testing.T) {
+	mw := NewMessageWriter(errorWriter{io.ErrClosedPipe})
+	assert.Equal(t, io.ErrClosedPipe, mw.WriteHeader("Subject", "Test"))
+	assert.Equal(t, io.ErrClosedPipe, mw.WritePart("text/plain", newCopier("Test")))
+	assert.Equal(t, io.ErrClosedPipe, mw.Close())
+}